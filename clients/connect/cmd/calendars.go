@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// calendarEntry is an item of GET /api/v1/calendars
+type calendarEntry struct {
+	Id         string `json:"id"`
+	Summary    string `json:"summary"`
+	Color      string `json:"color"`
+	AccessRole string `json:"accessRole"`
+	Primary    bool   `json:"primary"`
+}
+
+func fetchCalendars(q *NotificationsQuery) ([]*calendarEntry, error) {
+	u := url.URL{Scheme: "https", Host: q.Host, Path: "/api/v1/calendars"}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+q.Token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, errUserNotFound
+	case 401:
+		return nil, errTokenInvalid
+	default:
+		return nil, fmt.Errorf("unexpected status listing calendars: %v", res.Status)
+	}
+	var cals []*calendarEntry
+	err = json.NewDecoder(res.Body).Decode(&cals)
+	return cals, err
+}
+
+// validateCalendar makes sure the calendar the user asked for is in its calendar list, "primary" is always valid
+func validateCalendar(calendarName string, cals []*calendarEntry) error {
+	if calendarName == "primary" {
+		return nil
+	}
+	for _, c := range cals {
+		if c.Id == calendarName {
+			return nil
+		}
+	}
+	return errUnknownCalendar
+}
+
+// pickCalendar lists the calendars and asks the user to choose one
+func pickCalendar(cals []*calendarEntry) (string, error) {
+	fmt.Println("Which calendar do you want to connect to?")
+	for i, c := range cals {
+		primary := ""
+		if c.Primary {
+			primary = " (primary)"
+		}
+		fmt.Printf("  %d) %s%s [%s]\n", i+1, c.Summary, primary, c.Id)
+	}
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Printf("Enter a number between 1 and %d: ", len(cals))
+		line, err := in.ReadString('\n')
+		if n, convErr := strconv.Atoi(strings.TrimSpace(line)); convErr == nil && n >= 1 && n <= len(cals) {
+			return cals[n-1].Id, nil
+		}
+		// stdin was closed before a valid answer
+		if err != nil {
+			return "", err
+		}
+	}
+}
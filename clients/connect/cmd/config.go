@@ -20,9 +20,11 @@ func getEnvOrDefault(envName, fallback string) string {
 
 type NotificationsQuery struct {
 	Host       string        `url:"-"`
-	Email      string        `url:"email"`
-	Token      string        `url:"token"`
+	Email      string        `url:"-"`
+	Token      string        `url:"-"`
 	Calendar   string        `url:"calendar"`
+	Device     string        `url:"device"`
+	Protocol   int           `url:"protocol"`
 	TimeBefore time.Duration `url:"-"`
 	timeBefore string        `url:"timeBefore"`
 }
@@ -30,6 +32,37 @@ type NotificationsQuery struct {
 var token = flag.String("t", os.Getenv("MEETINGS_API_TOKEN"), "Meetings token to authenticate with the API")
 var calendarName = flag.String("c", "primary", "The calendar you want to inspect, by default: \"primary\"")
 var before = flag.String("b", "30s", "how long before the event starts to fire the notification")
+var device = flag.String("d", defaultDevice(), "Name of this device, events not acknowledged by it are redelivered when it reconnects")
+
+func defaultDevice() string {
+	h, _ := os.Hostname()
+	return h
+}
+
+func calendarFlagPassed() bool {
+	passed := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "c" {
+			passed = true
+		}
+	})
+	return passed
+}
+
+// pickCalendarOnFirstRun lets the user choose among its calendars, falling back to the -c default if they can't be listed
+func pickCalendarOnFirstRun(q *NotificationsQuery) string {
+	cals, err := fetchCalendars(q)
+	if err != nil || len(cals) == 0 {
+		log.Warnf("Could not list your calendars, using %v: %v", q.Calendar, err)
+		return q.Calendar
+	}
+	c, err := pickCalendar(cals)
+	if err != nil {
+		log.Warnf("Could not read your choice, using %v: %v", q.Calendar, err)
+		return q.Calendar
+	}
+	return c
+}
 
 func obtainConfig() (*NotificationsQuery, error) {
 	host := getEnvOrDefault("MEETINGS_SERVER_HOST", "meetings-api.gabrielzim.com")
@@ -37,6 +70,8 @@ func obtainConfig() (*NotificationsQuery, error) {
 	q := NotificationsQuery{
 		Token:    *token,
 		Calendar: *calendarName,
+		Device:   *device,
+		Protocol: protocolV2,
 		Host:     host,
 	}
 	if *token == "" {
@@ -49,13 +84,23 @@ func obtainConfig() (*NotificationsQuery, error) {
 			tAndE := strings.Split(contents, "\n")
 			q.Email = tAndE[0]
 			q.Token = tAndE[1]
+			// the calendar picked on the first run is in the third line
+			if len(tAndE) > 2 && tAndE[2] != "" && !calendarFlagPassed() {
+				q.Calendar = tAndE[2]
+			}
 		} else {
-			email, t, _ := initiateTokenRequestFlow(q.Host)
+			email, t, err := deviceLogin(q.Host, q.Device)
+			if err != nil {
+				log.Errorf("Could not sign in: %v", err)
+			}
 			if len(t) > 0 {
-				f.WriteString(fmt.Sprintf("%s\n%s", email, t)) // write email in first line, token in second line
-				log.Infof("Token written to: %v", tokenPath)
 				q.Token = t
 				q.Email = email
+				if !calendarFlagPassed() {
+					q.Calendar = pickCalendarOnFirstRun(&q)
+				}
+				f.WriteString(fmt.Sprintf("%s\n%s\n%s", email, t, q.Calendar)) // write email in first line, token in second line, calendar in the third
+				log.Infof("Token written to: %v", tokenPath)
 			}
 		}
 
@@ -70,11 +115,3 @@ func obtainConfig() (*NotificationsQuery, error) {
 	q.timeBefore = q.TimeBefore.String()
 	return &q, nil
 }
-
-func initiateTokenRequestFlow(host string) (string, string, error) {
-	fmt.Printf("Please: go to this link: https://%v/auth/google and paste here the token you obtain after signing in and press enter.\n", host)
-	var email string
-	var token string
-	_, err := fmt.Scanf("%s %s", &email, &token)
-	return email, token, err
-}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var errDeviceLoginExpired = errors.New("DEVICE_LOGIN_EXPIRED")
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+	Error string `json:"error"`
+}
+
+// deviceLogin shows the user a code to enter in any browser and waits until they sign in, it returns the email and api token of the user
+func deviceLogin(host, device string) (string, string, error) {
+	var code deviceCodeResponse
+	err := postForm(host, "/auth/device/code", url.Values{"device": {device}}, &code)
+	if err != nil {
+		return "", "", err
+	}
+	fmt.Printf("To sign in, go to %v and enter the code %v\n(or open %v)\n", code.VerificationURI, code.UserCode, code.VerificationURIComplete)
+
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+		var t deviceTokenResponse
+		if err := postForm(host, "/auth/device/token", url.Values{"device_code": {code.DeviceCode}}, &t); err != nil {
+			return "", "", err
+		}
+		switch t.Error {
+		case "":
+			return t.Email, t.Token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		case "expired_token":
+			return "", "", errDeviceLoginExpired
+		default:
+			return "", "", fmt.Errorf("signing in: %v", t.Error)
+		}
+	}
+	return "", "", errDeviceLoginExpired
+}
+
+// postForm posts params to the api and decodes the json response in v, 400s are decoded too since they carry the error of the device flow
+func postForm(host, path string, params url.Values, v interface{}) error {
+	u := url.URL{Scheme: "https", Host: host, Path: path}
+	res, err := http.PostForm(u.String(), params)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 400 {
+		return fmt.Errorf("unexpected status from %v: %v", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"github.com/google/go-querystring/query"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"google.golang.org/api/calendar/v3"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
@@ -15,14 +18,32 @@ import (
 )
 
 const (
-	pongWait = 45 * time.Second
+	pongWait   = 45 * time.Second
+	protocolV2 = 2
 )
 
+// frame is what the server sends over a protocol v2 connection, we only care about events and errors
+type frame struct {
+	Type        string          `json:"type"`
+	Error       string          `json:"error,omitempty"`
+	Code        string          `json:"code,omitempty"`
+	Seq         uint64          `json:"seq,omitempty"`
+	Redelivered bool            `json:"redelivered,omitempty"`
+	Event       *calendar.Event `json:"event,omitempty"`
+}
+
+type ackCommand struct {
+	Type string `json:"type"`
+	Seq  uint64 `json:"seq"`
+}
+
 var (
-	errNoToken      = errors.New("NO_API_TOKEN")
-	errUserNotFound = errors.New("EMAIl_NOT_FOUND_IN_DB")
-	errTokenInvalid = errors.New("INVALID_TOKEN_FOR_EMAIL")
-	errBadDuration  = errors.New("BAD_DURATION_PASSED_IN")
+	errNoToken         = errors.New("NO_API_TOKEN")
+	errUserNotFound    = errors.New("EMAIl_NOT_FOUND_IN_DB")
+	errTokenInvalid    = errors.New("INVALID_TOKEN_FOR_EMAIL")
+	errBadDuration     = errors.New("BAD_DURATION_PASSED_IN")
+	errUnknownCalendar = errors.New("CALENDAR_NOT_IN_CALENDAR_LIST")
+	errReauthRequired  = errors.New("GOOGLE_ACCESS_REVOKED")
 )
 
 func connectToWs(q *NotificationsQuery) (*websocket.Conn, error) {
@@ -30,13 +51,17 @@ func connectToWs(q *NotificationsQuery) (*websocket.Conn, error) {
 
 	u := url.URL{Scheme: "wss", Host: q.Host, Path: "/notifications", RawQuery: qs.Encode()}
 
-	c, res, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+q.Token)
+	c, res, err := websocket.DefaultDialer.Dial(u.String(), header)
 	if res != nil && res.StatusCode > 300 {
 		switch res.StatusCode {
 		case 404:
 			return c, errUserNotFound
 		case 401:
 			return c, errTokenInvalid
+		case 403:
+			return c, errReauthRequired
 		}
 	}
 	return c, err
@@ -49,11 +74,19 @@ func main() {
 	interrupt := make(chan os.Signal, 1)
 	signal.Notify(interrupt, syscall.SIGKILL)
 
+	flag.Parse()
 	q, err := obtainConfig()
 	if err != nil {
 		HandleConfigErrors(err, log, q)
 	}
 
+	cals, err := fetchCalendars(q)
+	if err != nil {
+		log.Warnf("Could not list your calendars to validate %v: %v", q.Calendar, err)
+	} else if err := validateCalendar(q.Calendar, cals); err != nil {
+		HandleConfigErrors(err, log, q)
+	}
+
 	conn, err := connectToWs(q)
 	if err != nil {
 		log.Fatalf("Error connecting to ws: %v", err)
@@ -80,16 +113,23 @@ func main() {
 
 	for {
 		select {
-		case e, ok := <-events:
+		case f, ok := <-events:
 			if !ok {
 				disconnect()
 				return
 			}
-			err := enc.Encode(e)
+			err := enc.Encode(f.Event)
 			if err != nil {
 				disconnect()
 				return
 			}
+			// only ack once the event made it to stdout, otherwise the server will redeliver it next time we connect
+			if f.Seq > 0 {
+				err = conn.WriteJSON(ackCommand{Type: "ack", Seq: f.Seq})
+				if err != nil {
+					log.Errorf("could not ack event: %v", err)
+				}
+			}
 		case <-ticker.C:
 			conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pongWait))
 		case <-interrupt:
@@ -111,27 +151,50 @@ func HandleConfigErrors(err error, log *zap.SugaredLogger, q *NotificationsQuery
 	if errors.Is(err, errNoToken) {
 		log.Fatalf(`You don't have a token set. If you have one, you can set it on MEETINGS_API_TOKEN or if you have more than one, pass it using -t.
 If you don't have one, you can obtain one from %v/auth/google.`, q.Host)
+	} else if errors.Is(err, errUnknownCalendar) {
+		msg := fmt.Sprintf("Calendar %q is not in your calendar list. Your calendars are:", q.Calendar)
+		if cals, err := fetchCalendars(q); err == nil {
+			for _, c := range cals {
+				msg += fmt.Sprintf("\n  %s (%s)", c.Id, c.Summary)
+			}
+		}
+		log.Fatal(msg)
 	} else if errors.Is(err, errBadDuration) {
 		log.Fatalf(`The duration you passed in is wrong. You passed in: %v. Valid examples are: 30s, 1m, 0s.`, *before)
 	}
 	panic(err)
 }
 
-// ReadEventsFromWs takes in a websocket connections and a duration `d`, receives events from the ws and returns a channel that emits events `d` moments before they start
-func ReadEventsFromWs(log *zap.SugaredLogger, c *websocket.Conn) <-chan *calendar.Event {
-	es := make(chan *calendar.Event, 100)
+// closeDeviceReplaced is the close code the server sends when another connection for the same device took over
+const closeDeviceReplaced = 4009
+
+// ReadEventsFromWs takes in a websocket connection and returns a channel with the event frames received from it
+func ReadEventsFromWs(log *zap.SugaredLogger, c *websocket.Conn) <-chan *frame {
+	es := make(chan *frame, 100)
 
 	go func() {
 		// read from ws
 		defer close(es)
 		for {
-			var e calendar.Event
-			err := c.ReadJSON(&e)
-			if err != nil {
-				log.Errorf("read:", err)
+			var f frame
+			err := c.ReadJSON(&f)
+			if websocket.IsCloseError(err, closeDeviceReplaced) {
+				log.Errorf("Another connection for device %q took over, give every client its own name with -d", *device)
+				return
+			} else if err != nil {
+				log.Errorf("read: %v", err)
 				return
 			}
-			es <- &e
+			switch f.Type {
+			case "event":
+				es <- &f
+			case "error":
+				if f.Code == "reauth_required" {
+					log.Errorf("Google revoked our access to your calendar, sign in again and get a new token")
+					return
+				}
+				log.Errorf("error from server: %v", f.Error)
+			}
 		}
 	}()
 
@@ -0,0 +1,65 @@
+// Package grpcclient connects to the meetings grpc api and receives calendar events, it's the grpc alternative to the connect binary.
+package grpcclient
+
+import (
+	"context"
+
+	"github.com/gabzim/meetings/server/grpcapi"
+	"github.com/gabzim/meetings/server/grpcapi/meetingspb"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+type Client struct {
+	conn  *grpc.ClientConn
+	api   meetingspb.MeetingsClient
+	token string
+}
+
+// Dial connects to the grpc api at addr (host:port) over TLS, unless opts say otherwise (eg: grpc.WithTransportCredentials(insecure.NewCredentials()) for local development).
+// The token alone identifies the user.
+func Dial(addr, token string, opts ...grpc.DialOption) (*Client, error) {
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(credentials.NewClientTLSFromCert(nil, ""))}, opts...)
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{conn: conn, api: meetingspb.NewMeetingsClient(conn), token: token}, nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Subscribe opens a stream of events for the given calendar. The channel is closed when ctx is done or the stream breaks, in which case the error is sent to errs.
+// Cancel ctx to stop reading events, the stream isn't closed otherwise.
+func (c *Client) Subscribe(ctx context.Context, calendarName string) (<-chan *calendar.Event, <-chan error, error) {
+	ctx = metadata.AppendToOutgoingContext(ctx, grpcapi.AuthorizationMetadataKey, "Bearer "+c.token)
+	stream, err := c.api.Subscribe(ctx, &meetingspb.SubscriptionRequest{Calendar: calendarName})
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(chan *calendar.Event, 100)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(events)
+		for {
+			m, err := stream.Recv()
+			if err != nil {
+				if ctx.Err() == nil {
+					errs <- err
+				}
+				return
+			}
+			// the consumer may have stopped reading, canceling ctx ends the stream and this goroutine
+			select {
+			case events <- m.ToCalendarEvent():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, errs, nil
+}
@@ -1,7 +1,436 @@
+// Package calendarsync mirrors the events of a calendar into another one as private busy blocks, the calendars can belong to different
+// google accounts. Blocks are tagged with private extended properties so they can be found, updated and deleted when their event changes,
+// and so they're never mirrored themselves.
 package calendarsync
 
-import "google.golang.org/api/calendar/v3"
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
-func SyncEvent(e *calendar.Event, srv *calendar.Service) {
-	srv.Events.Insert("id", e)
+	"github.com/gabzim/meetings/server/calendarwh"
+	"github.com/gabzim/meetings/server/services/auth"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// MirrorProperty is the private extended property blocks are tagged with, its value is the id of the mirror that wrote them
+	MirrorProperty = "meetingsMirror"
+	// SourceProperty is the id of the event a block mirrors
+	SourceProperty = "meetingsSource"
+	// BlockSummary is the title of every block
+	BlockSummary = "Busy"
+)
+
+// IsBlock tells whether e was written by a mirror, blocks are never mirrored so two mirrors in opposite directions don't feed each other
+func IsBlock(e *calendar.Event) bool {
+	return e.ExtendedProperties != nil && e.ExtendedProperties.Private[MirrorProperty] != ""
+}
+
+// NeedsBlock tells whether e makes its calendar busy: it's not cancelled, not marked as free and its owner didn't decline it
+func NeedsBlock(e *calendar.Event) bool {
+	if e.Status == "cancelled" || e.Transparency == "transparent" || IsBlock(e) {
+		return false
+	}
+	for _, a := range e.Attendees {
+		if a.Self && a.ResponseStatus == "declined" {
+			return false
+		}
+	}
+	return e.Start != nil && e.End != nil
+}
+
+// BlockId is the id of the block mirroring the event eventId. Ids are derived from the mirror and the event so every server writing
+// blocks agrees on them and a block is never written twice. Google only takes base32hex characters, hex is a subset.
+func BlockId(mirrorId, eventId string) string {
+	sum := sha256.Sum256([]byte(mirrorId + "/" + eventId))
+	return "mm" + hex.EncodeToString(sum[:20])
+}
+
+// Block is the private busy block mirroring e, it only keeps when it happens
+func Block(mirrorId string, e *calendar.Event) *calendar.Event {
+	return &calendar.Event{
+		Id:           BlockId(mirrorId, e.Id),
+		Summary:      BlockSummary,
+		Start:        &calendar.EventDateTime{Date: e.Start.Date, DateTime: e.Start.DateTime, TimeZone: e.Start.TimeZone},
+		End:          &calendar.EventDateTime{Date: e.End.Date, DateTime: e.End.DateTime, TimeZone: e.End.TimeZone},
+		Status:       "confirmed",
+		Transparency: "opaque",
+		Visibility:   "private",
+		Reminders:    &calendar.EventReminders{UseDefault: false, ForceSendFields: []string{"UseDefault"}},
+		ExtendedProperties: &calendar.EventExtendedProperties{
+			Private: map[string]string{MirrorProperty: mirrorId, SourceProperty: e.Id},
+		},
+	}
+}
+
+// Syncer keeps the blocks (or copies, with a Rule) of a mirror up to date in its target calendar
+type Syncer struct {
+	mirrorId   string
+	user       *auth.UserToken
+	srv        *calendar.Service
+	calendarId string
+	rule       *Rule
+	// written is the state of the block last written by source event ("" once deleted), so syncs of events that didn't change
+	// don't hit google. It's the times of blocks and the source hash of copies.
+	mu        sync.Mutex
+	written   map[string]string
+	conflicts map[string]*Change
+}
+
+// NewSyncer returns a syncer writing the blocks of the mirror into calendarId, srv has to act on behalf of t
+func NewSyncer(mirrorId string, t *auth.UserToken, srv *calendar.Service, calendarId string) *Syncer {
+	return &Syncer{mirrorId: mirrorId, user: t, srv: srv, calendarId: calendarId, written: make(map[string]string), conflicts: make(map[string]*Change)}
+}
+
+// CopyWith makes the syncer write copies of the events following the rule instead of busy blocks
+func (s *Syncer) CopyWith(rule *Rule) {
+	s.rule = rule
+}
+
+// SyncEvent writes, moves or deletes the block of e. It fails with an auth.ScopeError if the user hasn't granted auth.FeatureMirror.
+func (s *Syncer) SyncEvent(ctx context.Context, e *calendar.Event) error {
+	if IsBlock(e) {
+		if !s.sendsBack(e) {
+			return nil
+		}
+		ch, err := s.planBack(ctx, e)
+		if err != nil || ch == nil {
+			return err
+		}
+		return s.Apply(ctx, []*Change{ch})
+	}
+	state := s.state(e)
+	s.mu.Lock()
+	last, known := s.written[e.Id]
+	s.mu.Unlock()
+	if known && last == state {
+		return nil
+	}
+	var ch *Change
+	if s.rule == nil {
+		// blocks have nothing of their own, write or delete them without looking
+		action := ActionInsert
+		if state == "" {
+			action = ActionDelete
+		}
+		ch = s.change(action, BlockId(s.mirrorId, e.Id), e)
+		ch.event = Block(s.mirrorId, e)
+		ch.state = state
+	} else {
+		cur, err := s.getEvent(ctx, BlockId(s.mirrorId, e.Id))
+		if err != nil {
+			return auth.CheckScopeError(err, auth.FeatureMirror)
+		}
+		if ch, err = s.planEvent(ctx, e, cur); err != nil {
+			return err
+		}
+	}
+	if ch == nil {
+		s.remember(e.Id, state)
+		return nil
+	}
+	return s.Apply(ctx, []*Change{ch})
+}
+
+// Copies returns the blocks or copies of the mirror in the target calendar that haven't ended yet, as far as the webhooks look ahead
+func (s *Syncer) Copies(ctx context.Context) ([]*calendar.Event, error) {
+	copies := make([]*calendar.Event, 0)
+	err := s.eachBlock(ctx, time.Now().Add(calendarwh.Window), func(b *calendar.Event) error {
+		copies = append(copies, b)
+		return nil
+	})
+	return copies, err
+}
+
+// Plan returns the changes that make copies (the blocks or copies in the target calendar, see Copies) match events, every event of the
+// source calendar from now on. Nothing is written, pass them to Apply for that.
+func (s *Syncer) Plan(ctx context.Context, events, copies []*calendar.Event) ([]*Change, error) {
+	existing := make(map[string]*calendar.Event, len(copies))
+	for _, c := range copies {
+		existing[privateProperties(c)[SourceProperty]] = c
+	}
+	changes := make([]*Change, 0)
+	for _, e := range events {
+		cur := existing[e.Id]
+		delete(existing, e.Id)
+		ch, err := s.planEvent(ctx, e, cur)
+		if err != nil {
+			return nil, err
+		}
+		if ch != nil {
+			changes = append(changes, ch)
+		} else if !IsBlock(e) {
+			s.remember(e.Id, s.state(e))
+		}
+	}
+	// events deleted while nothing was syncing
+	for _, c := range copies {
+		source := privateProperties(c)[SourceProperty]
+		if _, ok := existing[source]; ok {
+			ch := s.change(ActionDelete, c.Id, c)
+			ch.SourceId = source
+			changes = append(changes, ch)
+		}
+	}
+	return changes, nil
+}
+
+// Apply makes the changes, conflicts are left alone and kept until they're solved (see Conflicts)
+func (s *Syncer) Apply(ctx context.Context, changes []*Change) error {
+	for _, ch := range changes {
+		if ch.Action == ActionConflict {
+			s.mu.Lock()
+			s.conflicts[ch.SourceId] = ch
+			s.mu.Unlock()
+			continue
+		}
+		if err := s.user.RequireFeature(auth.FeatureMirror); err != nil {
+			return err
+		}
+		var err error
+		switch ch.Action {
+		case ActionInsert:
+			err = s.writeBlock(ctx, ch.event)
+		case ActionUpdate:
+			_, err = s.srv.Events.Update(s.calendarId, ch.Id, ch.event).Context(ctx).Do()
+		case ActionDelete:
+			err = s.deleteBlock(ctx, ch.Id)
+		case ActionUpdateSource:
+			_, err = s.srv.Events.Patch(s.calendarId, ch.Id, ch.event).Context(ctx).Do()
+		}
+		if err != nil {
+			return auth.CheckScopeError(err, auth.FeatureMirror)
+		}
+		if ch.Action != ActionUpdateSource {
+			s.remember(ch.SourceId, ch.state)
+		}
+	}
+	return nil
+}
+
+// Conflicts returns the copies that weren't updated because both them and their events were edited
+func (s *Syncer) Conflicts() []*Change {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conflicts := make([]*Change, 0, len(s.conflicts))
+	for _, ch := range s.conflicts {
+		conflicts = append(conflicts, ch)
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Start < conflicts[j].Start })
+	return conflicts
+}
+
+// Reconcile makes the blocks from now on match events, every event of the source calendar from now on. It catches up with what
+// changed while nothing was syncing.
+func (s *Syncer) Reconcile(ctx context.Context, events []*calendar.Event) error {
+	copies, err := s.Copies(ctx)
+	if err != nil {
+		return err
+	}
+	changes, err := s.Plan(ctx, events, copies)
+	if err != nil {
+		return err
+	}
+	return s.Apply(ctx, changes)
+}
+
+// RemoveAll deletes every block of the mirror from now on, it's used when the mirror is deleted
+func (s *Syncer) RemoveAll(ctx context.Context) error {
+	return s.eachBlock(ctx, time.Time{}, func(b *calendar.Event) error {
+		return s.deleteBlock(ctx, b.Id)
+	})
+}
+
+// planEvent returns the change the block or copy of e (cur, nil if there's none) needs, nil if it's up to date
+func (s *Syncer) planEvent(ctx context.Context, e *calendar.Event, cur *calendar.Event) (*Change, error) {
+	if IsBlock(e) {
+		if s.sendsBack(e) {
+			return s.planBack(ctx, e)
+		}
+		return nil, nil
+	}
+	state := s.state(e)
+	if state == "" {
+		if cur == nil {
+			return nil, nil
+		}
+		return s.change(ActionDelete, cur.Id, e), nil
+	}
+	want := s.desired(e)
+	ch := s.change(ActionInsert, want.Id, e)
+	ch.event = want
+	ch.state = state
+	if cur == nil {
+		return ch, nil
+	}
+	ch.Action = ActionUpdate
+	if s.rule == nil {
+		if eventTime(cur.Start) == eventTime(want.Start) && eventTime(cur.End) == eventTime(want.End) {
+			return nil, nil
+		}
+		return ch, nil
+	}
+	props := privateProperties(cur)
+	sourceChanged := props[SourceHashProperty] != state
+	copyEdited := s.rule.copyHash(cur) != props[CopyHashProperty]
+	switch {
+	case !sourceChanged:
+		// edits made to copies of one way rules stay until their events change
+		return nil, nil
+	case !copyEdited || !s.rule.TwoWay || s.rule.copyHash(cur) == s.rule.copyHash(want):
+		return ch, nil
+	default:
+		ch.Action = ActionConflict
+		ch.event = nil
+		return ch, nil
+	}
+}
+
+// sendsBack tells whether c is a copy this syncer sends the edits of back to its event: a copy the other direction of a two way
+// mirror wrote into the source calendar
+func (s *Syncer) sendsBack(c *calendar.Event) bool {
+	return s.rule != nil && s.rule.TwoWay && s.srv != nil && privateProperties(c)[MirrorProperty] == s.mirrorId
+}
+
+// planBack returns the update that sends the edits made to the copy c back to its event, which is in the target calendar of the syncer
+func (s *Syncer) planBack(ctx context.Context, c *calendar.Event) (*Change, error) {
+	props := privateProperties(c)
+	if c.Status == "cancelled" || s.rule.copyHash(c) == props[CopyHashProperty] {
+		return nil, nil
+	}
+	e, err := s.getEvent(ctx, props[SourceProperty])
+	if err != nil || e == nil {
+		// if the event is gone the other direction deletes the copy
+		return nil, err
+	}
+	if sourceHash(e) != props[SourceHashProperty] {
+		// both were edited, the other direction tells about the conflict
+		return nil, nil
+	}
+	patch := &calendar.Event{Summary: strings.TrimPrefix(c.Summary, s.rule.Prefix), Start: c.Start, End: c.End}
+	if !s.rule.Redact {
+		patch.Location = c.Location
+	}
+	ch := s.change(ActionUpdateSource, e.Id, c)
+	ch.SourceId = c.Id
+	ch.event = patch
+	return ch, nil
+}
+
+// state is what the block or copy of e looks like, "" if e doesn't need one
+func (s *Syncer) state(e *calendar.Event) string {
+	if s.rule == nil {
+		if !NeedsBlock(e) {
+			return ""
+		}
+		return eventTime(e.Start) + "/" + eventTime(e.End)
+	}
+	if !s.rule.Wants(e) {
+		return ""
+	}
+	return sourceHash(e)
+}
+
+func (s *Syncer) desired(e *calendar.Event) *calendar.Event {
+	if s.rule == nil {
+		return Block(s.mirrorId, e)
+	}
+	return Copy(s.mirrorId, e, s.rule)
+}
+
+func (s *Syncer) change(action, id string, e *calendar.Event) *Change {
+	ch := &Change{Action: action, Calendar: s.calendarId, Id: id, SourceId: e.Id, Summary: e.Summary}
+	if e.Start != nil {
+		ch.Start = e.Start.Date + e.Start.DateTime
+	}
+	return ch
+}
+
+// remember keeps the state written for the source event and forgets its conflict
+func (s *Syncer) remember(sourceId, state string) {
+	s.mu.Lock()
+	s.written[sourceId] = state
+	delete(s.conflicts, sourceId)
+	s.mu.Unlock()
+}
+
+// getEvent returns the event with the given id in the target calendar, nil if there's none or it was deleted
+func (s *Syncer) getEvent(ctx context.Context, id string) (*calendar.Event, error) {
+	e, err := s.srv.Events.Get(s.calendarId, id).Context(ctx).Do()
+	if isStatus(err, http.StatusNotFound) || isStatus(err, http.StatusGone) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if e.Status == "cancelled" {
+		return nil, nil
+	}
+	return e, nil
+}
+
+// writeBlock inserts the block, or updates it if it was written before (even if it was deleted since)
+func (s *Syncer) writeBlock(ctx context.Context, b *calendar.Event) error {
+	_, err := s.srv.Events.Insert(s.calendarId, b).Context(ctx).Do()
+	if isStatus(err, http.StatusConflict) {
+		_, err = s.srv.Events.Update(s.calendarId, b.Id, b).Context(ctx).Do()
+	}
+	return err
+}
+
+func (s *Syncer) deleteBlock(ctx context.Context, id string) error {
+	err := s.srv.Events.Delete(s.calendarId, id).Context(ctx).Do()
+	if isStatus(err, http.StatusNotFound) || isStatus(err, http.StatusGone) {
+		return nil
+	}
+	return err
+}
+
+// eachBlock calls f with every block of the mirror in the target calendar that hasn't ended yet and starts before until (if it's set)
+func (s *Syncer) eachBlock(ctx context.Context, until time.Time, f func(b *calendar.Event) error) error {
+	q := s.srv.Events.List(s.calendarId).
+		PrivateExtendedProperty(MirrorProperty + "=" + s.mirrorId).
+		SingleEvents(true).
+		TimeMin(time.Now().Format(time.RFC3339))
+	if !until.IsZero() {
+		q.TimeMax(until.Format(time.RFC3339))
+	}
+	return q.Pages(ctx, func(page *calendar.Events) error {
+		for _, b := range page.Items {
+			if b.Status == "cancelled" {
+				continue
+			}
+			if err := f(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// UpcomingEvents returns the events of the calendar from now to as far as the webhooks look ahead, Reconcile needs them
+func UpcomingEvents(ctx context.Context, srv *calendar.Service, calendarId string) ([]*calendar.Event, error) {
+	events := make([]*calendar.Event, 0)
+	now := time.Now()
+	err := srv.Events.List(calendarId).
+		SingleEvents(true).
+		TimeMin(now.Format(time.RFC3339)).
+		TimeMax(now.Add(calendarwh.Window).Format(time.RFC3339)).
+		Pages(ctx, func(page *calendar.Events) error {
+			events = append(events, page.Items...)
+			return nil
+		})
+	return events, err
+}
+
+func isStatus(err error, code int) bool {
+	var gErr *googleapi.Error
+	return errors.As(err, &gErr) && gErr.Code == code
 }
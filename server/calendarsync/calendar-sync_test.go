@@ -0,0 +1,159 @@
+package calendarsync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gabzim/meetings/server/services/auth"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+func TestPlanEvent(t *testing.T) {
+	oneWay := &Rule{Prefix: "[p] "}
+	twoWay := &Rule{Prefix: "[p] ", TwoWay: true}
+	e := testEvent("e1", "Standup", "2030-01-07T09:00:00+01:00", "2030-01-07T10:00:00+01:00")
+	changed := with(e, func(e *calendar.Event) { e.Summary = "Standup moved" })
+	editedCopy := func(r *Rule) *calendar.Event {
+		return with(Copy("1", e, r), func(c *calendar.Event) { c.Summary = "[p] Mine" })
+	}
+	tests := []struct {
+		name string
+		rule *Rule
+		e    *calendar.Event
+		cur  *calendar.Event
+		want string
+	}{
+		{"no copy yet", oneWay, e, nil, ActionInsert},
+		{"copy up to date", oneWay, e, Copy("1", e, oneWay), ""},
+		{"source changed", oneWay, changed, Copy("1", e, oneWay), ActionUpdate},
+		{"copy edited, one way", oneWay, e, editedCopy(oneWay), ""},
+		// the edit goes back to the event through the other direction, see planBack
+		{"copy edited, two way", twoWay, e, editedCopy(twoWay), ""},
+		{"both edited, one way", oneWay, changed, editedCopy(oneWay), ActionUpdate},
+		{"both edited, two way", twoWay, changed, editedCopy(twoWay), ActionConflict},
+		{"both edited the same way", twoWay, with(e, func(e *calendar.Event) { e.Summary = "Mine" }), editedCopy(twoWay), ActionUpdate},
+		{"event cancelled", oneWay, with(e, func(e *calendar.Event) { e.Status = "cancelled" }), Copy("1", e, oneWay), ActionDelete},
+		{"event cancelled without a copy", oneWay, with(e, func(e *calendar.Event) { e.Status = "cancelled" }), nil, ""},
+		{"copies aren't copied", oneWay, Copy("2", e, oneWay), nil, ""},
+		{"block up to date", nil, e, Block("1", e), ""},
+		{"block with the times in another offset", nil, e, with(Block("1", e), func(b *calendar.Event) {
+			b.Start = &calendar.EventDateTime{DateTime: "2030-01-07T08:00:00Z"}
+			b.End = &calendar.EventDateTime{DateTime: "2030-01-07T09:00:00Z"}
+		}), ""},
+		{"event moved", nil, with(e, func(e *calendar.Event) { e.End = &calendar.EventDateTime{DateTime: "2030-01-07T11:00:00+01:00"} }), Block("1", e), ActionUpdate},
+		{"event marked as free", nil, with(e, func(e *calendar.Event) { e.Transparency = "transparent" }), Block("1", e), ActionDelete},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSyncer("1", &auth.UserToken{}, nil, "target")
+			if tt.rule != nil {
+				s.CopyWith(tt.rule)
+			}
+			ch, err := s.planEvent(context.Background(), tt.e, tt.cur)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if ch != nil {
+				got = ch.Action
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeCalendar answers the event gets of a syncer sending edits back, it holds one event
+type fakeCalendar struct {
+	mu sync.Mutex
+	e  *calendar.Event
+}
+
+func (f *fakeCalendar) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/events/"+f.e.Id) {
+		w.WriteHeader(404)
+		return
+	}
+	json.NewEncoder(w).Encode(f.e)
+}
+
+func (f *fakeCalendar) set(e *calendar.Event) {
+	f.mu.Lock()
+	f.e = e
+	f.mu.Unlock()
+}
+
+// TestTwoWayRoundTrip edits the copy of an event and follows the edit back to the event and into the copy again, nothing has to be
+// written after that
+func TestTwoWayRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	rule := &Rule{Prefix: "[p] ", TwoWay: true}
+	e := testEvent("e1", "Standup", "2030-01-07T09:00:00+01:00", "2030-01-07T10:00:00+01:00")
+	source := &fakeCalendar{e: e}
+	server := httptest.NewServer(source)
+	defer server.Close()
+	sourceSrv, err := calendar.NewService(ctx, option.WithHTTPClient(server.Client()), option.WithEndpoint(server.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// forward copies the events of the source calendar into the target one, reverse the other way round and sends the edits of the
+	// copies in the target calendar back to the source calendar
+	forward := NewSyncer("1", &auth.UserToken{}, nil, "target")
+	forward.CopyWith(rule)
+	reverse := NewSyncer("1", &auth.UserToken{}, sourceSrv, "source")
+	reverse.CopyWith(rule)
+
+	ch := plan(t, forward, e, nil, ActionInsert)
+	c := ch.event
+	// the copy shows up in the target calendar, it's neither copied back nor sent back
+	plan(t, reverse, c, nil, "")
+
+	edited := with(c, func(c *calendar.Event) {
+		c.Summary = "[p] Standup moved"
+		c.Start = &calendar.EventDateTime{DateTime: "2030-01-07T09:30:00+01:00"}
+	})
+	back := plan(t, reverse, edited, nil, ActionUpdateSource)
+	if back.Id != e.Id || back.event.Summary != "Standup moved" || back.event.Start.DateTime != edited.Start.DateTime {
+		t.Fatalf("sent back %+v to %v", back.event, back.Id)
+	}
+	if back.event.Description != "" || back.event.Attendees != nil {
+		t.Errorf("sent back more than the summary, the times and the location")
+	}
+
+	// google patches the event and tells the forward direction about it
+	patched := with(e, func(e *calendar.Event) { e.Summary, e.Start = back.event.Summary, back.event.Start })
+	source.set(patched)
+	ch = plan(t, forward, patched, edited, ActionUpdate)
+	rewritten := ch.event
+	if rewritten.Summary != edited.Summary {
+		t.Errorf("rewrote the copy as %q, want %q", rewritten.Summary, edited.Summary)
+	}
+	plan(t, reverse, rewritten, nil, "")
+	plan(t, forward, patched, rewritten, "")
+}
+
+// plan plans the sync of e with s, cur is its copy, and checks the action is want ("" for nothing to do)
+func plan(t *testing.T, s *Syncer, e, cur *calendar.Event, want string) *Change {
+	t.Helper()
+	ch, err := s.planEvent(context.Background(), e, cur)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	if ch != nil {
+		got = ch.Action
+	}
+	if got != want {
+		t.Fatalf("planning %q into %v got %q, want %q", e.Summary, s.calendarId, got, want)
+	}
+	return ch
+}
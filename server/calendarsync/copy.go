@@ -0,0 +1,145 @@
+package calendarsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/gabzim/meetings/server/eventfilter"
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	// SourceHashProperty is the hash of the copied fields of the event when its copy was written, it tells whether the event changed since
+	SourceHashProperty = "meetingsSourceHash"
+	// CopyHashProperty is the hash of the fields of a copy that can be edited when it was written, it tells whether someone edited the copy since
+	CopyHashProperty = "meetingsCopyHash"
+)
+
+// Rule makes a mirror copy events instead of writing busy blocks
+type Rule struct {
+	// Redact leaves the description, location and attendees out of the copies
+	Redact bool `json:"redact,omitempty"`
+	// Prefix is added to the summary of the copies, eg: "[personal] "
+	Prefix string `json:"prefix,omitempty"`
+	// Color is the color of every copy (a name like sage or a google color id), copies keep the color of their event if it's empty
+	Color string `json:"color,omitempty"`
+	// Filter selects the events to copy, every event that isn't cancelled or declined is copied without one
+	Filter *eventfilter.Filter `json:"filter,omitempty"`
+	// TwoWay copies the events of the target calendar into the source calendar too, and sends the edits made to copies back to their events
+	TwoWay bool `json:"twoWay,omitempty"`
+}
+
+// Validate returns an error if the color or the filter are not valid
+func (r *Rule) Validate() error {
+	if r.Color != "" {
+		if _, err := eventfilter.ColorId(r.Color); err != nil {
+			return err
+		}
+	}
+	if r.Filter != nil {
+		return r.Filter.Validate()
+	}
+	return nil
+}
+
+// Wants tells whether e has to be copied
+func (r *Rule) Wants(e *calendar.Event) bool {
+	if e.Status == "cancelled" || IsBlock(e) || e.Start == nil || e.End == nil {
+		return false
+	}
+	for _, a := range e.Attendees {
+		if a.Self && a.ResponseStatus == "declined" {
+			return false
+		}
+	}
+	return r.Filter.Match(e)
+}
+
+// Copy is the copy of e the rule writes, tagged like a block so it's never copied itself
+func Copy(mirrorId string, e *calendar.Event, r *Rule) *calendar.Event {
+	c := &calendar.Event{
+		Id:           BlockId(mirrorId, e.Id),
+		Summary:      r.Prefix + e.Summary,
+		Start:        &calendar.EventDateTime{Date: e.Start.Date, DateTime: e.Start.DateTime, TimeZone: e.Start.TimeZone},
+		End:          &calendar.EventDateTime{Date: e.End.Date, DateTime: e.End.DateTime, TimeZone: e.End.TimeZone},
+		Status:       "confirmed",
+		Transparency: e.Transparency,
+		Visibility:   e.Visibility,
+		ColorId:      e.ColorId,
+		Reminders:    &calendar.EventReminders{UseDefault: false, ForceSendFields: []string{"UseDefault"}},
+		ExtendedProperties: &calendar.EventExtendedProperties{
+			Private: map[string]string{MirrorProperty: mirrorId, SourceProperty: e.Id, SourceHashProperty: sourceHash(e)},
+		},
+	}
+	if r.Color != "" {
+		c.ColorId, _ = eventfilter.ColorId(r.Color)
+	}
+	if !r.Redact {
+		// attendees go in the description, adding them to the copy would invite them again
+		c.Description = e.Description
+		if emails := attendeeEmails(e); emails != "" {
+			c.Description = strings.TrimSpace(c.Description + "\n\nAttendees: " + emails)
+		}
+		c.Location = e.Location
+	}
+	c.ExtendedProperties.Private[CopyHashProperty] = r.copyHash(c)
+	return c
+}
+
+// copyHash hashes the fields of a copy that go back to its event when it's edited: the summary without the prefix, the times and
+// the location if it's copied
+func (r *Rule) copyHash(c *calendar.Event) string {
+	location := ""
+	if !r.Redact {
+		location = c.Location
+	}
+	return hashOf(strings.TrimPrefix(c.Summary, r.Prefix), eventTime(c.Start), eventTime(c.End), location)
+}
+
+// sourceHash hashes the fields of an event that end up in its copy
+func sourceHash(e *calendar.Event) string {
+	return hashOf(e.Summary, e.Description, e.Location, eventTime(e.Start), eventTime(e.End), e.ColorId, e.Transparency, e.Visibility, attendeeEmails(e))
+}
+
+func hashOf(fields ...string) string {
+	h := sha256.New()
+	for _, f := range fields {
+		h.Write([]byte(f))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:12])
+}
+
+func attendeeEmails(e *calendar.Event) string {
+	emails := make([]string, 0, len(e.Attendees))
+	for _, a := range e.Attendees {
+		if !a.Resource {
+			emails = append(emails, a.Email)
+		}
+	}
+	return strings.Join(emails, ", ")
+}
+
+// eventTime is the date of all day events or the time in UTC, google doesn't always return times with the offset they were written with
+func eventTime(t *calendar.EventDateTime) string {
+	if t == nil {
+		return ""
+	}
+	if t.Date != "" {
+		return t.Date
+	}
+	if parsed, err := time.Parse(time.RFC3339, t.DateTime); err == nil {
+		return parsed.UTC().Format(time.RFC3339)
+	}
+	return t.DateTime
+}
+
+// privateProperties returns the private extended properties of e, never nil
+func privateProperties(e *calendar.Event) map[string]string {
+	if e.ExtendedProperties == nil || e.ExtendedProperties.Private == nil {
+		return map[string]string{}
+	}
+	return e.ExtendedProperties.Private
+}
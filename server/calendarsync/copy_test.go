@@ -0,0 +1,114 @@
+package calendarsync
+
+import (
+	"testing"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// testEvent is an hour long event starting at start, with an attendee and a location
+func testEvent(id, summary, start, end string) *calendar.Event {
+	return &calendar.Event{
+		Id:          id,
+		Status:      "confirmed",
+		Summary:     summary,
+		Description: "Agenda",
+		Location:    "Room 1",
+		Start:       &calendar.EventDateTime{DateTime: start},
+		End:         &calendar.EventDateTime{DateTime: end},
+		Attendees:   []*calendar.EventAttendee{{Email: "me@example.com", Self: true}, {Email: "ana@example.com"}},
+	}
+}
+
+// with returns a copy of e changed by f, e is left alone
+func with(e *calendar.Event, f func(e *calendar.Event)) *calendar.Event {
+	c := *e
+	f(&c)
+	return &c
+}
+
+func TestSourceHash(t *testing.T) {
+	e := testEvent("e1", "Standup", "2030-01-07T09:00:00+01:00", "2030-01-07T10:00:00+01:00")
+	tests := []struct {
+		name    string
+		changed *calendar.Event
+		same    bool
+	}{
+		{"same event", with(e, func(e *calendar.Event) {}), true},
+		{"same times with another offset", with(e, func(e *calendar.Event) {
+			e.Start = &calendar.EventDateTime{DateTime: "2030-01-07T08:00:00Z"}
+			e.End = &calendar.EventDateTime{DateTime: "2030-01-07T09:00:00Z"}
+		}), true},
+		{"fields that aren't copied", with(e, func(e *calendar.Event) { e.Etag, e.Reminders = "2", &calendar.EventReminders{UseDefault: true} }), true},
+		{"summary", with(e, func(e *calendar.Event) { e.Summary = "Retro" }), false},
+		{"description", with(e, func(e *calendar.Event) { e.Description = "" }), false},
+		{"location", with(e, func(e *calendar.Event) { e.Location = "Room 2" }), false},
+		{"start", with(e, func(e *calendar.Event) { e.Start = &calendar.EventDateTime{DateTime: "2030-01-07T09:30:00+01:00"} }), false},
+		{"attendees", with(e, func(e *calendar.Event) { e.Attendees = e.Attendees[:1] }), false},
+		{"free", with(e, func(e *calendar.Event) { e.Transparency = "transparent" }), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := sourceHash(tt.changed) == sourceHash(e); same != tt.same {
+				t.Errorf("same hash = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestCopyHash(t *testing.T) {
+	e := testEvent("e1", "Standup", "2030-01-07T09:00:00+01:00", "2030-01-07T10:00:00+01:00")
+	tests := []struct {
+		name string
+		rule *Rule
+		edit func(c *calendar.Event)
+		same bool
+	}{
+		{"untouched copy", &Rule{Prefix: "[p] "}, func(c *calendar.Event) {}, true},
+		{"summary", &Rule{Prefix: "[p] "}, func(c *calendar.Event) { c.Summary = "[p] Retro" }, false},
+		{"prefix removed", &Rule{Prefix: "[p] "}, func(c *calendar.Event) { c.Summary = "Standup" }, true},
+		{"end", &Rule{}, func(c *calendar.Event) { c.End = &calendar.EventDateTime{DateTime: "2030-01-07T10:30:00+01:00"} }, false},
+		{"description isn't sent back", &Rule{}, func(c *calendar.Event) { c.Description = "Notes" }, true},
+		{"location", &Rule{}, func(c *calendar.Event) { c.Location = "Room 2" }, false},
+		{"location of a redacted copy", &Rule{Redact: true}, func(c *calendar.Event) { c.Location = "Room 2" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Copy("1", e, tt.rule)
+			written := c.ExtendedProperties.Private[CopyHashProperty]
+			if tt.rule.copyHash(c) != written {
+				t.Fatalf("the hash of the copy as written doesn't match its %v property", CopyHashProperty)
+			}
+			if same := tt.rule.copyHash(with(c, tt.edit)) == written; same != tt.same {
+				t.Errorf("same hash = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	e := testEvent("e1", "Standup", "2030-01-07T09:00:00+01:00", "2030-01-07T10:00:00+01:00")
+	tests := []struct {
+		name            string
+		rule            *Rule
+		wantDescription string
+		wantLocation    string
+	}{
+		{"everything", &Rule{}, "Agenda\n\nAttendees: me@example.com, ana@example.com", "Room 1"},
+		{"redacted", &Rule{Redact: true}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Copy("1", e, tt.rule)
+			if c.Description != tt.wantDescription || c.Location != tt.wantLocation {
+				t.Errorf("got description %q and location %q, want %q and %q", c.Description, c.Location, tt.wantDescription, tt.wantLocation)
+			}
+			if len(c.Attendees) > 0 {
+				t.Errorf("the copy invites %v attendees", len(c.Attendees))
+			}
+			if !IsBlock(c) || c.ExtendedProperties.Private[SourceProperty] != e.Id {
+				t.Errorf("the copy isn't tagged as a copy of %v", e.Id)
+			}
+		})
+	}
+}
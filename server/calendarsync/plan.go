@@ -0,0 +1,30 @@
+package calendarsync
+
+import "google.golang.org/api/calendar/v3"
+
+// actions of a change
+const (
+	ActionInsert = "insert"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+	// ActionUpdateSource sends the edits made to a copy back to its event (two way rules)
+	ActionUpdateSource = "update-source"
+	// ActionConflict is a copy that was edited while its event changed too, it's left alone until one of them is made like the other,
+	// or the copy is deleted
+	ActionConflict = "conflict"
+)
+
+// Change is something a syncer writes (or would write) into a calendar
+type Change struct {
+	Action string `json:"action"`
+	// Calendar is the calendar changed and Id the event changed in it
+	Calendar string `json:"calendar"`
+	Id       string `json:"id"`
+	// SourceId is the event the block or copy mirrors, or the copy whose edits go back to its event
+	SourceId string `json:"sourceId"`
+	Summary  string `json:"summary"`
+	Start    string `json:"start"`
+	// event is what's written and state what the syncer remembers once it's written
+	event *calendar.Event
+	state string
+}
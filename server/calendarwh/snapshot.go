@@ -0,0 +1,70 @@
+package calendarwh
+
+import (
+	"time"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// MaxSnapshotAge is how old a persisted snapshot can be to resume from it. Deltas don't bring the events that entered the
+// window in the meantime, older snapshots are ignored and every event is fetched again.
+var MaxSnapshotAge = SyncEvery
+
+// Snapshot is what a webhook knows about its calendar, the events and the token to ask google for what changed since
+type Snapshot struct {
+	Events    []*calendar.Event
+	SyncToken string
+	SyncedAt  time.Time
+}
+
+// SnapshotStore persists the snapshot of a webhook, see PersistTo
+type SnapshotStore interface {
+	// LoadSnapshot returns nil (and no error) if there's no snapshot saved
+	LoadSnapshot() (*Snapshot, error)
+	SaveSnapshot(s *Snapshot) error
+}
+
+// restoreSnapshot picks up where the last webhook for the calendar left off if it synced recently enough
+func (c *CalendarWebHookManaged) restoreSnapshot() {
+	if c.store == nil {
+		return
+	}
+	s, err := c.store.LoadSnapshot()
+	if err != nil {
+		c.log.Errorw("could not load the snapshot", "calendar", c.calendarName, "error", err)
+		return
+	}
+	if s == nil || s.SyncToken == "" || time.Since(s.SyncedAt) > MaxSnapshotAge {
+		return
+	}
+	c.syncMu.Lock()
+	c.syncToken = s.SyncToken
+	c.syncMu.Unlock()
+	// the last full sync happened at most SyncEvery before the last save, assume the oldest
+	c.updateSnapshot(s.Events, true, s.SyncedAt.Add(-SyncEvery))
+	c.log.Infow("restored snapshot", "calendar", c.calendarName, "events", len(s.Events), "syncedAt", s.SyncedAt)
+}
+
+// saveSnapshot persists the snapshot once it's complete, the caller holds syncMu
+func (c *CalendarWebHookManaged) saveSnapshot() {
+	if c.store == nil {
+		return
+	}
+	c.snapshotMu.RLock()
+	if !c.snapshotReady {
+		c.snapshotMu.RUnlock()
+		return
+	}
+	s := &Snapshot{
+		Events:    make([]*calendar.Event, 0, len(c.snapshot)),
+		SyncToken: c.syncToken,
+		SyncedAt:  time.Now(),
+	}
+	for _, e := range c.snapshot {
+		s.Events = append(s.Events, e)
+	}
+	c.snapshotMu.RUnlock()
+	if err := c.store.SaveSnapshot(s); err != nil {
+		c.log.Errorw("could not save the snapshot", "calendar", c.calendarName, "error", err)
+	}
+}
@@ -2,11 +2,15 @@ package calendarwh
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
 	"net/http"
+	"sort"
+	"sync"
 	"time"
 )
 
@@ -22,7 +26,18 @@ type CalendarPushNotification struct {
 
 type pushNotificationHandler func(*CalendarPushNotification) error
 
-var syncEvery30Minutes = 30 * time.Minute
+// SyncEvery is how often webhooks sync every event, in case google didn't notify about a change
+var SyncEvery = 30 * time.Minute
+
+// Window is how far ahead webhooks fetch events when they sync every event
+var Window = 14 * 24 * time.Hour
+
+// ConfigureSync changes Window and SyncEvery (and MaxSnapshotAge with it), call it before any webhook starts
+func ConfigureSync(window, every time.Duration) {
+	Window = window
+	SyncEvery = every
+	MaxSnapshotAge = every
+}
 
 func New(calendarService *calendar.Service, calendarName, endpoint string, log *zap.SugaredLogger) *CalendarWebHookManaged {
 	w := &CalendarWebHookManaged{
@@ -58,15 +73,50 @@ type CalendarWebHookManaged struct {
 	endpoint      string
 	calendarName  string
 	log           *zap.SugaredLogger
+	// snapshot holds the current events of the calendar as seen through the pushes, it's ready after the first full sync
+	snapshotMu    sync.RWMutex
+	snapshot      map[string]*calendar.Event
+	snapshotReady bool
+	// fullSyncAt is when every event of the window was last fetched, the snapshot has every event until fullSyncAt + Window
+	fullSyncAt time.Time
+	// syncMu makes syncs (pushes and the ticker) run one at a time, they share the sync token
+	syncMu sync.Mutex
+	// done is closed by Stop so syncs sending events give up instead of blocking on a consumer that's gone, doneMu guards it
+	done   chan struct{}
+	doneMu sync.Mutex
+	// sending counts the syncs sending events, events is only closed once they're done
+	sending sync.WaitGroup
+	// sendMu keeps the events of one sync from interleaving with the next, Stop never takes it
+	sendMu sync.Mutex
+	// store persists the snapshot, it's nil if it's only kept in memory
+	store SnapshotStore
+}
+
+// PersistTo makes the webhook save its snapshot to store after every sync, and resume from it when it's started if it's recent enough
+// so google is only asked for what changed since.
+func (c *CalendarWebHookManaged) PersistTo(store SnapshotStore) {
+	c.store = store
 }
 
 func (c *CalendarWebHookManaged) Start() (<-chan *calendar.Event, error) {
+	c.restoreSnapshot()
+	// google pushes a sync notification as soon as the channel is created, be ready for it
+	c.syncMu.Lock()
+	c.events = make(chan *calendar.Event, 100)
+	c.syncMu.Unlock()
+	c.doneMu.Lock()
+	c.done = make(chan struct{})
+	c.doneMu.Unlock()
 	err := c.startCalendarChannel(c.endpoint)
 	if err != nil {
+		c.closeDone()
+		c.syncMu.Lock()
+		c.events = nil
+		c.syncMu.Unlock()
+		c.resetSnapshot()
 		return nil, err
 	}
-	c.events = make(chan *calendar.Event, 100)
-	c.startEventSyncTicker(syncEvery30Minutes)
+	c.startEventSyncTicker(SyncEvery)
 	return c.events, nil
 }
 
@@ -75,14 +125,44 @@ func (c *CalendarWebHookManaged) Stop() error {
 	err := c.stopCalendarChannel()
 	if err != nil {
 		// we couldn't stop the channel, start sync ticker again so we do not leave the stop halfway through.
-		c.startEventSyncTicker(syncEvery30Minutes)
+		c.startEventSyncTicker(SyncEvery)
 		return err
 	}
-	close(c.events)
-	c.events = nil
+	// a sync may be blocked sending to a consumer that waits on whoever called Stop, so it's told to give up without taking syncMu
+	// and events is closed once no sync is sending
+	c.closeDone()
+	c.sending.Wait()
+	c.syncMu.Lock()
+	if c.events != nil {
+		close(c.events)
+		c.events = nil
+	}
+	c.syncMu.Unlock()
+	c.resetSnapshot()
 	return nil
 }
 
+func (c *CalendarWebHookManaged) closeDone() {
+	c.doneMu.Lock()
+	defer c.doneMu.Unlock()
+	if c.done != nil {
+		close(c.done)
+		c.done = nil
+	}
+}
+
+// resetSnapshot forgets the events and the sync token, the next sync fetches every event
+func (c *CalendarWebHookManaged) resetSnapshot() {
+	c.syncMu.Lock()
+	c.syncToken = ""
+	c.syncMu.Unlock()
+	c.snapshotMu.Lock()
+	c.snapshot = nil
+	c.snapshotReady = false
+	c.fullSyncAt = time.Time{}
+	c.snapshotMu.Unlock()
+}
+
 func (c *CalendarWebHookManaged) IsRunning() bool {
 	return c.events != nil
 }
@@ -114,17 +194,8 @@ func (c *CalendarWebHookManaged) startEventSyncTicker(d time.Duration) {
 				c.stopEventSyncTicker()
 				return
 			}
-			exp := parseUnixTimeInSeconds(c.gcalChannel.Expiration)
-			pushNotification := &CalendarPushNotification{
-				ChannelId:         c.gcalChannel.Id,
-				ResourceId:        c.gcalChannel.ResourceId,
-				ChannelExpiration: &exp,
-				ResourceState:     "sync",
-				ResourceUri:       "",
-				MessageNumber:     "1",
-				Token:             c.gcalChannel.Token,
-			}
-			c.handleIncomingPushNotification(pushNotification)
+			// deltas don't bring the events that entered the window since the last full sync, fetch them all again
+			c.sync(true)
 		}
 	}()
 }
@@ -172,23 +243,66 @@ func (c *CalendarWebHookManaged) handleIncomingPushNotification(pushNotification
 		}
 		return nil
 	}
-	// if it's a sync push notification, forget our sync token and start fresh
-	if pushNotification.ResourceState == "sync" {
+	// google sends a sync notification when the channel is created, if we have a sync token (eg: restored from the store) what changed
+	// since is enough
+	c.sync(false)
+	return nil
+}
+
+// sync fetches the events that changed since the last sync and forwards them, if full is true (or there's no sync token)
+// it fetches every event within the window instead and they replace the snapshot.
+func (c *CalendarWebHookManaged) sync(full bool) {
+	c.syncMu.Lock()
+	if c.events == nil {
+		c.syncMu.Unlock()
+		return
+	}
+	if full {
 		c.syncToken = ""
 	}
+	fullSync := c.syncToken == ""
 	// passing in syncToken means that the query will only retrieve deltas since the last query
-	// if it's empty we retrieve all events for the coming week
-	twoWeeks := time.Now().Add(14 * 24 * time.Hour)
-	events, nextSyncToken, err := c.fetchEventsDelta(twoWeeks, c.syncToken)
+	// if it's empty we retrieve all events within the window
+	until := time.Now().Add(Window)
+	events, nextSyncToken, err := c.fetchEventsDelta(until, c.syncToken)
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) && gErr.Code == http.StatusGone {
+		// google expired the sync token
+		c.log.Infow("sync token expired, fetching every event", "calendar", c.calendarName)
+		fullSync = true
+		events, nextSyncToken, err = c.fetchEventsDelta(until, "")
+	}
 
 	if err != nil {
 		c.log.Errorf("unable to retrieve events delta")
 	}
 	c.syncToken = nextSyncToken
+	c.updateSnapshot(events, err == nil && fullSync, time.Now())
+	if err == nil {
+		c.saveSnapshot()
+	}
+	// send them without holding syncMu, the consumer may be waiting on whoever is stopping the webhook
+	out := c.events
+	c.doneMu.Lock()
+	done := c.done
+	if done == nil {
+		c.doneMu.Unlock()
+		c.syncMu.Unlock()
+		return
+	}
+	c.sending.Add(1)
+	c.doneMu.Unlock()
+	defer c.sending.Done()
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	c.syncMu.Unlock()
 	for _, event := range events {
-		c.events <- event
+		select {
+		case out <- event:
+		case <-done:
+			return
+		}
 	}
-	return nil
 }
 
 // fetchEventsDelta retrieves events from the calendar, if syncToken is passed, only deltas from the last query will be retrieved
@@ -214,6 +328,55 @@ func (c *CalendarWebHookManaged) fetchEventsDelta(to time.Time, syncToken string
 	return events.Items, events.NextSyncToken, nil
 }
 
+// updateSnapshot applies the events fetched to the snapshot, fullSync means they are every event of the calendar (fetched at syncedAt)
+// and replace the snapshot.
+func (c *CalendarWebHookManaged) updateSnapshot(events []*calendar.Event, fullSync bool, syncedAt time.Time) {
+	c.snapshotMu.Lock()
+	defer c.snapshotMu.Unlock()
+	if fullSync || c.snapshot == nil {
+		c.snapshot = make(map[string]*calendar.Event, len(events))
+	}
+	for _, e := range events {
+		if e.Status == "cancelled" {
+			delete(c.snapshot, e.Id)
+			continue
+		}
+		c.snapshot[e.Id] = e
+	}
+	if fullSync {
+		c.snapshotReady = true
+		c.fullSyncAt = syncedAt
+	}
+}
+
+// Snapshot returns the events of the calendar that haven't ended yet sorted by start time, ok is false if the webhook hasn't completed a full sync yet.
+func (c *CalendarWebHookManaged) Snapshot() (events []*calendar.Event, ok bool) {
+	events, _, ok = c.SnapshotUntil()
+	return events, ok
+}
+
+// SnapshotUntil is Snapshot along with how far ahead it has every event: deltas don't bring the events that entered the window since
+// the last full sync.
+func (c *CalendarWebHookManaged) SnapshotUntil() (events []*calendar.Event, until time.Time, ok bool) {
+	c.snapshotMu.RLock()
+	defer c.snapshotMu.RUnlock()
+	if !c.snapshotReady {
+		return nil, time.Time{}, false
+	}
+	now := time.Now()
+	events = make([]*calendar.Event, 0, len(c.snapshot))
+	for _, e := range c.snapshot {
+		if end := EventTime(e.End); !end.IsZero() && end.Before(now) {
+			continue
+		}
+		events = append(events, e)
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return EventTime(events[i].Start).Before(EventTime(events[j].Start))
+	})
+	return events, c.fullSyncAt.Add(Window), true
+}
+
 func (c *CalendarWebHookManaged) restart() error {
 	err := c.stopCalendarChannel()
 	if err != nil {
@@ -240,6 +403,19 @@ func (c *CalendarWebHookManaged) restartAt(t time.Time) context.CancelFunc {
 
 // utility functions
 
+// EventTime parses the start or end of an event, all day events start at midnight UTC. It returns the zero time if it can't be parsed.
+func EventTime(d *calendar.EventDateTime) time.Time {
+	if d == nil {
+		return time.Time{}
+	}
+	if d.DateTime != "" {
+		t, _ := time.Parse(time.RFC3339, d.DateTime)
+		return t
+	}
+	t, _ := time.Parse("2006-01-02", d.Date)
+	return t
+}
+
 func parseUnixTimeInSeconds(secs int64) time.Time {
 	return time.Unix(secs/1000, 0)
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gabzim/meetings/server/services/account"
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+// runAccountCommand runs meetings-server export-user <email> (prints the export to stdout) or meetings-server delete-user <email>.
+// Deleting goes through the running server (cfg.AdminURL) so it disconnects the clients of the user and stops the google channels of its
+// calendars, it's only done from this process if the server isn't running.
+func runAccountCommand(command, email string, cfg *ServerConfig, authServ *auth.Service, accountServ *account.Service, log *zap.SugaredLogger) error {
+	user, err := authServ.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("finding %v: %w", email, err)
+	}
+	switch command {
+	case "export-user":
+		export, err := accountServ.Export(user, audit.CLI)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(export)
+	case "delete-user":
+		err := deleteThroughServer(cfg, user.Email)
+		if !errors.Is(err, errServerUnreachable) {
+			return err
+		}
+		log.Warnf("%v, deleting from here: no clients to disconnect, google channels left expire on their own", err)
+		return accountServ.Delete(context.Background(), user, audit.CLI)
+	}
+	return fmt.Errorf("unknown command %v", command)
+}
+
+var errServerUnreachable = errors.New("the server is not running")
+
+// deleteThroughServer asks the server at cfg.AdminURL to delete the user, it returns errServerUnreachable if it can't connect to it
+func deleteThroughServer(cfg *ServerConfig, email string) error {
+	if len(cfg.AdminTokens) == 0 {
+		return errors.New("adminTokens (MEETINGS_ADMIN_TOKENS) must be set, the running server has to disconnect the clients of the user")
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(cfg.AdminURL, "/")+"/admin/users/delete?email="+url.QueryEscape(email), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.AdminTokens[0])
+	res, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		var netErr interface{ Timeout() bool }
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("the server at %v didn't answer: %w", cfg.AdminURL, err)
+		}
+		return fmt.Errorf("%w at %v: %v", errServerUnreachable, cfg.AdminURL, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("the server answered %v: %s", res.Status, body)
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken only lets through requests with one of the tokens as bearer token, everyone if there are none
+func requireToken(tokens []string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !hasToken(tokens, r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(401)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// hasToken tells whether the request has one of the tokens as bearer token, every request does if there are none
+func hasToken(tokens []string, r *http.Request) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(t)) == 1 {
+			return true
+		}
+	}
+	return false
+}
@@ -1,85 +1,268 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
-	"github.com/gabzim/meetings/server/postgres"
+	"github.com/gabzim/meetings/server/calendarwh"
+	"github.com/gabzim/meetings/server/grpcapi"
+	"github.com/gabzim/meetings/server/services/account"
+	"github.com/gabzim/meetings/server/services/audit"
 	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/calendars"
+	"github.com/gabzim/meetings/server/services/events"
+	"github.com/gabzim/meetings/server/services/feeds"
+	"github.com/gabzim/meetings/server/services/freebusy"
+	"github.com/gabzim/meetings/server/services/health"
+	"github.com/gabzim/meetings/server/services/mirrors"
 	"github.com/gabzim/meetings/server/services/notifications"
-	"github.com/markbates/goth/providers/google"
-	"golang.org/x/oauth2"
-	"google.golang.org/api/calendar/v3"
+	"github.com/gabzim/meetings/server/storage"
+	"github.com/jmoiron/sqlx"
 )
 
-func getEnvOrDefault(envName, fallback string) string {
-	v := os.Getenv(envName)
-	if v == "" {
-		return fallback
-	}
-	return v
-}
-
-type ServerConfig struct {
-	Port     string
-	DbURL    string
-	hostURL  string
-	OauthCfg *oauth2.Config
-}
-
-func getServerConfig() *ServerConfig {
-	port := getEnvOrDefault("MEETINGS_PORT", "8080")
-	dbUrl := os.Getenv("MEETINGS_DB_URL")
-	googleClientId := os.Getenv("MEETINGS_GOOGLE_KEY")
-	googleClientSecret := os.Getenv("MEETINGS_GOOGLE_SECRET")
-	hostUrl := os.Getenv("MEETINGS_HOST_URL")
-	redirectUrl := hostUrl + "/auth/google/callback"
-	cfg := &oauth2.Config{ClientID: googleClientId, ClientSecret: googleClientSecret, Endpoint: google.Endpoint, RedirectURL: redirectUrl, Scopes: []string{calendar.CalendarReadonlyScope}}
-	return &ServerConfig{
-		Port:     port,
-		DbURL:    dbUrl,
-		hostURL:  hostUrl,
-		OauthCfg: cfg,
-	}
-}
-
 func main() {
-	cfg := getServerConfig()
-
 	loggerConfig := zap.NewProductionConfig()
 	loggerConfig.EncoderConfig.TimeKey = "timestamp"
 	loggerConfig.EncoderConfig.EncodeTime = zapcore.TimeEncoderOfLayout(time.RFC3339)
 	log, _ := loggerConfig.Build()
 	logger := log.Sugar()
 
+	// meetings-server config check [file] validates the config and exits
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		if err := runConfigCheck(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := loadConfig(os.Getenv("MEETINGS_CONFIG"))
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	// meetings-server migrate up|down|status manages the schema and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := checkDbURL(cfg.DbURL); err != nil {
+			logger.Fatalf("%v", err)
+		}
+		db, err := storage.Connect(cfg.DbURL)
+		if err != nil {
+			logger.Fatalf("error connecting to db: %v", err)
+		}
+		if err := runMigrateCommand(db, os.Args[2:]); err != nil {
+			logger.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
+		logger.Fatalf("%v", err)
+	}
+	for _, w := range cfg.Warnings() {
+		logger.Warn(w)
+	}
+	auth.ConfigureSessions(cfg.SessionSecret, strings.HasPrefix(cfg.HostURL, "https://"))
+	calendarwh.ConfigureSync(cfg.SyncWindow(), cfg.Sync.Every)
+	oauthCfg := cfg.OauthConfig()
+
+	tokenCipher, err := auth.ParseTokenKeys(cfg.TokenKeys, cfg.TokenKeyId)
+	if err != nil {
+		logger.Fatalf("MEETINGS_TOKEN_KEYS: %v", err)
+	}
+
 	// init data layer
-	db, err := postgres.CreateDB(cfg.DbURL)
+	var db *sqlx.DB
+	if cfg.Features.AutoMigrate {
+		db, err = storage.CreateDB(cfg.DbURL)
+	} else {
+		db, err = storage.Connect(cfg.DbURL)
+	}
 	if err != nil {
 		logger.Fatalf("error connecting to db: %v", err)
 	}
+	stores := storage.NewStores(db, tokenCipher)
+	tokenStore := stores.Tokens
+
+	// meetings-server reencrypt encrypts every user with the active key and exits, run it after rotating keys
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		n, err := tokenStore.Reencrypt()
+		if err != nil {
+			logger.Fatalf("re-encrypted %v users before failing: %v", n, err)
+		}
+		logger.Infof("re-encrypted %v users with key %v", n, tokenCipher.ActiveKeyId())
+		return
+	}
 
 	// init services
-	tokenStore := auth.NewTokenStore(db)
-	authServ := auth.NewService(logger, tokenStore)
-	notifServ := notifications.NewService(logger, cfg.OauthCfg, cfg.hostURL)
+	if err := audit.TrustProxies(cfg.TrustedProxies); err != nil {
+		logger.Fatalf("trustedProxies: %v", err)
+	}
+	auditServ := audit.NewService(logger, stores.Audit)
+	tokenHasher := auth.NewTokenHasher(cfg.TokenHashKey)
+	authServ := auth.NewService(logger, tokenStore, oauthCfg, tokenHasher)
+	authServ.SetAuditLog(auditServ)
+	if !cfg.Features.QueryToken {
+		authServ.DisableQueryToken()
+	}
+	notifServ := notifications.NewService(logger, authServ, cfg.HostURL)
+	notifServ.LimitOutboxes(cfg.Limits.UnackedEvents, cfg.Limits.UnackedTTL)
+	if cfg.Features.PersistSnapshots {
+		notifServ.PersistSnapshots(stores.Snapshots)
+	}
+	eventsServ := events.NewService(logger, authServ, notifServ)
+	calendarsServ := calendars.NewService(logger, authServ)
+	freeBusyServ := freebusy.NewService(logger, authServ)
+	feedsServ := feeds.NewService(logger, stores.Feeds, authServ, eventsServ, tokenHasher, cfg.HostURL)
+	accountServ := account.NewService(logger, authServ, notifServ, feedsServ, auditServ)
+	mirrorsServ := mirrors.NewService(logger, stores.Mirrors, authServ, notifServ)
+	healthServ := health.NewService(logger)
+	healthServ.Add("database", 0, db.PingContext)
+	// google is asked at most once a minute, probes run every few seconds on every replica
+	healthServ.Add("google", time.Minute, health.Reachable(http.DefaultClient, oauthCfg.Endpoint.TokenURL))
+	healthServ.Add("notifications", 0, notifServ.Ping)
+
+	// meetings-server export-user <email> and delete-user <email> do what users can do from their account page
+	if len(os.Args) > 2 && (os.Args[1] == "export-user" || os.Args[1] == "delete-user") {
+		if err := runAccountCommand(os.Args[1], os.Args[2], cfg, authServ, accountServ, logger); err != nil {
+			logger.Fatalf("%v: %v", os.Args[1], err)
+		}
+		return
+	}
+
+	// meetings-server mirror-plan <id> is the dry run of a mirror
+	if len(os.Args) > 2 && os.Args[1] == "mirror-plan" {
+		if err := runMirrorPlan(os.Args[2], mirrorsServ); err != nil {
+			logger.Fatalf("mirror-plan: %v", err)
+		}
+		return
+	}
+
+	if cfg.AuditRetentionDays > 0 {
+		auditServ.KeepFor(cfg.AuditRetention())
+	}
+	if cfg.Features.Mirrors {
+		if err := mirrorsServ.Start(); err != nil {
+			logger.Errorf("could not start the mirrors: %v", err)
+		}
+	}
 
 	// init controllers
-	authCtrl := auth.NewController(cfg.OauthCfg, authServ, cfg.OauthCfg.RedirectURL)
+	authCtrl := auth.NewController(oauthCfg, authServ, oauthCfg.RedirectURL, cfg.HostURL)
+	tokensCtrl := auth.NewTokensController(authServ, logger)
 	notificationsCtrl := notifications.NewController(notifServ, authServ, logger)
+	eventsCtrl := events.NewController(eventsServ, authServ, logger)
+	feedsCtrl := feeds.NewController(feedsServ, authServ, logger)
+	mirrorsCtrl := mirrors.NewController(mirrorsServ, authServ, logger)
+	calendarsCtrl := calendars.NewController(calendarsServ, authServ, logger)
+	freeBusyCtrl := freebusy.NewController(freeBusyServ, authServ, logger)
+	accountCtrl := account.NewController(accountServ, authServ, notifServ, feedsServ, logger)
+	healthCtrl := health.NewController(healthServ, func(r *http.Request) bool { return hasToken(cfg.AdminTokens, r) }, logger)
 
-	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/metrics", requireToken(cfg.MetricsTokens(), promhttp.Handler()))
+	// requireToken lets everyone through without tokens, deleting users is never open
+	if len(cfg.AdminTokens) > 0 {
+		http.Handle("/admin/users/delete", requireToken(cfg.AdminTokens, http.HandlerFunc(accountCtrl.AdminDelete)))
+	}
+	http.HandleFunc("/healthz", healthCtrl.Healthz)
+	http.HandleFunc("/readyz", healthCtrl.Readyz)
 
 	// init api
 	http.HandleFunc("/auth/google", authCtrl.Redirect)
 	http.HandleFunc("/auth/google/callback", authCtrl.Callback)
+	http.HandleFunc("/auth/google/upgrade", authCtrl.Upgrade)
+	http.HandleFunc("/auth/google/upgrade/callback", authCtrl.UpgradeCallback)
+	http.HandleFunc("/auth/device", authCtrl.Device)
+	http.HandleFunc("/auth/device/approve", authCtrl.ApproveDevice)
+	http.HandleFunc("/auth/device/code", authCtrl.DeviceCode)
+	http.HandleFunc("/auth/device/token", authCtrl.DeviceToken)
 	http.HandleFunc("/notifications", notificationsCtrl.RegisterClient)
 	http.HandleFunc("/push/", notificationsCtrl.ReceivePushFromGoogle)
+	http.HandleFunc("/api/v1/events", eventsCtrl.List)
+	http.HandleFunc("/api/v1/tokens", tokensCtrl.Tokens)
+	http.HandleFunc("/api/v1/tokens/", tokensCtrl.Token)
+	http.HandleFunc("/api/v1/calendars", calendarsCtrl.List)
+	http.HandleFunc("/api/v1/freebusy", freeBusyCtrl.Query)
+	http.HandleFunc("/api/v1/freebusy/sharing", freeBusyCtrl.Sharing)
+	http.HandleFunc("/api/v1/feeds", feedsCtrl.Feeds)
+	http.HandleFunc("/api/v1/feeds/", feedsCtrl.Feed)
+	http.HandleFunc("/ical/", feedsCtrl.ServeFeed)
+	if cfg.Features.Mirrors {
+		http.HandleFunc("/api/v1/mirrors", mirrorsCtrl.Mirrors)
+		http.HandleFunc("/api/v1/mirrors/", mirrorsCtrl.Mirror)
+	}
+	http.HandleFunc("/account", accountCtrl.Account)
+	http.HandleFunc("/account/tokens", accountCtrl.CreateToken)
+	http.HandleFunc("/account/tokens/revoke", accountCtrl.RevokeToken)
+	http.HandleFunc("/account/feeds/revoke", accountCtrl.RevokeFeed)
+	http.HandleFunc("/account/freebusy", accountCtrl.FreeBusy)
+	http.HandleFunc("/account/logout", accountCtrl.Logout)
+	http.HandleFunc("/account/export", accountCtrl.Export)
+	http.HandleFunc("/account/delete", accountCtrl.Delete)
+	http.HandleFunc("/api/v1/account", accountCtrl.API)
+	http.HandleFunc("/api/v1/account/export", accountCtrl.APIExport)
+	http.HandleFunc("/api/v1/account/audit", accountCtrl.APIAudit)
 
-	logger.Infof("Listening in %v...", cfg.Port)
-	err = http.ListenAndServe(":"+cfg.Port, nil)
-	logger.Fatalf("Error attaching to port %v: %v", cfg.Port, err)
+	// init grpc api
+	grpcServer := grpc.NewServer()
+	grpcapi.NewServer(notifServ, authServ, logger).Register(grpcServer)
+	lis, err := net.Listen("tcp", ":"+cfg.GrpcPort)
+	if err != nil {
+		logger.Fatalf("Error attaching to grpc port %v: %v", cfg.GrpcPort, err)
+	}
+	go func() {
+		logger.Infof("Grpc listening in %v...", cfg.GrpcPort)
+		if err := grpcServer.Serve(lis); err != nil {
+			logger.Fatalf("Error serving grpc: %v", err)
+		}
+	}()
+
+	server := &http.Server{Addr: ":" + cfg.Port}
+	go func() {
+		logger.Infof("Listening in %v...", cfg.Port)
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logger.Fatalf("Error attaching to port %v: %v", cfg.Port, err)
+		}
+	}()
+
+	// on SIGTERM turn unready first, so the load balancer stops sending requests before the server stops taking them
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	logger.Infof("shutting down, draining for %v", cfg.Shutdown.Drain)
+	healthServ.ShutDown()
+	time.Sleep(cfg.Shutdown.Drain)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(grpcStopped)
+	}()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Errorf("could not finish the requests in flight: %v", err)
+	}
+	// websockets are hijacked, server.Shutdown doesn't wait for them. Closing the notifications ends them and the grpc streams too.
+	mirrorsServ.Stop()
+	if err := notifServ.Shutdown(ctx); err != nil {
+		logger.Errorf("could not stop the google channels: %v", err)
+	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		grpcServer.Stop()
+	}
+	logger.Infof("stopped")
 }
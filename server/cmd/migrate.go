@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/gabzim/meetings/server/storage"
+	"github.com/jmoiron/sqlx"
+)
+
+// runMigrateCommand runs meetings-server migrate up, migrate down [steps] (1 by default) or migrate status
+func runMigrateCommand(db *sqlx.DB, args []string) error {
+	migrator, err := storage.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [steps]|status")
+	}
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Printf("applied %04d_%v\n", m.Version, m.Name)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Println("schema is up to date")
+		}
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return fmt.Errorf("steps must be a positive number")
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		for _, m := range reverted {
+			fmt.Printf("reverted %04d_%v\n", m.Version, m.Name)
+		}
+		return err
+	case "status":
+		states, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d_%-30v %v\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown migrate command %v, use up, down or status", args[0])
+}
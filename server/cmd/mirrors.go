@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/gabzim/meetings/server/services/mirrors"
+)
+
+// runMirrorPlan runs meetings-server mirror-plan <id>, it prints the inserts, updates and deletes the mirror would make right now
+// and the conflicts it would leave alone, without writing anything
+func runMirrorPlan(id string, mirrorsServ *mirrors.Service) error {
+	mirrorId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid mirror id %q", id)
+	}
+	m, changes, err := mirrorsServ.Plan(context.Background(), mirrorId)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("mirror %v: %v of %v into %v of %v\n", m.Id, m.SourceCalendar, m.SourceEmail, m.TargetCalendar, m.TargetEmail)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, ch := range changes {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", ch.Action, ch.Calendar, ch.Start, ch.Summary)
+	}
+	tw.Flush()
+	fmt.Printf("%v changes\n", len(changes))
+	return nil
+}
@@ -0,0 +1,78 @@
+// Package eventfields limits the fields of the events sent to clients whose tokens can only see some of them (eg: titles and times).
+package eventfields
+
+import (
+	"fmt"
+	"sort"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+// copiers copy each field that can be granted, names are the ones of the json of google calendar events
+var copiers = map[string]func(dst, src *calendar.Event){
+	"summary":          func(dst, src *calendar.Event) { dst.Summary = src.Summary },
+	"description":      func(dst, src *calendar.Event) { dst.Description = src.Description },
+	"location":         func(dst, src *calendar.Event) { dst.Location = src.Location },
+	"start":            func(dst, src *calendar.Event) { dst.Start = src.Start },
+	"end":              func(dst, src *calendar.Event) { dst.End = src.End },
+	"attendees":        func(dst, src *calendar.Event) { dst.Attendees = src.Attendees },
+	"organizer":        func(dst, src *calendar.Event) { dst.Organizer = src.Organizer },
+	"creator":          func(dst, src *calendar.Event) { dst.Creator = src.Creator },
+	"colorId":          func(dst, src *calendar.Event) { dst.ColorId = src.ColorId },
+	"htmlLink":         func(dst, src *calendar.Event) { dst.HtmlLink = src.HtmlLink },
+	"hangoutLink":      func(dst, src *calendar.Event) { dst.HangoutLink = src.HangoutLink },
+	"conferenceData":   func(dst, src *calendar.Event) { dst.ConferenceData = src.ConferenceData },
+	"created":          func(dst, src *calendar.Event) { dst.Created = src.Created },
+	"updated":          func(dst, src *calendar.Event) { dst.Updated = src.Updated },
+	"recurringEventId": func(dst, src *calendar.Event) { dst.RecurringEventId = src.RecurringEventId },
+	"transparency":     func(dst, src *calendar.Event) { dst.Transparency = src.Transparency },
+	"visibility":       func(dst, src *calendar.Event) { dst.Visibility = src.Visibility },
+	"eventType":        func(dst, src *calendar.Event) { dst.EventType = src.EventType },
+}
+
+// Names returns the fields that can be granted
+func Names() []string {
+	names := make([]string, 0, len(copiers))
+	for name := range copiers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Validate checks every field can be granted
+func Validate(fields []string) error {
+	for _, f := range fields {
+		if _, ok := copiers[f]; !ok {
+			return fmt.Errorf("unknown event field %q, valid ones are %v", f, Names())
+		}
+	}
+	return nil
+}
+
+// Project returns a copy of the event with only the given fields, plus id and status which clients always need to tell events apart
+// and know when they're cancelled. No fields means all of them, e is returned as is.
+func Project(e *calendar.Event, fields []string) *calendar.Event {
+	if len(fields) == 0 || e == nil {
+		return e
+	}
+	projected := &calendar.Event{Id: e.Id, Status: e.Status}
+	for _, f := range fields {
+		if copy, ok := copiers[f]; ok {
+			copy(projected, e)
+		}
+	}
+	return projected
+}
+
+// ProjectAll projects every event
+func ProjectAll(events []*calendar.Event, fields []string) []*calendar.Event {
+	if len(fields) == 0 {
+		return events
+	}
+	res := make([]*calendar.Event, len(events))
+	for i, e := range events {
+		res[i] = Project(e, fields)
+	}
+	return res
+}
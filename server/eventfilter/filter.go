@@ -0,0 +1,147 @@
+// Package eventfilter selects calendar events on the server side, it supports the same options as the filters binary.
+package eventfilter
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"google.golang.org/api/calendar/v3"
+)
+
+var colorNameToId = map[string]string{
+	"lavender":  "1",
+	"sage":      "2",
+	"grape":     "3",
+	"flamingo":  "4",
+	"banana":    "5",
+	"tangerine": "6",
+	"peacock":   "7",
+	"graphite":  "8",
+	"blueberry": "9",
+	"basil":     "10",
+	"tomato":    "11",
+}
+
+// Filter describes the events a client is interested in, the zero value matches every event.
+type Filter struct {
+	// Colors can be color names (eg: sage, tomato) or google color ids
+	Colors    []string `json:"colors,omitempty"`
+	Organizer string   `json:"organizer,omitempty"`
+	// AttendeeEmail and AttendeeStatus match events where that attendee responded with one of the statuses, eg: accepted, needsAction
+	AttendeeEmail  string   `json:"attendee,omitempty"`
+	AttendeeStatus []string `json:"attendeeStatus,omitempty"`
+}
+
+// Validate returns an error if the filter references colors that don't exist or is missing the attendee email
+func (f *Filter) Validate() error {
+	for _, c := range f.Colors {
+		if _, err := ColorId(c); err != nil {
+			return err
+		}
+	}
+	if len(f.AttendeeStatus) > 0 && f.AttendeeEmail == "" {
+		return fmt.Errorf("attendeeStatus needs an attendee email")
+	}
+	return nil
+}
+
+// Fields returns the event fields the filter looks at (as named in eventfields), a token that can't see them can't filter on them either
+func (f *Filter) Fields() []string {
+	fields := make([]string, 0, 3)
+	if f == nil {
+		return fields
+	}
+	if len(f.Colors) > 0 {
+		fields = append(fields, "colorId")
+	}
+	if f.Organizer != "" {
+		fields = append(fields, "organizer")
+	}
+	if f.AttendeeEmail != "" {
+		fields = append(fields, "attendees")
+	}
+	return fields
+}
+
+// Match tells whether the event passes the filter. Cancelled events always pass since google strips most of their fields
+// and clients need them to remove events they already know about.
+func (f *Filter) Match(e *calendar.Event) bool {
+	if f == nil || e.Status == "cancelled" {
+		return true
+	}
+	if len(f.Colors) > 0 && !f.matchesColor(e.ColorId) {
+		return false
+	}
+	if f.Organizer != "" && (e.Organizer == nil || !strings.EqualFold(e.Organizer.Email, f.Organizer)) {
+		return false
+	}
+	if f.AttendeeEmail != "" && !f.matchesAttendee(e.Attendees) {
+		return false
+	}
+	return true
+}
+
+func (f *Filter) matchesColor(id string) bool {
+	for _, c := range f.Colors {
+		cId, _ := ColorId(c)
+		if cId == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) matchesAttendee(attendees []*calendar.EventAttendee) bool {
+	for _, a := range attendees {
+		if !strings.EqualFold(a.Email, f.AttendeeEmail) {
+			continue
+		}
+		if len(f.AttendeeStatus) == 0 {
+			return true
+		}
+		for _, s := range f.AttendeeStatus {
+			if a.ResponseStatus == s {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ColorId returns the google color id of a color name (eg: sage, tomato) or id
+func ColorId(c string) (string, error) {
+	if id, ok := colorNameToId[strings.ToLower(c)]; ok {
+		return id, nil
+	}
+	for _, id := range colorNameToId {
+		if id == c {
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("unknown color %q", c)
+}
+
+// ParseQuery reads a filter from query params named like the json fields: colors, organizer, attendee and attendeeStatus.
+// Lists can be repeated params or comma separated values.
+func ParseQuery(q url.Values) (*Filter, error) {
+	f := &Filter{
+		Colors:         splitValues(q["colors"]),
+		Organizer:      q.Get("organizer"),
+		AttendeeEmail:  q.Get("attendee"),
+		AttendeeStatus: splitValues(q["attendeeStatus"]),
+	}
+	return f, f.Validate()
+}
+
+func splitValues(vs []string) []string {
+	var res []string
+	for _, v := range vs {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				res = append(res, part)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,83 @@
+package meetingspb
+
+import "google.golang.org/api/calendar/v3"
+
+// FromCalendarEvent maps a google calendar event to its protobuf representation
+func FromCalendarEvent(e *calendar.Event) *EventMessage {
+	m := &EventMessage{
+		Id:               e.Id,
+		Status:           e.Status,
+		Summary:          e.Summary,
+		Description:      e.Description,
+		Location:         e.Location,
+		ColorId:          e.ColorId,
+		HtmlLink:         e.HtmlLink,
+		HangoutLink:      e.HangoutLink,
+		Start:            fromEventDateTime(e.Start),
+		End:              fromEventDateTime(e.End),
+		Created:          e.Created,
+		Updated:          e.Updated,
+		RecurringEventId: e.RecurringEventId,
+	}
+	if e.Organizer != nil {
+		m.Organizer = &Person{Email: e.Organizer.Email, DisplayName: e.Organizer.DisplayName, Self: e.Organizer.Self}
+	}
+	for _, a := range e.Attendees {
+		m.Attendees = append(m.Attendees, &Attendee{
+			Email:          a.Email,
+			DisplayName:    a.DisplayName,
+			ResponseStatus: a.ResponseStatus,
+			Optional:       a.Optional,
+			Organizer:      a.Organizer,
+			Self:           a.Self,
+		})
+	}
+	return m
+}
+
+// ToCalendarEvent maps the message back to a google calendar event, so clients can reuse the code they have for the websocket api
+func (m *EventMessage) ToCalendarEvent() *calendar.Event {
+	e := &calendar.Event{
+		Id:               m.Id,
+		Status:           m.Status,
+		Summary:          m.Summary,
+		Description:      m.Description,
+		Location:         m.Location,
+		ColorId:          m.ColorId,
+		HtmlLink:         m.HtmlLink,
+		HangoutLink:      m.HangoutLink,
+		Start:            m.Start.toEventDateTime(),
+		End:              m.End.toEventDateTime(),
+		Created:          m.Created,
+		Updated:          m.Updated,
+		RecurringEventId: m.RecurringEventId,
+	}
+	if m.Organizer != nil {
+		e.Organizer = &calendar.EventOrganizer{Email: m.Organizer.Email, DisplayName: m.Organizer.DisplayName, Self: m.Organizer.Self}
+	}
+	for _, a := range m.Attendees {
+		e.Attendees = append(e.Attendees, &calendar.EventAttendee{
+			Email:          a.Email,
+			DisplayName:    a.DisplayName,
+			ResponseStatus: a.ResponseStatus,
+			Optional:       a.Optional,
+			Organizer:      a.Organizer,
+			Self:           a.Self,
+		})
+	}
+	return e
+}
+
+func fromEventDateTime(d *calendar.EventDateTime) *EventDateTime {
+	if d == nil {
+		return nil
+	}
+	return &EventDateTime{Date: d.Date, DateTime: d.DateTime, TimeZone: d.TimeZone}
+}
+
+func (d *EventDateTime) toEventDateTime() *calendar.EventDateTime {
+	if d == nil {
+		return nil
+	}
+	return &calendar.EventDateTime{Date: d.Date, DateTime: d.DateTime, TimeZone: d.TimeZone}
+}
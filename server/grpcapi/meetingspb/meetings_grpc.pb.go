@@ -0,0 +1,134 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: meetings.proto
+
+package meetingspb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// MeetingsClient is the client API for Meetings service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type MeetingsClient interface {
+	// Subscribe sends the events of the coming two weeks and then every new/updated/cancelled event of the calendar.
+	Subscribe(ctx context.Context, in *SubscriptionRequest, opts ...grpc.CallOption) (Meetings_SubscribeClient, error)
+}
+
+type meetingsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMeetingsClient(cc grpc.ClientConnInterface) MeetingsClient {
+	return &meetingsClient{cc}
+}
+
+func (c *meetingsClient) Subscribe(ctx context.Context, in *SubscriptionRequest, opts ...grpc.CallOption) (Meetings_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Meetings_ServiceDesc.Streams[0], "/meetings.v1.Meetings/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &meetingsSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Meetings_SubscribeClient interface {
+	Recv() (*EventMessage, error)
+	grpc.ClientStream
+}
+
+type meetingsSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *meetingsSubscribeClient) Recv() (*EventMessage, error) {
+	m := new(EventMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// MeetingsServer is the server API for Meetings service.
+// All implementations must embed UnimplementedMeetingsServer
+// for forward compatibility
+type MeetingsServer interface {
+	// Subscribe sends the events of the coming two weeks and then every new/updated/cancelled event of the calendar.
+	Subscribe(*SubscriptionRequest, Meetings_SubscribeServer) error
+	mustEmbedUnimplementedMeetingsServer()
+}
+
+// UnimplementedMeetingsServer must be embedded to have forward compatible implementations.
+type UnimplementedMeetingsServer struct {
+}
+
+func (UnimplementedMeetingsServer) Subscribe(*SubscriptionRequest, Meetings_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+func (UnimplementedMeetingsServer) mustEmbedUnimplementedMeetingsServer() {}
+
+// UnsafeMeetingsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to MeetingsServer will
+// result in compilation errors.
+type UnsafeMeetingsServer interface {
+	mustEmbedUnimplementedMeetingsServer()
+}
+
+func RegisterMeetingsServer(s grpc.ServiceRegistrar, srv MeetingsServer) {
+	s.RegisterService(&Meetings_ServiceDesc, srv)
+}
+
+func _Meetings_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscriptionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MeetingsServer).Subscribe(m, &meetingsSubscribeServer{stream})
+}
+
+type Meetings_SubscribeServer interface {
+	Send(*EventMessage) error
+	grpc.ServerStream
+}
+
+type meetingsSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *meetingsSubscribeServer) Send(m *EventMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Meetings_ServiceDesc is the grpc.ServiceDesc for Meetings service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Meetings_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "meetings.v1.Meetings",
+	HandlerType: (*MeetingsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Meetings_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "meetings.proto",
+}
@@ -0,0 +1,148 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/gabzim/meetings/server/grpcapi/meetingspb"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/notifications"
+	"go.uber.org/zap"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// clients authenticate with "authorization: Bearer <token>" metadata, or the older x-meetings-token (x-meetings-email is optional)
+const (
+	AuthorizationMetadataKey = "authorization"
+	EmailMetadataKey         = "x-meetings-email"
+	TokenMetadataKey         = "x-meetings-token"
+)
+
+// events buffered per stream before we start blocking the webhook that forwards them
+const streamBuffer = 100
+
+func NewServer(notifServ *notifications.Service, authServ *auth.Service, log *zap.SugaredLogger) *Server {
+	l := log.With("controller", "GrpcServer")
+	return &Server{notifServ: notifServ, auth: authServ, log: l}
+}
+
+// Server implements the Meetings grpc service on top of the notifications service, grpc streams are just another kind of subscriber.
+type Server struct {
+	meetingspb.UnimplementedMeetingsServer
+	log       *zap.SugaredLogger
+	notifServ *notifications.Service
+	auth      *auth.Service
+}
+
+// Register mounts the Meetings service in a grpc server
+func (s *Server) Register(g *grpc.Server) {
+	meetingspb.RegisterMeetingsServer(g, s)
+}
+
+func (s *Server) Subscribe(req *meetingspb.SubscriptionRequest, stream meetingspb.Meetings_SubscribeServer) error {
+	ctx := stream.Context()
+	user, err := s.authenticate(ctx)
+	if err != nil {
+		return err
+	}
+	calendarName := req.Calendar
+	if calendarName == "" {
+		calendarName = "primary"
+	}
+
+	l := &streamListener{ctx: ctx, events: make(chan *calendar.Event, streamBuffer), errs: make(chan error, 1)}
+	id, err := s.notifServ.Subscribe(user, calendarName, nil, l)
+	if errors.Is(err, auth.ErrCalendarNotAllowed) {
+		return status.Error(codes.PermissionDenied, "this token can't read calendar "+calendarName)
+	} else if errors.Is(err, auth.ErrGrantRevoked) {
+		return status.Error(codes.FailedPrecondition, "google access revoked, sign in again")
+	} else if errors.Is(err, notifications.ErrShuttingDown) {
+		return status.Error(codes.Unavailable, "server shutting down, subscribe again")
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	defer s.notifServ.Unsubscribe(id)
+	s.log.Infow("grpc client subscribed", "email", user.Email, "calendar", calendarName, "id", id)
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.log.Infow("grpc client disconnected", "email", user.Email, "calendar", calendarName, "id", id)
+			return nil
+		case err := <-l.errs:
+			if errors.Is(err, auth.ErrGrantRevoked) {
+				return status.Error(codes.FailedPrecondition, "google access revoked, sign in again")
+			} else if errors.Is(err, notifications.ErrShuttingDown) {
+				return status.Error(codes.Unavailable, "server shutting down, subscribe again")
+			}
+			return status.Error(codes.Internal, err.Error())
+		case e := <-l.events:
+			err := stream.Send(meetingspb.FromCalendarEvent(e))
+			if err != nil {
+				s.log.Errorw("could not send event to grpc client: "+err.Error(), "email", user.Email, "calendar", calendarName, "id", id)
+				return err
+			}
+		}
+	}
+}
+
+// streamListener receives the events of the subscription of a stream
+type streamListener struct {
+	ctx    context.Context
+	events chan *calendar.Event
+	errs   chan error
+}
+
+func (l *streamListener) SendEvent(_ string, e *calendar.Event) {
+	select {
+	case l.events <- e:
+	case <-l.ctx.Done():
+	}
+}
+
+func (l *streamListener) SendError(_ string, err error) {
+	select {
+	case l.errs <- err:
+	default:
+	}
+}
+
+func (s *Server) authenticate(ctx context.Context) (*auth.UserToken, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	email := firstValue(md, EmailMetadataKey)
+	token := firstValue(md, TokenMetadataKey)
+	if scheme, bearer, ok := strings.Cut(firstValue(md, AuthorizationMetadataKey), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		token, email = strings.TrimSpace(bearer), ""
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing "+AuthorizationMetadataKey+" metadata")
+	}
+	user, err := s.auth.AuthenticateUser(email, token)
+	if errors.Is(err, auth.ErrTokenInvalid) || errors.Is(err, auth.ErrUserNotFound) {
+		// like the rest api, it doesn't tell whether the user exists
+		return nil, status.Error(codes.Unauthenticated, "Token provided is not valid")
+	} else if err != nil {
+		s.log.Errorf("could not authenticate user: %v", err)
+		return nil, status.Error(codes.Internal, "could not authenticate user")
+	}
+	if user.NeedsReconsent {
+		return nil, status.Error(codes.FailedPrecondition, "google access revoked, sign in again")
+	}
+	if !user.Can(auth.CapabilityWebhook) {
+		return nil, status.Error(codes.PermissionDenied, "this token can't stream events")
+	}
+	return user, nil
+}
+
+func firstValue(md metadata.MD, key string) string {
+	vs := md.Get(key)
+	if len(vs) == 0 {
+		return ""
+	}
+	return vs[0]
+}
@@ -0,0 +1,230 @@
+// Package migrate applies numbered schema migrations, each database backend embeds its own and tells how to lock while migrating.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// migrationName matches <version>_<name>.<up|down>.sql
+var migrationName = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+var ErrNoDownMigration = errors.New("NO_DOWN_MIGRATION")
+
+// Migration is a numbered change of the schema, Down is empty for the ones that can't be reverted
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationState is a migration and when it was applied, AppliedAt is nil if it's pending
+type MigrationState struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// Locker keeps other processes from migrating the same database at the same time, it locks the connection migrations run on
+type Locker interface {
+	Lock(ctx context.Context, conn *sqlx.Conn) error
+	Unlock(ctx context.Context, conn *sqlx.Conn) error
+}
+
+// Load reads the migrations in dir of files sorted by version
+func Load(files fs.FS, dir string) ([]*Migration, error) {
+	byVersion := make(map[int]*Migration)
+	err := fs.WalkDir(files, dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		m := migrationName.FindStringSubmatch(path.Base(p))
+		if m == nil {
+			return fmt.Errorf("unexpected migration file %v", p)
+		}
+		version, _ := strconv.Atoi(m[1])
+		sql, err := fs.ReadFile(files, p)
+		if err != nil {
+			return err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = migration
+		} else if migration.Name != m[2] {
+			return fmt.Errorf("migrations %v_%v and %v_%v have the same version", m[1], migration.Name, m[1], m[2])
+		}
+		if m[3] == "up" {
+			migration.Up = string(sql)
+		} else {
+			migration.Down = string(sql)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]*Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %v_%v has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies and reverts migrations, every operation holds the lock of its Locker
+type Migrator struct {
+	db         *sqlx.DB
+	migrations []*Migration
+	locker     Locker
+}
+
+// NewMigrator returns a migrator for the migrations in dir of files, locker can be nil for databases only one process opens (eg: sqlite)
+func NewMigrator(db *sqlx.DB, files fs.FS, dir string, locker Locker) (*Migrator, error) {
+	migrations, err := Load(files, dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: db, migrations: migrations, locker: locker}, nil
+}
+
+// Up applies every pending migration in order, each one in its own transaction. It returns the ones applied.
+func (m *Migrator) Up(ctx context.Context) ([]*Migration, error) {
+	applied := make([]*Migration, 0)
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			err := inTx(ctx, conn, func(tx *sqlx.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, "INSERT INTO schema_version (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("applying migration %v_%v: %w", migration.Version, migration.Name, err)
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down reverts the last steps migrations applied, newest first. It returns the ones reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]*Migration, error) {
+	reverted := make([]*Migration, 0)
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("%w: %v_%v can't be reverted", ErrNoDownMigration, migration.Version, migration.Name)
+			}
+			err := inTx(ctx, conn, func(tx *sqlx.Tx) error {
+				if _, err := tx.ExecContext(ctx, migration.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, "DELETE FROM schema_version WHERE version = $1", migration.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %v_%v: %w", migration.Version, migration.Name, err)
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status returns every migration known to the binary and when it was applied
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationState, error) {
+	states := make([]*MigrationState, 0, len(m.migrations))
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		done, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			state := &MigrationState{Migration: *migration}
+			if appliedAt, ok := done[migration.Version]; ok {
+				state.AppliedAt = &appliedAt
+			}
+			states = append(states, state)
+		}
+		return nil
+	})
+	return states, err
+}
+
+// withLock runs f on a single connection holding the lock, locks like postgres advisory locks belong to the connection that took them
+func (m *Migrator) withLock(ctx context.Context, f func(conn *sqlx.Conn) error) error {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if m.locker != nil {
+		if err := m.locker.Lock(ctx, conn); err != nil {
+			return fmt.Errorf("taking migration lock: %w", err)
+		}
+		defer m.locker.Unlock(context.Background(), conn)
+	}
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_version(version INTEGER PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP)"); err != nil {
+		return err
+	}
+	return f(conn)
+}
+
+// appliedVersions returns when each applied migration was applied
+func appliedVersions(ctx context.Context, conn *sqlx.Conn) (map[int]time.Time, error) {
+	rows := []struct {
+		Version   int       `db:"version"`
+		AppliedAt time.Time `db:"applied_at"`
+	}{}
+	if err := conn.SelectContext(ctx, &rows, "SELECT version, applied_at FROM schema_version"); err != nil {
+		return nil, err
+	}
+	done := make(map[int]time.Time, len(rows))
+	for _, r := range rows {
+		done[r.Version] = r.AppliedAt
+	}
+	return done, nil
+}
+
+func inTx(ctx context.Context, conn *sqlx.Conn, f func(tx *sqlx.Tx) error) error {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -1,29 +1,54 @@
 package postgres
 
 import (
+	"context"
+	"embed"
+
+	"github.com/gabzim/meetings/server/migrate"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
-var schema = `
-CREATE TABLE IF NOT EXISTS user_tokens(
-    id SERIAL PRIMARY KEY,
-    access_token CHAR(255) NOT NULL,
-    refresh_token CHAR(255) NOT NULL,
-    meetings_token CHAR(64) UNIQUE NOT NULL,
-    email VARCHAR(255) UNIQUE NOT NULL,
-    first_name VARCHAR(50),
-    last_name VARCHAR(50),
-    expires_at TIMESTAMP NOT NULL,
-    created_at TIMESTAMP DEFAULT NOW(),
-    updated_at TIMESTAMP DEFAULT NOW()
-)`
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockKey is the advisory lock held while migrating, so replicas starting at the same time don't race
+const migrationLockKey = 7283461
+
+// Connect opens the database without touching its schema
+func Connect(url string) (*sqlx.DB, error) {
+	return sqlx.Connect("postgres", url)
+}
 
+// CreateDB opens the database and applies the pending migrations, replicas starting at the same time wait for each other
 func CreateDB(url string) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("postgres", url)
+	db, err := Connect(url)
 	if err != nil {
 		return nil, err
 	}
-	db.MustExec(schema)
-	return db, err
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewMigrator returns a migrator for the postgres migrations, it holds an advisory lock while migrating
+func NewMigrator(db *sqlx.DB) (*migrate.Migrator, error) {
+	return migrate.NewMigrator(db, migrationFiles, "migrations", advisoryLock{})
+}
+
+type advisoryLock struct{}
+
+func (advisoryLock) Lock(ctx context.Context, conn *sqlx.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey)
+	return err
+}
+
+func (advisoryLock) Unlock(ctx context.Context, conn *sqlx.Conn) error {
+	_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+	return err
 }
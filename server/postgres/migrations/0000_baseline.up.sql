@@ -0,0 +1,76 @@
+-- schema as it was created before migrations existed, every statement is idempotent so databases created back then adopt it as is
+CREATE TABLE IF NOT EXISTS user_tokens(
+    id SERIAL PRIMARY KEY,
+    access_token CHAR(255) NOT NULL,
+    refresh_token CHAR(255) NOT NULL,
+    meetings_token CHAR(64) UNIQUE NOT NULL,
+    email VARCHAR(255) UNIQUE NOT NULL,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS share_freebusy BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS needs_reconsent BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE TABLE IF NOT EXISTS api_tokens(
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    token VARCHAR(64) UNIQUE NOT NULL,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT NOW(),
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+-- meetings_token used to be the only api token of each user, move it to api_tokens so it keeps working
+ALTER TABLE user_tokens ALTER COLUMN meetings_token DROP NOT NULL;
+INSERT INTO api_tokens (user_id, token, label, created_at) SELECT id, meetings_token, 'legacy', created_at FROM user_tokens WHERE meetings_token IS NOT NULL ON CONFLICT (token) DO NOTHING;
+UPDATE user_tokens SET meetings_token = NULL WHERE meetings_token IS NOT NULL;
+-- tokens are stored as a keyed hash, plain text ones left in token are hashed the first time they are used
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS token_prefix VARCHAR(8);
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS token_hash VARCHAR(64);
+ALTER TABLE api_tokens ALTER COLUMN token DROP NOT NULL;
+CREATE INDEX IF NOT EXISTS api_tokens_token_prefix ON api_tokens(token_prefix);
+-- json with the calendars, event fields and apis the token is restricted to, NULL for full access
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS scopes TEXT;
+-- google tokens are encrypted with a data key of their own, wrapped with the key key_id identifies. access_token and refresh_token are left empty
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS encrypted_tokens TEXT;
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS wrapped_key TEXT;
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS key_id VARCHAR(32);
+-- space separated google scopes the user granted, NULL for users from before it was tracked (they granted the sign in scopes)
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS granted_scopes TEXT;
+CREATE TABLE IF NOT EXISTS device_codes(
+    id SERIAL PRIMARY KEY,
+    device_code_hash VARCHAR(64) UNIQUE NOT NULL,
+    user_code VARCHAR(9) NOT NULL,
+    device VARCHAR(100) NOT NULL DEFAULT '',
+    user_id INTEGER REFERENCES user_tokens(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    last_polled_at TIMESTAMP,
+    consumed_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS device_codes_user_code ON device_codes(user_code);
+-- audit_log rows are kept after the user is deleted, so user_id is not a foreign key
+CREATE TABLE IF NOT EXISTS audit_log(
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    actor VARCHAR(50) NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS audit_log_user_id ON audit_log(user_id);
+CREATE TABLE IF NOT EXISTS feed_tokens(
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    token VARCHAR(64) UNIQUE NOT NULL,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    calendar VARCHAR(255) NOT NULL DEFAULT 'primary',
+    filter TEXT NOT NULL DEFAULT '{}',
+    privacy VARCHAR(20) NOT NULL DEFAULT 'full',
+    created_at TIMESTAMP DEFAULT NOW(),
+    revoked_at TIMESTAMP
+);
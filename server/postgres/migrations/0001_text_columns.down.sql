@@ -0,0 +1,3 @@
+ALTER TABLE user_tokens ALTER COLUMN meetings_token TYPE CHAR(64);
+ALTER TABLE user_tokens ALTER COLUMN refresh_token TYPE CHAR(255);
+ALTER TABLE user_tokens ALTER COLUMN access_token TYPE CHAR(255);
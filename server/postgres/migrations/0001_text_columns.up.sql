@@ -0,0 +1,4 @@
+-- CHAR pads values with spaces and google access tokens can be longer than 255 characters
+ALTER TABLE user_tokens ALTER COLUMN access_token TYPE TEXT USING rtrim(access_token);
+ALTER TABLE user_tokens ALTER COLUMN refresh_token TYPE TEXT USING rtrim(refresh_token);
+ALTER TABLE user_tokens ALTER COLUMN meetings_token TYPE VARCHAR(64) USING rtrim(meetings_token);
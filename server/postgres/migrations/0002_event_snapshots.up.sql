@@ -0,0 +1,9 @@
+-- the events of the calendars being watched, a restarted server serves them right away and only asks google for what changed
+CREATE TABLE event_snapshots(
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    calendar VARCHAR(255) NOT NULL,
+    sync_token TEXT NOT NULL DEFAULT '',
+    events TEXT NOT NULL DEFAULT '[]',
+    synced_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (user_id, calendar)
+);
@@ -0,0 +1,5 @@
+DROP TABLE api_token_ips;
+DROP INDEX audit_log_created_at;
+ALTER TABLE audit_log DROP COLUMN outcome;
+ALTER TABLE audit_log DROP COLUMN user_agent;
+ALTER TABLE audit_log DROP COLUMN ip;
@@ -0,0 +1 @@
+ALTER TABLE mirrors DROP COLUMN rule;
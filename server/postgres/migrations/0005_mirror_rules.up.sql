@@ -0,0 +1,2 @@
+-- copy rules of the mirrors that copy events instead of writing busy blocks
+ALTER TABLE mirrors ADD COLUMN rule TEXT NOT NULL DEFAULT '';
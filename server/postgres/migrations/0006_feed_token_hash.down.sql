@@ -0,0 +1,5 @@
+-- feeds only known by their hash can't be used without it
+DELETE FROM feed_tokens WHERE token IS NULL;
+DROP INDEX feed_tokens_token_hash;
+ALTER TABLE feed_tokens ALTER COLUMN token SET NOT NULL;
+ALTER TABLE feed_tokens DROP COLUMN token_hash;
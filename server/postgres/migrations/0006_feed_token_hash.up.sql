@@ -0,0 +1,4 @@
+-- feed tokens are stored hashed, token only keeps the ones created before until they're first used
+ALTER TABLE feed_tokens ADD COLUMN token_hash VARCHAR(64);
+ALTER TABLE feed_tokens ALTER COLUMN token DROP NOT NULL;
+CREATE UNIQUE INDEX feed_tokens_token_hash ON feed_tokens(token_hash);
@@ -0,0 +1,422 @@
+// Package account serves the pages where users manage their account: api tokens, connected devices, feeds and settings.
+// Users sign in with google, the session lives in a cookie and every form carries the csrf token of the session.
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/feeds"
+	"github.com/gabzim/meetings/server/services/notifications"
+	"go.uber.org/zap"
+)
+
+// maxLabelLength matches the label column of api_tokens
+const maxLabelLength = 100
+
+// audit entries shown on the account page and returned by the api
+const (
+	activityOnPage   = 20
+	defaultAuditPage = 50
+	maxAuditPage     = 500
+)
+
+func NewController(serv *Service, authServ *auth.Service, notifServ *notifications.Service, feedsServ *feeds.Service, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "AccountController")
+	return &Controller{serv: serv, auth: authServ, notif: notifServ, feeds: feedsServ, log: l}
+}
+
+type Controller struct {
+	log   *zap.SugaredLogger
+	serv  *Service
+	auth  *auth.Service
+	notif *notifications.Service
+	feeds *feeds.Service
+}
+
+// featureView is a feature that needs more google access and whether the user granted it
+type featureView struct {
+	Name       auth.Feature
+	Granted    bool
+	UpgradeURL string
+}
+
+type pageData struct {
+	User *auth.UserToken
+	CSRF string
+	// NewToken is the token just created, its value is only shown once
+	NewToken    *auth.APIToken
+	Error       string
+	Tokens      []*auth.APIToken
+	Calendars   []notifications.WatchedCalendar
+	Connections []notifications.ConnectionInfo
+	Feeds       []*feeds.FeedToken
+	Features    []featureView
+	// Activity are the latest entries of the audit log about the user
+	Activity []*audit.Entry
+}
+
+// Account handles GET /account
+func (c *Controller) Account(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.authenticate(w, r)
+	if !ok {
+		return
+	}
+	c.render(w, r, user, 200, pageData{})
+}
+
+// CreateToken handles POST /account/tokens with a label, the page is rendered with the new token
+func (c *Controller) CreateToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authenticateForm(w, r)
+	if !ok {
+		return
+	}
+	label := strings.TrimSpace(r.PostFormValue("label"))
+	if label == "" || len(label) > maxLabelLength {
+		c.render(w, r, user, 400, pageData{Error: fmt.Sprintf("Tokens need a label of up to %v characters", maxLabelLength)})
+		return
+	}
+	apiToken, err := c.auth.CreateAPIToken(user, label, nil, nil)
+	if err != nil {
+		c.log.Errorw("could not create api token: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionTokenCreate, audit.OutcomeSuccess, fmt.Sprintf("token %v: %v", apiToken.Id, label))
+	c.render(w, r, user, 200, pageData{NewToken: apiToken})
+}
+
+// RevokeToken handles POST /account/tokens/revoke with the id of the token
+func (c *Controller) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authenticateForm(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid token id")
+		return
+	}
+	err = c.auth.RevokeAPIToken(user, id)
+	if err != nil && !errors.Is(err, auth.ErrAPITokenNotFound) {
+		c.log.Errorw("could not revoke api token: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionTokenRevoke, outcome(err), fmt.Sprintf("token %v", id))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// RevokeFeed handles POST /account/feeds/revoke with the id of the feed
+func (c *Controller) RevokeFeed(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authenticateForm(w, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseInt(r.PostFormValue("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid feed id")
+		return
+	}
+	err = c.feeds.Revoke(user, id)
+	if err != nil && !errors.Is(err, feeds.ErrFeedNotFound) {
+		c.log.Errorw("could not revoke feed: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionFeedRevoke, outcome(err), fmt.Sprintf("feed %v", id))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// FreeBusy handles POST /account/freebusy, share is "true" to opt in to sharing free/busy information
+func (c *Controller) FreeBusy(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authenticateForm(w, r)
+	if !ok {
+		return
+	}
+	share := r.PostFormValue("share") == "true"
+	if err := c.auth.SetShareFreeBusy(user, share); err != nil {
+		c.log.Errorw("could not change free/busy sharing: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionSharingChange, audit.OutcomeSuccess, fmt.Sprintf("share: %v", share))
+	http.Redirect(w, r, "/account", http.StatusSeeOther)
+}
+
+// Export handles GET /account/export, it downloads everything we keep about the user as json
+func (c *Controller) Export(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.authenticate(w, r)
+	if !ok {
+		return
+	}
+	c.writeExport(w, r, user)
+}
+
+// Delete handles POST /account/delete, confirm must be the email of the user
+func (c *Controller) Delete(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authenticateForm(w, r)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(strings.TrimSpace(r.PostFormValue("confirm")), user.Email) {
+		c.render(w, r, user, 400, pageData{Error: "Type your email to confirm you want to delete your account"})
+		return
+	}
+	if err := c.serv.Delete(r.Context(), user, auth.Origin(r, user)); err != nil {
+		c.log.Errorw("could not delete account: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	auth.EndSession(w, r)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Your account was deleted and we revoked our access to your google calendar. The audit log keeps a record of the deletion with your email.")
+}
+
+// API handles DELETE /api/v1/account?confirm=<email of the user>
+func (c *Controller) API(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.authenticateToken(w, r)
+	if !ok {
+		return
+	}
+	if !strings.EqualFold(r.URL.Query().Get("confirm"), user.Email) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "confirm must be the email of the account")
+		return
+	}
+	if err := c.serv.Delete(r.Context(), user, auth.Origin(r, user)); err != nil {
+		c.log.Errorw("could not delete account: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// AdminDelete handles POST /admin/users/delete?email=<email>, it's how meetings-server delete-user gets the running server to
+// disconnect the clients of the user and stop the google channels of its calendars. Only mounted behind the admin tokens.
+func (c *Controller) AdminDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	user, err := c.auth.GetUserByEmail(r.URL.Query().Get("email"))
+	if errors.Is(err, auth.ErrUserNotFound) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "User not found")
+		return
+	} else if err != nil {
+		c.log.Errorf("could not find user to delete: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	if err := c.serv.Delete(r.Context(), user, audit.RequestOrigin(r, audit.ActorAdmin)); err != nil {
+		c.log.Errorw("could not delete account: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// APIExport handles GET /api/v1/account/export
+func (c *Controller) APIExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.authenticateToken(w, r)
+	if !ok {
+		return
+	}
+	c.writeExport(w, r, user)
+}
+
+func (c *Controller) writeExport(w http.ResponseWriter, r *http.Request, user *auth.UserToken) {
+	export, err := c.serv.Export(user, auth.Origin(r, user))
+	if err != nil {
+		c.log.Errorw("could not export account: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="meetings-export.json"`)
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(export)
+}
+
+// Logout handles POST /account/logout
+func (c *Controller) Logout(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authenticateForm(w, r)
+	if !ok {
+		return
+	}
+	if err := auth.EndSession(w, r); err != nil {
+		c.log.Errorf("could not end session: %v", err)
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionLogout, audit.OutcomeSuccess, "")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// APIAudit handles GET /api/v1/account/audit?before=<id>&limit=<n>, the entries of the audit log about the user, newest first.
+// nextBefore is the before param of the next page, it's missing on the last one.
+func (c *Controller) APIAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.authenticateToken(w, r)
+	if !ok {
+		return
+	}
+	var before int64
+	if v := r.URL.Query().Get("before"); v != "" {
+		var err error
+		if before, err = strconv.ParseInt(v, 10, 64); err != nil || before <= 0 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "before must be the id of an entry")
+			return
+		}
+	}
+	limit := defaultAuditPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > maxAuditPage {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "limit must be between 1 and %v", maxAuditPage)
+			return
+		}
+	}
+	entries, err := c.serv.Activity(user, before, limit)
+	if err != nil {
+		c.log.Errorw("could not list audit entries: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	page := auditPage{Items: entries}
+	if len(entries) == limit {
+		page.NextBefore = entries[len(entries)-1].Id
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(page)
+}
+
+type auditPage struct {
+	Items      []*audit.Entry `json:"items"`
+	NextBefore int64          `json:"nextBefore,omitempty"`
+}
+
+// outcome is the audit outcome of an action that failed with err, nil if it succeeded
+func outcome(err error) string {
+	if err != nil {
+		return audit.OutcomeFailure
+	}
+	return audit.OutcomeSuccess
+}
+
+func (c *Controller) render(w http.ResponseWriter, r *http.Request, user *auth.UserToken, status int, data pageData) {
+	var err error
+	data.User = user
+	data.CSRF = auth.CSRFToken(r)
+	if data.Tokens, err = c.auth.ListAPITokens(user); err != nil {
+		c.log.Errorw("could not list api tokens: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	userFeeds, err := c.feeds.List(user)
+	if err != nil {
+		c.log.Errorw("could not list feeds: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	for _, f := range userFeeds {
+		if !f.IsRevoked() {
+			data.Feeds = append(data.Feeds, f)
+		}
+	}
+	if data.Activity, err = c.serv.Activity(user, 0, activityOnPage); err != nil {
+		c.log.Errorw("could not list audit entries: "+err.Error(), "email", user.Email)
+		w.WriteHeader(500)
+		return
+	}
+	data.Calendars = c.notif.WatchedCalendars(user.Email)
+	data.Connections = c.notif.Connections(user.Email)
+	for _, f := range auth.Features() {
+		data.Features = append(data.Features, featureView{Name: f, Granted: user.CanUse(f), UpgradeURL: auth.UpgradePath(f)})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// the page shows tokens, don't let anyone cache it or frame it
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.WriteHeader(status)
+	if err := accountPage.Execute(w, data); err != nil {
+		c.log.Errorf("could not render account page: %v", err)
+	}
+}
+
+// authenticate sends users without a session to sign in with google
+func (c *Controller) authenticate(w http.ResponseWriter, r *http.Request) (*auth.UserToken, bool) {
+	user, err := c.auth.AuthenticateSession(r)
+	if errors.Is(err, auth.ErrNoSession) || errors.Is(err, auth.ErrUserNotFound) {
+		http.Redirect(w, r, "/auth/google", http.StatusFound)
+		return nil, false
+	} else if err != nil {
+		c.log.Errorf("could not authenticate session: %v", err)
+		w.WriteHeader(500)
+		return nil, false
+	}
+	return user, true
+}
+
+// authenticateToken authenticates api requests, made with an api token instead of the session. The token needs the admin capability
+func (c *Controller) authenticateToken(w http.ResponseWriter, r *http.Request) (*auth.UserToken, bool) {
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	// exporting or deleting the account is as powerful as it gets
+	if !auth.RequireCapability(w, user, auth.CapabilityAdmin) {
+		return nil, false
+	}
+	return user, true
+}
+
+// authenticateForm authenticates POSTs of the account forms, they must carry the csrf token of the session
+func (c *Controller) authenticateForm(w http.ResponseWriter, r *http.Request) (*auth.UserToken, bool) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return nil, false
+	}
+	user, ok := c.authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	if !auth.CheckCSRF(r) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Invalid csrf token, reload the page and try again")
+		return nil, false
+	}
+	return user, true
+}
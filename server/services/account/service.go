@@ -0,0 +1,101 @@
+package account
+
+import (
+	"context"
+	"time"
+
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/feeds"
+	"github.com/gabzim/meetings/server/services/notifications"
+	"go.uber.org/zap"
+)
+
+// Export is everything we keep about a user. Google credentials are left out, they're only good to talk to google on behalf of the user.
+type Export struct {
+	ExportedAt time.Time          `json:"exportedAt"`
+	User       ExportedUser       `json:"user"`
+	APITokens  []*auth.APIToken   `json:"apiTokens"`
+	Feeds      []*feeds.FeedToken `json:"feeds"`
+	Audit      []*audit.Entry     `json:"audit"`
+}
+
+type ExportedUser struct {
+	Email          string     `json:"email"`
+	FirstName      string     `json:"firstName"`
+	LastName       string     `json:"lastName"`
+	CreatedAt      *time.Time `json:"createdAt"`
+	UpdatedAt      *time.Time `json:"updatedAt"`
+	ShareFreeBusy  bool       `json:"shareFreeBusy"`
+	NeedsReconsent bool       `json:"needsReconsent"`
+	GoogleScopes   []string   `json:"googleScopes"`
+}
+
+type Service struct {
+	logger *zap.SugaredLogger
+	auth   *auth.Service
+	notif  *notifications.Service
+	feeds  *feeds.Service
+	audit  *audit.Service
+}
+
+func NewService(logger *zap.SugaredLogger, authServ *auth.Service, notifServ *notifications.Service, feedsServ *feeds.Service, auditServ *audit.Service) *Service {
+	l := logger.With("service", "AccountService")
+	return &Service{logger: l, auth: authServ, notif: notifServ, feeds: feedsServ, audit: auditServ}
+}
+
+// Export gathers everything stored about the user, by is who asked for it
+func (s *Service) Export(t *auth.UserToken, by audit.Origin) (*Export, error) {
+	tokens, err := s.auth.ListAPITokens(t)
+	if err != nil {
+		return nil, err
+	}
+	userFeeds, err := s.feeds.List(t)
+	if err != nil {
+		return nil, err
+	}
+	s.audit.Record(&audit.Entry{UserId: t.Id, Email: t.Email, Action: audit.ActionAccountExport, Origin: by})
+	entries, err := s.audit.List(t.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &Export{
+		ExportedAt: time.Now(),
+		User: ExportedUser{
+			Email:          t.Email,
+			FirstName:      t.FirstName,
+			LastName:       t.LastName,
+			CreatedAt:      t.CreatedAt,
+			UpdatedAt:      t.UpdatedAt,
+			ShareFreeBusy:  t.ShareFreeBusy,
+			NeedsReconsent: t.NeedsReconsent,
+			GoogleScopes:   t.GoogleScopes(),
+		},
+		APITokens: tokens,
+		Feeds:     userFeeds,
+		Audit:     entries,
+	}, nil
+}
+
+// Activity returns up to limit entries of the audit log about the user older than the entry with id before (0 for the latest ones), newest first
+func (s *Service) Activity(t *auth.UserToken, before int64, limit int) ([]*audit.Entry, error) {
+	return s.audit.Page(t.Id, before, limit)
+}
+
+// Delete closes the account of the user: its clients are disconnected and the google channels of its calendars stopped, its mirrors
+// are stopped and their blocks removed, the access it gave us is revoked at google and its rows are deleted. Failing to revoke the grant doesn't stop the deletion, it's recorded in the audit log.
+func (s *Service) Delete(ctx context.Context, t *auth.UserToken, by audit.Origin) error {
+	s.notif.DisconnectUser(t.Email, auth.ErrAccountDeleted)
+	s.auth.DeletingUser(ctx, t)
+	detail := "google grant revoked"
+	if err := s.auth.RevokeGoogleGrant(ctx, t); err != nil {
+		s.logger.Errorw("could not revoke google grant of deleted user: "+err.Error(), "email", t.Email)
+		detail = "google grant could not be revoked: " + err.Error()
+	}
+	if err := s.auth.DeleteUser(t); err != nil {
+		s.audit.Record(&audit.Entry{UserId: t.Id, Email: t.Email, Action: audit.ActionAccountDelete, Origin: by, Outcome: audit.OutcomeFailure, Detail: detail + ", deleting rows failed: " + err.Error()})
+		return err
+	}
+	s.audit.Record(&audit.Entry{UserId: t.Id, Email: t.Email, Action: audit.ActionAccountDelete, Origin: by, Detail: detail})
+	return nil
+}
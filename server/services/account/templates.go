@@ -0,0 +1,136 @@
+package account
+
+import (
+	"html/template"
+	"time"
+)
+
+var funcs = template.FuncMap{
+	// when formats time.Time and *time.Time values, "-" if they're not set
+	"when": func(v interface{}) string {
+		var t time.Time
+		switch tv := v.(type) {
+		case time.Time:
+			t = tv
+		case *time.Time:
+			if tv != nil {
+				t = *tv
+			}
+		}
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04")
+	},
+}
+
+var accountPage = template.Must(template.New("account").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<title>Your account - meetings</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: .3em .6em; border-bottom: 1px solid #ddd; }
+form.inline { display: inline; }
+.notice { background: #ffd; padding: .6em; }
+code { word-break: break-all; }
+</style>
+</head>
+<body>
+<form class="inline" method="POST" action="/account/logout"><input type="hidden" name="csrf" value="{{.CSRF}}"><button type="submit">Sign out</button></form>
+<h1>{{.User.Email}}</h1>
+{{if .User.NeedsReconsent}}<p class="notice">Google access was revoked, <a href="/auth/google">sign in again</a> so your clients get events.</p>{{end}}
+{{if .Error}}<p class="notice">{{.Error}}</p>{{end}}
+
+<h2>API tokens</h2>
+{{with .NewToken}}
+<p class="notice">Your new token, copy it now, it won't be shown again:<br><code>{{.Token}}</code><br>
+Older clients asking for "email token" take: <code>{{$.User.Email}} {{.Token}}</code></p>
+{{end}}
+<table>
+<tr><th>Label</th><th>Token</th><th>Scopes</th><th>Created</th><th>Last used</th><th>Expires</th><th></th></tr>
+{{range .Tokens}}
+<tr>
+<td>{{.Label}}</td><td><code>{{.Prefix}}…</code></td><td>{{.Scopes.String}}</td><td>{{when .CreatedAt}}</td><td>{{when .LastUsedAt}}</td><td>{{when .ExpiresAt}}</td>
+<td>{{if .RevokedAt}}revoked {{when .RevokedAt}}{{else}}<form class="inline" method="POST" action="/account/tokens/revoke"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="id" value="{{.Id}}"><button type="submit">Revoke</button></form>{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="7">No tokens yet</td></tr>
+{{end}}
+</table>
+<form method="POST" action="/account/tokens">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="label" placeholder="Label, eg: office pi" maxlength="100" required>
+<button type="submit">Create token</button>
+</form>
+
+<h2>Watched calendars</h2>
+<table>
+<tr><th>Calendar</th><th>Subscriptions</th><th>Google push notifications</th></tr>
+{{range .Calendars}}
+<tr><td>{{.Calendar}}</td><td>{{.Subscriptions}}</td><td>{{if .WebhookRunning}}on{{else}}starting{{end}}</td></tr>
+{{else}}
+<tr><td colspan="3">No client is watching your calendars right now</td></tr>
+{{end}}
+</table>
+
+<h2>Connected devices</h2>
+<table>
+<tr><th>Device</th><th>Address</th><th>Calendars</th><th>Connected</th><th>Last activity</th></tr>
+{{range .Connections}}
+<tr><td>{{if .Device}}{{.Device}}{{else}}unnamed{{end}}</td><td>{{.RemoteAddr}}</td><td>{{range $i, $c := .Calendars}}{{if $i}}, {{end}}{{$c}}{{end}}</td><td>{{when .ConnectedAt}}</td><td>{{when .LastActivity}}</td></tr>
+{{else}}
+<tr><td colspan="5">No devices connected</td></tr>
+{{end}}
+</table>
+
+<h2>Calendar feeds</h2>
+<table>
+<tr><th>Label</th><th>Calendar</th><th>Privacy</th><th>Created</th><th></th></tr>
+{{range .Feeds}}
+<tr><td>{{.Label}}</td><td>{{.Calendar}}</td><td>{{.Privacy}}</td><td>{{when .CreatedAt}}</td>
+<td><form class="inline" method="POST" action="/account/feeds/revoke"><input type="hidden" name="csrf" value="{{$.CSRF}}"><input type="hidden" name="id" value="{{.Id}}"><button type="submit">Revoke</button></form></td></tr>
+{{else}}
+<tr><td colspan="5">No feeds, create them with POST /api/v1/feeds</td></tr>
+{{end}}
+</table>
+
+<h2>Free/busy sharing</h2>
+<form method="POST" action="/account/freebusy">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<label><input type="checkbox" name="share" value="true" {{if .User.ShareFreeBusy}}checked{{end}}> Let other users of this server see when I'm busy</label>
+<button type="submit">Save</button>
+</form>
+
+<h2>Google access</h2>
+<p>We can read your calendars. Some features need to change them too, google asks you for that when you turn them on.</p>
+<table>
+<tr><th>Feature</th><th>Access</th></tr>
+{{range .Features}}
+<tr><td>{{.Name}}</td><td>{{if .Granted}}granted{{else}}<a href="{{.UpgradeURL}}">Allow editing events</a>{{end}}</td></tr>
+{{end}}
+</table>
+
+<h2>Recent activity</h2>
+<table>
+<tr><th>When</th><th>Action</th><th>By</th><th>Address</th><th>Outcome</th><th>Detail</th></tr>
+{{range .Activity}}
+<tr><td>{{when .CreatedAt}}</td><td>{{.Action}}</td><td>{{.Actor}}</td><td>{{.IP}}</td><td>{{.Outcome}}</td><td>{{.Detail}}</td></tr>
+{{else}}
+<tr><td colspan="6">Nothing yet</td></tr>
+{{end}}
+</table>
+<p>The whole log is at GET /api/v1/account/audit.</p>
+
+<h2>Your data</h2>
+<p><a href="/account/export">Download everything we keep about you</a> (json)</p>
+<form method="POST" action="/account/delete">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p>Deleting your account disconnects your devices, revokes our access to your google calendar and deletes all your data. It can't be undone.</p>
+<input name="confirm" placeholder="Type your email to confirm" required>
+<button type="submit">Delete my account</button>
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Origin is who did something and from where
+type Origin struct {
+	// Actor is who did it: user, cli, token:<id>...
+	Actor     string `db:"actor" json:"actor"`
+	IP        string `db:"ip" json:"ip,omitempty"`
+	UserAgent string `db:"user_agent" json:"userAgent,omitempty"`
+}
+
+// Entry records something done to an account. Entries outlive the users they're about, so they keep the email instead of relying on user_tokens.
+type Entry struct {
+	Id     int64  `db:"id" json:"id"`
+	UserId int64  `db:"user_id" json:"-"`
+	Email  string `db:"email" json:"email"`
+	// Action is what was done, eg: account.export
+	Action string `db:"action" json:"action"`
+	Origin
+	// Outcome is OutcomeSuccess if it's empty
+	Outcome   string    `db:"outcome" json:"outcome"`
+	Detail    string    `db:"detail" json:"detail,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// Store keeps the audit log, EntryStore implements it on postgres and sqlite. Entries are never updated, only deleted once they're older than the retention.
+type Store interface {
+	Insert(e *Entry) error
+	// SelectByUser returns every entry about the user, oldest first
+	SelectByUser(userId int64) ([]*Entry, error)
+	// SelectPage returns up to limit entries about the user older than the entry with id before (0 for the newest ones), newest first
+	SelectPage(userId, before int64, limit int) ([]*Entry, error)
+	// DeleteBefore deletes the entries created before t and returns how many
+	DeleteBefore(t time.Time) (int64, error)
+}
+
+type EntryStore struct {
+	db *sqlx.DB
+}
+
+func NewEntryStore(db *sqlx.DB) *EntryStore {
+	return &EntryStore{db: db}
+}
+
+const entryColumns = "id, user_id, email, action, actor, ip, user_agent, outcome, detail, created_at"
+
+func (s *EntryStore) Insert(e *Entry) error {
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	if e.Outcome == "" {
+		e.Outcome = OutcomeSuccess
+	}
+	return s.db.Get(&e.Id, "INSERT INTO audit_log (user_id, email, action, actor, ip, user_agent, outcome, detail, created_at) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9) RETURNING id",
+		e.UserId, e.Email, e.Action, e.Actor, e.IP, e.UserAgent, e.Outcome, e.Detail, e.CreatedAt)
+}
+
+func (s *EntryStore) SelectByUser(userId int64) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	err := s.db.Select(&entries, "SELECT "+entryColumns+" FROM audit_log WHERE user_id = $1 ORDER BY id", userId)
+	return entries, err
+}
+
+func (s *EntryStore) SelectPage(userId, before int64, limit int) ([]*Entry, error) {
+	entries := make([]*Entry, 0)
+	var err error
+	if before > 0 {
+		err = s.db.Select(&entries, "SELECT "+entryColumns+" FROM audit_log WHERE user_id = $1 AND id < $2 ORDER BY id DESC LIMIT $3", userId, before, limit)
+	} else {
+		err = s.db.Select(&entries, "SELECT "+entryColumns+" FROM audit_log WHERE user_id = $1 ORDER BY id DESC LIMIT $2", userId, limit)
+	}
+	return entries, err
+}
+
+func (s *EntryStore) DeleteBefore(t time.Time) (int64, error) {
+	res, err := s.db.Exec("DELETE FROM audit_log WHERE created_at < $1", t)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
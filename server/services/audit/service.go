@@ -0,0 +1,172 @@
+// Package audit keeps an append only log of security relevant actions on accounts: sign ins, tokens created and revoked, tokens used from
+// new addresses, websocket connections, changes to settings, exports and deletions.
+package audit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// actions recorded
+const (
+	ActionLogin       = "login"
+	ActionLogout      = "logout"
+	ActionDeviceLogin = "login.device"
+	ActionGoogleGrant = "google.grant"
+	ActionTokenCreate = "token.create"
+	ActionTokenRevoke = "token.revoke"
+	ActionTokenNewIP  = "token.new_ip"
+	// ActionTokenAuth is a request whose token was rejected, successful ones aren't recorded
+	ActionTokenAuth     = "token.auth"
+	ActionFeedCreate    = "feed.create"
+	ActionFeedRevoke    = "feed.revoke"
+	ActionMirrorCreate  = "mirror.create"
+	ActionMirrorAccept  = "mirror.accept"
+	ActionMirrorDelete  = "mirror.delete"
+	ActionSharingChange = "freebusy.sharing"
+	ActionConnect       = "websocket.connect"
+	ActionDisconnect    = "websocket.disconnect"
+	ActionAccountExport = "account.export"
+	ActionAccountDelete = "account.delete"
+)
+
+// actors
+const (
+	ActorUser = "user"
+	ActorCLI  = "cli"
+	// ActorAdmin is someone with one of the admin tokens of the server, eg: meetings-server delete-user
+	ActorAdmin = "admin"
+)
+
+// TokenActor is the actor of actions done with the api token with the given id
+func TokenActor(id int64) string {
+	return "token:" + strconv.FormatInt(id, 10)
+}
+
+// outcomes
+const (
+	OutcomeSuccess = "success"
+	// OutcomeFailure is for actions that failed, eg: revoking a token that doesn't exist
+	OutcomeFailure = "failure"
+	// OutcomeDenied is for actions that weren't allowed, eg: the user didn't grant google access
+	OutcomeDenied = "denied"
+)
+
+// CLI is the origin of the commands run on the server
+var CLI = Origin{Actor: ActorCLI}
+
+// RequestOrigin is actor making the request r
+func RequestOrigin(r *http.Request, actor string) Origin {
+	return Origin{Actor: actor, IP: ClientIP(r), UserAgent: r.UserAgent()}
+}
+
+// trustedProxies are the proxies whose X-Forwarded-For is believed, see TrustProxies
+var trustedProxies []*net.IPNet
+
+// TrustProxies sets the addresses (or CIDR ranges) of the proxies in front of the server, eg: the ingress. Call it before serving.
+func TrustProxies(proxies []string) error {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		if ip := net.ParseIP(p); ip != nil {
+			if v4 := ip.To4(); v4 != nil {
+				ip = v4
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("%q is not an address or a CIDR range", p)
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP is the address the request comes from. Clients can send any X-Forwarded-For, so it's only read when the request comes from a
+// trusted proxy and the address is the rightmost one that isn't a trusted proxy, the one the first proxy added.
+func ClientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !isTrustedProxy(addr) {
+		return addr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if ip == "" {
+			continue
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+		addr = ip
+	}
+	return addr
+}
+
+type Service struct {
+	logger *zap.SugaredLogger
+	store  Store
+}
+
+func NewService(logger *zap.SugaredLogger, store Store) *Service {
+	l := logger.With("service", "AuditService")
+	return &Service{logger: l, store: store}
+}
+
+// Record saves the entry, failing to do so is logged but doesn't fail the action being recorded
+func (s *Service) Record(e *Entry) {
+	if err := s.store.Insert(e); err != nil {
+		s.logger.Errorw("could not record audit entry: "+err.Error(), "email", e.Email, "action", e.Action, "actor", e.Actor, "outcome", e.Outcome, "detail", e.Detail)
+	}
+}
+
+// List returns the entries about a user, oldest first
+func (s *Service) List(userId int64) ([]*Entry, error) {
+	return s.store.SelectByUser(userId)
+}
+
+// Page returns up to limit entries about a user older than the entry with id before (0 for the latest ones), newest first
+func (s *Service) Page(userId, before int64, limit int) ([]*Entry, error) {
+	return s.store.SelectPage(userId, before, limit)
+}
+
+// KeepFor deletes entries once they're older than retention, it checks every hour. Entries are kept forever if it's not called.
+func (s *Service) KeepFor(retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for {
+			n, err := s.store.DeleteBefore(time.Now().Add(-retention))
+			if err != nil {
+				s.logger.Errorf("could not delete old audit entries: %v", err)
+			} else if n > 0 {
+				s.logger.Infof("deleted %v audit entries older than %v", n, retention)
+			}
+			<-ticker.C
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+var ErrAPITokenNotFound = errors.New("API_TOKEN_NOT_FOUND")
+
+// APIToken is a credential a user gives to one of its clients (the pi running the lights, the laptop...).
+// Users can have as many as they want and revoke them independently.
+// Only a keyed hash of the token is stored, with its first characters to find it. Tokens issued before hashing was introduced are kept in
+// plain text until they are used for the first time.
+type APIToken struct {
+	Id     int64 `db:"id" json:"id"`
+	UserId int64 `db:"user_id" json:"-"`
+	// Token is only known when the token is created, it's sent to the user then and never again
+	Token string `db:"-" json:"token,omitempty"`
+	// Prefix helps users tell their tokens apart
+	Prefix string `db:"token_prefix" json:"prefix"`
+	Hash   string `db:"token_hash" json:"-"`
+	// PlainToken is only set for tokens that haven't been hashed yet
+	PlainToken string     `db:"token" json:"-"`
+	Label      string     `db:"label" json:"label"`
+	CreatedAt  *time.Time `db:"created_at" json:"createdAt"`
+	LastUsedAt *time.Time `db:"last_used_at" json:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time `db:"expires_at" json:"expiresAt,omitempty"`
+	RevokedAt  *time.Time `db:"revoked_at" json:"revokedAt,omitempty"`
+	// Scopes restrict what the token can do, nil for tokens that can do everything
+	Scopes *Scopes `db:"scopes" json:"scopes,omitempty"`
+}
+
+func (t *APIToken) GenerateToken() {
+	t.Token = uniuri.NewLen(64)
+}
+
+// IsValid tells whether the token can still be used to authenticate
+func (t *APIToken) IsValid() bool {
+	return t.RevokedAt == nil && (t.ExpiresAt == nil || t.ExpiresAt.After(time.Now()))
+}
+
+const apiTokenColumns = "id, user_id, COALESCE(token, '') AS token, COALESCE(token_prefix, SUBSTR(token, 1, 8)) AS token_prefix, COALESCE(token_hash, '') AS token_hash, label, created_at, last_used_at, expires_at, revoked_at, scopes"
+
+// lastUsedResolution avoids writing to the db on every request, last_used_at is only updated if it's older than this
+const lastUsedResolution = time.Minute
+
+// SelectAPITokensByPrefix returns the tokens whose first characters are prefix, hashed or not. The caller must find which one matches.
+func (s *TokenStore) SelectAPITokensByPrefix(prefix string) ([]*APIToken, error) {
+	tokens := make([]*APIToken, 0)
+	err := s.db.Select(&tokens, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE token_prefix = $1 OR (token_hash IS NULL AND SUBSTR(token, 1, 8) = $1)", prefix)
+	return tokens, err
+}
+
+// HashAPIToken replaces the plain text token of a row with its hash
+func (s *TokenStore) HashAPIToken(id int64, prefix, hash string) error {
+	_, err := s.db.Exec("UPDATE api_tokens SET token_prefix = $1, token_hash = $2, token = NULL WHERE id = $3", prefix, hash, id)
+	return err
+}
+
+func (s *TokenStore) SelectAPITokensByUser(userId int64) ([]*APIToken, error) {
+	tokens := make([]*APIToken, 0)
+	err := s.db.Select(&tokens, "SELECT "+apiTokenColumns+" FROM api_tokens WHERE user_id = $1 ORDER BY id", userId)
+	return tokens, err
+}
+
+// InsertAPIToken saves a token, Prefix and Hash must be set
+func (s *TokenStore) InsertAPIToken(t *APIToken) (*APIToken, error) {
+	now := time.Now()
+	t.CreatedAt = &now
+	err := s.db.Get(&t.Id, "INSERT INTO api_tokens (user_id, token_prefix, token_hash, label, created_at, expires_at, scopes) VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id", t.UserId, t.Prefix, t.Hash, t.Label, t.CreatedAt, t.ExpiresAt, t.Scopes)
+	return t, err
+}
+
+func (s *TokenStore) RevokeAPIToken(userId, id int64) error {
+	res, err := s.db.Exec("UPDATE api_tokens SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL", time.Now(), id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrAPITokenNotFound
+	}
+	return err
+}
+
+func (s *TokenStore) TouchAPIToken(t *APIToken) error {
+	now := time.Now()
+	if t.LastUsedAt != nil && now.Sub(*t.LastUsedAt) < lastUsedResolution {
+		return nil
+	}
+	t.LastUsedAt = &now
+	_, err := s.db.Exec("UPDATE api_tokens SET last_used_at = $1 WHERE id = $2", now, t.Id)
+	return err
+}
+
+func (s *TokenStore) InsertAPITokenIP(tokenId int64, ip string, at time.Time) (bool, error) {
+	res, err := s.db.Exec("INSERT INTO api_token_ips (api_token_id, ip, first_seen_at) VALUES ($1,$2,$3) ON CONFLICT (api_token_id, ip) DO NOTHING", tokenId, ip, at)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
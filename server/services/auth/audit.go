@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gabzim/meetings/server/services/audit"
+)
+
+// SetAuditLog makes the service and the controllers using it record security relevant actions in log
+func (s *Service) SetAuditLog(log *audit.Service) {
+	s.audit = log
+}
+
+// Origin is who is making the request r on behalf of t: one of its api tokens, or the user itself through the session
+func Origin(r *http.Request, t *UserToken) audit.Origin {
+	actor := audit.ActorUser
+	if t != nil && t.APIToken != nil {
+		actor = audit.TokenActor(t.APIToken.Id)
+	}
+	return audit.RequestOrigin(r, actor)
+}
+
+// Audit records action on the account of t in the audit log, if there's one. outcome is one of the audit outcomes.
+func (s *Service) Audit(o audit.Origin, t *UserToken, action, outcome, detail string) {
+	if s.audit == nil {
+		return
+	}
+	s.audit.Record(&audit.Entry{UserId: t.Id, Email: t.Email, Action: action, Origin: o, Outcome: outcome, Detail: detail})
+}
+
+// rejectedTokenError is an ErrTokenInvalid for a token that exists but can't be used, the audit log records it for its user
+type rejectedTokenError struct {
+	token  *APIToken
+	reason string
+}
+
+func (e *rejectedTokenError) Error() string {
+	return ErrTokenInvalid.Error()
+}
+
+func (e *rejectedTokenError) Unwrap() error {
+	return ErrTokenInvalid
+}
+
+const (
+	// rejectedAuditEvery is how often a rejected request is recorded per token and address, the rest are dropped
+	rejectedAuditEvery = time.Minute
+	// maxRejectionKeys bounds the tokens and addresses rejectionLimiter remembers
+	maxRejectionKeys = 10000
+)
+
+// rejectionLimiter lets one rejected request per key through every rejectedAuditEvery, so junk requests can't flood the audit log or
+// the database
+type rejectionLimiter struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func (l *rejectionLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.last == nil {
+		l.last = make(map[string]time.Time)
+	}
+	if last, ok := l.last[key]; ok && now.Sub(last) < rejectedAuditEvery {
+		return false
+	}
+	if len(l.last) >= maxRejectionKeys {
+		for k, last := range l.last {
+			if now.Sub(last) >= rejectedAuditEvery {
+				delete(l.last, k)
+			}
+		}
+		if len(l.last) >= maxRejectionKeys {
+			return false
+		}
+	}
+	l.last[key] = now
+	return true
+}
+
+// auditRejectedRequest records a request whose credentials were rejected as denied for the user if it was one of its tokens. Unknown
+// tokens are only logged, anyone can send one claiming to be any user. Requests without credentials are not recorded, the others once a
+// minute per token and address.
+func (s *Service) auditRejectedRequest(r *http.Request, err error) {
+	if s.audit == nil || !errors.Is(err, ErrTokenInvalid) || !hasCredentials(r) {
+		return
+	}
+	ip := audit.ClientIP(r)
+	var rejected *rejectedTokenError
+	if errors.As(err, &rejected) {
+		if !s.rejections.allow(audit.TokenActor(rejected.token.Id)+" "+ip, time.Now()) {
+			return
+		}
+		reason := rejected.reason
+		if reason == "" {
+			reason = "token revoked or expired"
+		}
+		user, err := s.store.SelectById(rejected.token.UserId)
+		if err != nil {
+			s.logger.Errorw("could not find the user of a rejected token: "+err.Error(), "token", rejected.token.Id)
+			return
+		}
+		s.Audit(audit.RequestOrigin(r, audit.TokenActor(rejected.token.Id)), user, audit.ActionTokenAuth, audit.OutcomeDenied,
+			fmt.Sprintf("token %v: %v", rejected.token.Id, reason))
+		return
+	}
+	if !s.rejections.allow(ip, time.Now()) {
+		return
+	}
+	reason := "unknown token"
+	if errors.Is(err, ErrQueryTokenDisabled) {
+		reason = "credentials in the query string are disabled"
+	}
+	s.logger.Warnw("rejected request: "+reason, "ip", ip, "path", r.URL.Path, "userAgent", r.UserAgent())
+}
+
+// checkTokenIP records in the audit log the first time each api token is used from an address
+func (s *Service) checkTokenIP(r *http.Request, t *UserToken) {
+	if s.audit == nil || t.APIToken == nil {
+		return
+	}
+	ip := audit.ClientIP(r)
+	key := audit.TokenActor(t.APIToken.Id) + " " + ip
+	if _, seen := s.tokenIPs.Load(key); seen {
+		return
+	}
+	isNew, err := s.store.InsertAPITokenIP(t.APIToken.Id, ip, time.Now())
+	if err != nil {
+		s.logger.Errorw("could not record api token address: "+err.Error(), "email", t.Email, "token", t.APIToken.Id)
+		return
+	}
+	s.tokenIPs.Store(key, struct{}{})
+	if isNew {
+		s.Audit(Origin(r, t), t, audit.ActionTokenNewIP, audit.OutcomeSuccess, t.APIToken.Label)
+	}
+}
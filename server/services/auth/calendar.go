@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/option"
+)
+
+// ErrGrantRevoked means google refused to refresh the access token of the user, it revoked our access or the refresh token expired.
+// The user needs to sign in again.
+var ErrGrantRevoked = errors.New("GOOGLE_GRANT_REVOKED")
+
+// GrantRevokedListener is notified when a user grant is found to be revoked
+type GrantRevokedListener func(t *UserToken)
+
+// UserDeletingListener is notified before a user is deleted, while its google grant still works
+type UserDeletingListener func(ctx context.Context, t *UserToken)
+
+// CalendarService returns a google calendar client acting on behalf of the user, access tokens are refreshed as they expire and saved.
+func (s *Service) CalendarService(ctx context.Context, t *UserToken) (*calendar.Service, error) {
+	return calendar.NewService(ctx, option.WithTokenSource(s.TokenSource(t)))
+}
+
+// TokenSource returns a token source for the user that saves refreshed access tokens, and marks the user as needing re-consent
+// if the refresh token is rejected.
+func (s *Service) TokenSource(t *UserToken) oauth2.TokenSource {
+	return &persistingTokenSource{
+		base:        s.cfg.TokenSource(context.Background(), t.GetOauthToken()),
+		serv:        s,
+		user:        t,
+		accessToken: t.AccessToken,
+	}
+}
+
+// OnGrantRevoked registers a listener called every time a user grant is found to be revoked
+func (s *Service) OnGrantRevoked(l GrantRevokedListener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.revokedListeners = append(s.revokedListeners, l)
+}
+
+// OnUserDeleting registers a listener called every time a user is about to be deleted, see DeletingUser
+func (s *Service) OnUserDeleting(l UserDeletingListener) {
+	s.listenersMu.Lock()
+	defer s.listenersMu.Unlock()
+	s.deletingListeners = append(s.deletingListeners, l)
+}
+
+// DeletingUser tells the listeners the user is about to be deleted. Call it before revoking its google grant, so they can still clean up
+// its calendars.
+func (s *Service) DeletingUser(ctx context.Context, t *UserToken) {
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, l := range s.deletingListeners {
+		l(ctx, t)
+	}
+}
+
+func (s *Service) grantRevoked(t *UserToken) {
+	s.logger.Warnw("google grant revoked, user needs to sign in again", "email", t.Email)
+	if err := s.store.MarkNeedsReconsent(t.Id); err != nil {
+		s.logger.Errorw("could not mark user as needing re-consent: "+err.Error(), "email", t.Email)
+	}
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for _, l := range s.revokedListeners {
+		l(t)
+	}
+}
+
+type persistingTokenSource struct {
+	base oauth2.TokenSource
+	serv *Service
+	user *UserToken
+	// accessToken is the last access token we saw, when the base source returns a different one it was refreshed and must be saved
+	mu          sync.Mutex
+	accessToken string
+	revoked     bool
+}
+
+func (ts *persistingTokenSource) Token() (*oauth2.Token, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.revoked {
+		return nil, ErrGrantRevoked
+	}
+	t, err := ts.base.Token()
+	if isInvalidGrant(err) {
+		ts.revoked = true
+		go ts.serv.grantRevoked(ts.user)
+		return nil, fmt.Errorf("%w: %v", ErrGrantRevoked, err)
+	} else if err != nil {
+		return nil, err
+	}
+	if t.AccessToken != ts.accessToken {
+		ts.accessToken = t.AccessToken
+		if err := ts.serv.store.UpdateOauthToken(ts.user.Id, t); err != nil {
+			ts.serv.logger.Errorw("could not save refreshed access token: "+err.Error(), "email", ts.user.Email)
+		}
+	}
+	return t, nil
+}
+
+func isInvalidGrant(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(retrieveErr.Body, &body)
+	return body.Error == "invalid_grant"
+}
+
+// googleRevokeURL is google's oauth revoke endpoint
+const googleRevokeURL = "https://oauth2.googleapis.com/revoke"
+
+// RevokeGoogleGrant tells google to revoke the access the user gave us, revoking the refresh token revokes its access tokens too.
+// Tokens google doesn't know (already revoked or expired) are not an error.
+func (s *Service) RevokeGoogleGrant(ctx context.Context, t *UserToken) error {
+	token := t.RefreshToken
+	if token == "" {
+		token = t.AccessToken
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, googleRevokeURL, strings.NewReader(url.Values{"token": {token}}.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	json.NewDecoder(res.Body).Decode(&body)
+	if res.StatusCode == http.StatusBadRequest && body.Error == "invalid_token" {
+		return nil
+	}
+	return fmt.Errorf("revoking google grant: %v %v", res.Status, body.Error)
+}
@@ -4,27 +4,31 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
+	"github.com/gabzim/meetings/server/services/audit"
 	"github.com/markbates/goth"
 	"github.com/markbates/goth/gothic"
 	"github.com/markbates/goth/providers/google"
 	"golang.org/x/oauth2"
-	"google.golang.org/api/calendar/v3"
-	"google.golang.org/api/plus/v1"
 )
 
-func NewController(cfg *oauth2.Config, authServ *Service, redirectUrl string) *GoogleAuthController {
-	gProvider := google.New(cfg.ClientID, cfg.ClientSecret, redirectUrl, calendar.CalendarReadonlyScope, plus.UserinfoEmailScope, plus.UserinfoProfileScope)
+func NewController(cfg *oauth2.Config, authServ *Service, redirectUrl, hostURL string) *GoogleAuthController {
+	// features that need more are granted later, see Upgrade
+	gProvider := google.New(cfg.ClientID, cfg.ClientSecret, redirectUrl, signInScopes...)
 	gProvider.SetPrompt("consent")
 
 	goth.UseProviders(gProvider)
-	return &GoogleAuthController{authServ: authServ, google: gProvider}
+	return &GoogleAuthController{cfg: cfg, authServ: authServ, google: gProvider, hostURL: hostURL}
 }
 
 type GoogleAuthController struct {
 	cfg      *oauth2.Config
 	authServ *Service
 	google   goth.Provider
+	// hostURL is where users are sent to sign in devices
+	hostURL string
 }
 
 func (c *GoogleAuthController) Redirect(w http.ResponseWriter, r *http.Request) {
@@ -35,13 +39,48 @@ func (c *GoogleAuthController) Redirect(w http.ResponseWriter, r *http.Request)
 func (c *GoogleAuthController) Callback(w http.ResponseWriter, r *http.Request) {
 	user, err := gothic.CompleteUserAuth(w, r)
 	if err != nil {
+		// the user isn't known yet, the entry only has where the attempt came from
+		outcome, detail := audit.OutcomeFailure, err.Error()
+		if e := r.URL.Query().Get("error"); e != "" {
+			// eg: access_denied when the user doesn't allow access on google's consent screen
+			outcome, detail = audit.OutcomeDenied, e
+		}
+		c.authServ.Audit(audit.RequestOrigin(r, audit.ActorUser), &UserToken{}, audit.ActionLogin, outcome, detail)
+		w.WriteHeader(401)
+		fmt.Fprint(w, "Could not sign in with google, try again")
 		return
 	}
 
-	t, err := c.authServ.RegisterUser(&user)
+	if state := gothic.GetState(r); strings.HasPrefix(state, deviceStatePrefix) {
+		t, err := c.authServ.SaveUser(&user)
+		if err != nil {
+			fmt.Fprint(w, err)
+			return
+		}
+		c.confirmDevice(w, r, t, state)
+		return
+	}
+
+	before, _ := c.authServ.GetUserByEmail(user.Email)
+	t, err := c.authServ.SaveUser(&user)
 	if err != nil {
 		fmt.Fprint(w, err)
 		return
 	}
-	fmt.Fprintf(w, "%s %s", t.Email, t.MeetingsToken)
+	// tokens are created from the account page now
+	if err := StartSession(w, r, t); err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	c.authServ.Audit(Origin(r, t), t, audit.ActionLogin, audit.OutcomeSuccess, "")
+	// the features the user had turned on need their scopes granted again
+	if lost := lostFeatures(before, t); len(lost) > 0 {
+		q := url.Values{}
+		for _, f := range lost {
+			q.Add("feature", string(f))
+		}
+		http.Redirect(w, r, "/auth/google/upgrade?"+q.Encode(), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusFound)
 }
@@ -0,0 +1,127 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("UNKNOWN_ENCRYPTION_KEY")
+
+// TokenCipher does envelope encryption of the google tokens: every row gets a random data key the tokens are encrypted with (AES-GCM),
+// and the data key is stored wrapped (encrypted) with one of the configured keys. Rows keep the id of the key that wrapped their data key,
+// so keys can be rotated adding a new one, making it the active one and re-encrypting the rows.
+type TokenCipher struct {
+	keys     map[string][]byte
+	activeId string
+}
+
+// ParseTokenKeys reads keys in the "id:base64key,id2:base64key" format, keys must be 16, 24 or 32 bytes long.
+// New rows are encrypted with activeId, the first key is the active one if activeId is empty.
+func ParseTokenKeys(keys, activeId string) (*TokenCipher, error) {
+	c := &TokenCipher{keys: make(map[string][]byte)}
+	for _, entry := range strings.Split(keys, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key %q must be in the id:base64key format", entry)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %v is not valid base64: %w", id, err)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("key %v: %w", id, err)
+		}
+		c.keys[id] = key
+		if c.activeId == "" {
+			c.activeId = id
+		}
+	}
+	if len(c.keys) == 0 {
+		return nil, errors.New("no encryption keys configured")
+	}
+	if activeId != "" {
+		if _, ok := c.keys[activeId]; !ok {
+			return nil, fmt.Errorf("active key %v is not among the configured keys", activeId)
+		}
+		c.activeId = activeId
+	}
+	return c, nil
+}
+
+// ActiveKeyId is the id of the key new rows are encrypted with
+func (c *TokenCipher) ActiveKeyId() string {
+	return c.activeId
+}
+
+// Seal encrypts plaintext with a new data key and wraps it with the active key
+func (c *TokenCipher) Seal(plaintext []byte) (sealed, wrappedKey, keyId string, err error) {
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return "", "", "", err
+	}
+	sealed, err = gcmSeal(dataKey, plaintext, nil)
+	if err != nil {
+		return "", "", "", err
+	}
+	// the key id is authenticated along the data key, a wrapped key can't be passed off as wrapped by another key
+	wrappedKey, err = gcmSeal(c.keys[c.activeId], dataKey, []byte(c.activeId))
+	return sealed, wrappedKey, c.activeId, err
+}
+
+// Open unwraps the data key with the key keyId identifies and decrypts sealed with it
+func (c *TokenCipher) Open(sealed, wrappedKey, keyId string) ([]byte, error) {
+	key, ok := c.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownKey, keyId)
+	}
+	dataKey, err := gcmOpen(key, wrappedKey, []byte(keyId))
+	if err != nil {
+		return nil, fmt.Errorf("unwrapping data key: %w", err)
+	}
+	return gcmOpen(dataKey, sealed, nil)
+}
+
+// gcmSeal returns base64(nonce + ciphertext)
+func gcmSeal(key, plaintext, additionalData []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+func gcmOpen(key []byte, sealed string, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -2,30 +2,45 @@ package auth
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"time"
 
-	"github.com/dchest/uniuri"
 	"github.com/jmoiron/sqlx"
 	"golang.org/x/oauth2"
 )
 
 type UserToken struct {
-	Id            int64      `db:"id"`
-	AccessToken   string     `db:"access_token"`
-	RefreshToken  string     `db:"refresh_token"`
-	MeetingsToken string     `db:"meetings_token"`
-	Email         string     `db:"email"`
-	FirstName     string     `db:"first_name"`
-	LastName      string     `db:"last_name"`
-	ExpiresAt     *time.Time `db:"expires_at"`
-	CreatedAt     *time.Time `db:"created_at"`
-	UpdatedAt     *time.Time `db:"updated_at"`
+	Id           int64      `db:"id"`
+	AccessToken  string     `db:"access_token"`
+	RefreshToken string     `db:"refresh_token"`
+	Email        string     `db:"email"`
+	FirstName    string     `db:"first_name"`
+	LastName     string     `db:"last_name"`
+	ExpiresAt    *time.Time `db:"expires_at"`
+	CreatedAt    *time.Time `db:"created_at"`
+	UpdatedAt    *time.Time `db:"updated_at"`
+	// NeedsReconsent is set when google rejects our refresh token, the user has to sign in again
+	NeedsReconsent bool `db:"needs_reconsent"`
+	// ShareFreeBusy is true if the user opted in to share its free/busy information with other users of the server
+	ShareFreeBusy bool `db:"share_freebusy"`
+	// APIToken is the token the user authenticated with, nil if it wasn't authenticated with one
+	APIToken *APIToken `db:"-"`
+	// EncryptedTokens holds the access and refresh tokens encrypted with a data key, WrappedKey is that data key encrypted with
+	// the key KeyId identifies. Rows from before encryption have an empty KeyId and their tokens in AccessToken and RefreshToken.
+	EncryptedTokens string `db:"encrypted_tokens"`
+	WrappedKey      string `db:"wrapped_key"`
+	KeyId           string `db:"key_id"`
+	// GrantedScopes are the google scopes the user granted us separated by spaces, empty if we don't know them (see GoogleScopes)
+	GrantedScopes string `db:"granted_scopes"`
 }
 
-func (t *UserToken) GenerateAuthToken() {
-	t.MeetingsToken = uniuri.NewLen(64)
+// sealedTokens is what gets encrypted in EncryptedTokens
+type sealedTokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
 }
 
 // GetOauthToken description
@@ -33,46 +48,271 @@ func (t *UserToken) GetOauthToken() *oauth2.Token {
 	return &oauth2.Token{AccessToken: t.AccessToken, RefreshToken: t.RefreshToken, Expiry: *t.ExpiresAt}
 }
 
+// Store keeps users, their api tokens and device codes. TokenStore implements it on postgres and sqlite, the storage package
+// checks implementations behave the same.
+type Store interface {
+	SelectById(id int64) (*UserToken, error)
+	SelectByEmail(email string) ([]*UserToken, error)
+	UpsertToken(t *UserToken) (*UserToken, error)
+	SelectSharingFreeBusy(emails []string) ([]*UserToken, error)
+	SetShareFreeBusy(id int64, share bool) error
+	UpdateOauthToken(id int64, t *oauth2.Token) error
+	UpdateGrant(id int64, t *oauth2.Token, scopes string) error
+	Reencrypt() (int, error)
+	DeleteUser(id int64) error
+	MarkNeedsReconsent(id int64) error
+
+	SelectAPITokensByPrefix(prefix string) ([]*APIToken, error)
+	HashAPIToken(id int64, prefix, hash string) error
+	SelectAPITokensByUser(userId int64) ([]*APIToken, error)
+	InsertAPIToken(t *APIToken) (*APIToken, error)
+	RevokeAPIToken(userId, id int64) error
+	TouchAPIToken(t *APIToken) error
+	// InsertAPITokenIP records the token was used from ip, it returns false if it already was
+	InsertAPITokenIP(tokenId int64, ip string, at time.Time) (bool, error)
+
+	InsertDeviceCode(d *DeviceCode) error
+	SelectDeviceCodeByUserCode(userCode string) (*DeviceCode, error)
+	SelectDeviceCodeByHash(hash string) (*DeviceCode, error)
+	ApproveDeviceCode(id, userId int64) error
+	TouchDeviceCode(id int64, t time.Time) error
+	ConsumeDeviceCode(id int64) (bool, error)
+	DeleteExpiredDeviceCodes() error
+}
+
+// TokenStore is the sql Store, its queries run on both postgres and sqlite
 type TokenStore struct {
-	db *sqlx.DB
+	db     *sqlx.DB
+	cipher *TokenCipher
 }
 
-func NewTokenStore(db *sqlx.DB) *TokenStore {
-	return &TokenStore{db}
+func NewTokenStore(db *sqlx.DB, cipher *TokenCipher) *TokenStore {
+	return &TokenStore{db: db, cipher: cipher}
 }
 
 var ErrUserNotFound = errors.New("USER_NOT_FOUND")
 
-func (s *TokenStore) SelectToken(authToken string) (*UserToken, error) {
+const userTokenColumns = "id, access_token, refresh_token, email, first_name, last_name, expires_at, created_at, updated_at, share_freebusy, needs_reconsent, " +
+	"COALESCE(encrypted_tokens, '') AS encrypted_tokens, COALESCE(wrapped_key, '') AS wrapped_key, COALESCE(key_id, '') AS key_id, COALESCE(granted_scopes, '') AS granted_scopes"
+
+// open decrypts the google tokens of t into AccessToken and RefreshToken
+func (s *TokenStore) open(t *UserToken) error {
+	if t.KeyId == "" {
+		// not encrypted yet, databases without migration 0001 pad the CHAR columns with spaces
+		t.AccessToken = strings.TrimRight(t.AccessToken, " ")
+		t.RefreshToken = strings.TrimRight(t.RefreshToken, " ")
+		return nil
+	}
+	plaintext, err := s.cipher.Open(t.EncryptedTokens, t.WrappedKey, t.KeyId)
+	if err != nil {
+		return fmt.Errorf("decrypting tokens of user %v: %w", t.Id, err)
+	}
+	sealed := sealedTokens{}
+	if err := json.Unmarshal(plaintext, &sealed); err != nil {
+		return fmt.Errorf("decrypting tokens of user %v: %w", t.Id, err)
+	}
+	t.AccessToken, t.RefreshToken = sealed.AccessToken, sealed.RefreshToken
+	return nil
+}
+
+// seal encrypts AccessToken and RefreshToken of t with the active key
+func (s *TokenStore) seal(t *UserToken) error {
+	plaintext, err := json.Marshal(sealedTokens{AccessToken: t.AccessToken, RefreshToken: t.RefreshToken})
+	if err != nil {
+		return err
+	}
+	t.EncryptedTokens, t.WrappedKey, t.KeyId, err = s.cipher.Seal(plaintext)
+	return err
+}
+
+func (s *TokenStore) openAll(tokens []*UserToken) error {
+	for _, t := range tokens {
+		if err := s.open(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *TokenStore) SelectById(id int64) (*UserToken, error) {
 	user := UserToken{}
-	err := s.db.Get(&user, "SELECT id, access_token, refresh_token, email, meetings_token, first_name, last_name, expires_at, created_at, updated_at from user_tokens where meetings_token = $1", authToken)
+	err := s.db.Get(&user, "SELECT "+userTokenColumns+" from user_tokens where id = $1", id)
 	if errors.Is(err, sql.ErrNoRows) {
 		return &user, ErrUserNotFound
+	} else if err != nil {
+		return &user, err
 	}
-	return &user, err
+	return &user, s.open(&user)
 }
 
 func (s *TokenStore) SelectByEmail(email string) ([]*UserToken, error) {
 	email = strings.ToLower(strings.Trim(email, " "))
 	tokens := make([]*UserToken, 0)
-	err := s.db.Select(&tokens, "SELECT id, access_token, refresh_token, email, meetings_token, first_name, last_name, expires_at, created_at, updated_at from user_tokens where email = $1", email)
+	err := s.db.Select(&tokens, "SELECT "+userTokenColumns+" from user_tokens where email = $1", email)
 	if errors.Is(err, sql.ErrNoRows) {
 		return tokens, ErrUserNotFound
+	} else if err != nil {
+		// Todo wrap error
+		return tokens, err
 	}
-	// Todo wrap error
-	return tokens, err
+	return tokens, s.openAll(tokens)
 }
 
+// UpsertToken inserts the user or updates its google credentials if it already exists, api tokens are handled separately in api_tokens
 func (s *TokenStore) UpsertToken(t *UserToken) (*UserToken, error) {
 	now := time.Now()
-	if t.MeetingsToken == "" {
-		t.GenerateAuthToken()
-	}
 	if t.CreatedAt == nil {
 		t.CreatedAt = &now
 	}
 	t.UpdatedAt = &now
-	_, error := s.db.Exec("INSERT INTO user_tokens (access_token, refresh_token, email, meetings_token, first_name, last_name, expires_at, created_at, updated_at) values ($1,$2,$3,$4,$5,$6,$7,$8,$9) ON CONFLICT (email) DO UPDATE SET access_token = $1, expires_at = $7, updated_at = $9, meetings_token = $4 RETURNING *", t.AccessToken, t.RefreshToken, t.Email, t.MeetingsToken, t.FirstName, t.LastName, t.ExpiresAt, t.CreatedAt, t.UpdatedAt)
-	// todo wrap error
-	return t, error
+	if t.RefreshToken != "" {
+		if err := s.seal(t); err != nil {
+			return t, err
+		}
+		return t, s.upsertToken(t, nil)
+	}
+	// google only sends a refresh token the first time the user consents, keep the one we have. The row is only updated if its tokens
+	// are still the ones we read, so a sign in saving a new refresh token in the meantime isn't undone: we read it again and retry.
+	for attempt := 1; ; attempt++ {
+		existing, err := s.SelectByEmail(t.Email)
+		if err != nil {
+			return t, err
+		}
+		read := ""
+		if len(existing) > 0 {
+			t.RefreshToken, read = existing[0].RefreshToken, existing[0].EncryptedTokens
+		}
+		if err := s.seal(t); err != nil {
+			return t, err
+		}
+		err = s.upsertToken(t, &read)
+		if !errors.Is(err, sql.ErrNoRows) || attempt == 3 {
+			return t, err
+		}
+		t.RefreshToken = ""
+	}
+}
+
+// upsertToken writes the sealed tokens of t. If ifTokens isn't nil an existing row is only updated if its encrypted tokens are still
+// *ifTokens, otherwise it fails with sql.ErrNoRows.
+func (s *TokenStore) upsertToken(t *UserToken, ifTokens *string) error {
+	// granted_scopes is kept if we couldn't tell which scopes the new token has
+	query := "INSERT INTO user_tokens (access_token, refresh_token, encrypted_tokens, wrapped_key, key_id, email, first_name, last_name, expires_at, created_at, updated_at, granted_scopes) values ('','',$1,$2,$3,$4,$5,$6,$7,$8,$9,NULLIF($10, '')) ON CONFLICT (email) DO UPDATE SET access_token = '', refresh_token = '', encrypted_tokens = $1, wrapped_key = $2, key_id = $3, expires_at = $7, updated_at = $9, needs_reconsent = FALSE, granted_scopes = COALESCE(NULLIF($10, ''), user_tokens.granted_scopes)"
+	args := []interface{}{t.EncryptedTokens, t.WrappedKey, t.KeyId, t.Email, t.FirstName, t.LastName, t.ExpiresAt, t.CreatedAt, t.UpdatedAt, t.GrantedScopes}
+	if ifTokens != nil {
+		query += " WHERE COALESCE(user_tokens.encrypted_tokens, '') = $11"
+		args = append(args, *ifTokens)
+	}
+	return s.db.Get(&t.Id, query+" RETURNING id", args...)
+}
+
+// SelectSharingFreeBusy returns the users among emails that opted in to share their free/busy information
+func (s *TokenStore) SelectSharingFreeBusy(emails []string) ([]*UserToken, error) {
+	tokens := make([]*UserToken, 0)
+	if len(emails) == 0 {
+		return tokens, nil
+	}
+	normalized := make([]string, len(emails))
+	for i, e := range emails {
+		normalized[i] = strings.ToLower(strings.Trim(e, " "))
+	}
+	query, args, err := sqlx.In("SELECT "+userTokenColumns+" from user_tokens where share_freebusy and LOWER(email) IN (?)", normalized)
+	if err != nil {
+		return tokens, err
+	}
+	err = s.db.Select(&tokens, s.db.Rebind(query), args...)
+	if err != nil {
+		return tokens, err
+	}
+	return tokens, s.openAll(tokens)
+}
+
+func (s *TokenStore) SetShareFreeBusy(id int64, share bool) error {
+	_, err := s.db.Exec("UPDATE user_tokens SET share_freebusy = $1, updated_at = $2 WHERE id = $3", share, time.Now(), id)
+	return err
+}
+
+// UpdateOauthToken saves a refreshed google token, google only sends a new refresh token sometimes so we keep the old one otherwise.
+// The granted scopes are updated when google says which ones the token has. Like UpsertToken, the row is only updated if its tokens are
+// still the ones we read, a sign in saving a new refresh token in the meantime isn't undone.
+func (s *TokenStore) UpdateOauthToken(id int64, t *oauth2.Token) error {
+	scopes, _ := t.Extra("scope").(string)
+	for attempt := 1; ; attempt++ {
+		user, err := s.SelectById(id)
+		if err != nil {
+			return err
+		}
+		read := user.EncryptedTokens
+		user.AccessToken = t.AccessToken
+		if t.RefreshToken != "" {
+			user.RefreshToken = t.RefreshToken
+		}
+		if err := s.seal(user); err != nil {
+			return err
+		}
+		res, err := s.db.Exec("UPDATE user_tokens SET access_token = '', refresh_token = '', encrypted_tokens = $1, wrapped_key = $2, key_id = $3, expires_at = $4, updated_at = $5, granted_scopes = COALESCE(NULLIF($6, ''), granted_scopes) WHERE id = $7 AND COALESCE(encrypted_tokens, '') = $8", user.EncryptedTokens, user.WrappedKey, user.KeyId, t.Expiry, time.Now(), scopes, id, read)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n > 0 {
+			return err
+		}
+		if attempt == 3 {
+			return fmt.Errorf("the tokens of user %v kept changing while saving a refreshed one", id)
+		}
+	}
+}
+
+// UpdateGrant saves the google token of a user that just granted us more scopes
+func (s *TokenStore) UpdateGrant(id int64, t *oauth2.Token, scopes string) error {
+	if err := s.UpdateOauthToken(id, t); err != nil {
+		return err
+	}
+	_, err := s.db.Exec("UPDATE user_tokens SET granted_scopes = $1, needs_reconsent = FALSE WHERE id = $2", scopes, id)
+	return err
+}
+
+// Reencrypt encrypts with the active key the tokens of every user that isn't encrypted with it yet (including the ones never encrypted),
+// it returns how many users were re-encrypted, users updated or deleted in the meantime aren't counted. Every key rows are currently encrypted with has to be configured.
+func (s *TokenStore) Reencrypt() (int, error) {
+	ids := make([]int64, 0)
+	err := s.db.Select(&ids, "SELECT id FROM user_tokens WHERE key_id IS NULL OR key_id <> $1", s.cipher.ActiveKeyId())
+	if err != nil {
+		return 0, err
+	}
+	reencrypted := 0
+	for _, id := range ids {
+		user, err := s.SelectById(id)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return reencrypted, err
+		}
+		previousKeyId := user.KeyId
+		if err := s.seal(user); err != nil {
+			return reencrypted, err
+		}
+		// key_id is checked again in case the row was updated in the meantime, it'd be encrypted with the active key already
+		res, err := s.db.Exec("UPDATE user_tokens SET access_token = '', refresh_token = '', encrypted_tokens = $1, wrapped_key = $2, key_id = $3 WHERE id = $4 AND key_id IS NOT DISTINCT FROM NULLIF($5, '')", user.EncryptedTokens, user.WrappedKey, user.KeyId, id, previousKeyId)
+		if err != nil {
+			return reencrypted, err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return reencrypted, err
+		} else if n > 0 {
+			reencrypted++
+		}
+	}
+	return reencrypted, nil
+}
+
+// DeleteUser removes the user, its api tokens, feeds and device codes go with it (ON DELETE CASCADE)
+func (s *TokenStore) DeleteUser(id int64) error {
+	_, err := s.db.Exec("DELETE FROM user_tokens WHERE id = $1", id)
+	return err
+}
+
+func (s *TokenStore) MarkNeedsReconsent(id int64) error {
+	_, err := s.db.Exec("UPDATE user_tokens SET needs_reconsent = TRUE, updated_at = $1 WHERE id = $2", time.Now(), id)
+	return err
 }
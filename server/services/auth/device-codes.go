@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// errors returned while polling a device login, they map to the error codes of RFC 8628
+var (
+	ErrAuthorizationPending = errors.New("authorization_pending")
+	ErrSlowDown             = errors.New("slow_down")
+	ErrDeviceCodeExpired    = errors.New("expired_token")
+	ErrDeviceCodeNotFound   = errors.New("DEVICE_CODE_NOT_FOUND")
+	// ErrDeviceCodeApproved is returned when someone approves a code that was already approved
+	ErrDeviceCodeApproved = errors.New("DEVICE_CODE_APPROVED")
+)
+
+const (
+	// DeviceCodeTTL is how long users have to finish signing in
+	DeviceCodeTTL = 10 * time.Minute
+	// DevicePollInterval is how often devices can poll for their token
+	DevicePollInterval = 5 * time.Second
+)
+
+// userCodeAlphabet has no vowels (no words) and no easily confused characters
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceCode is a pending sign in of a device that can't open a browser (eg: a pi without a screen). The device shows UserCode to the user,
+// who enters it in a browser and signs in with google, meanwhile the device polls with its device code until it gets its api token.
+// Only a hash of the device code is stored.
+type DeviceCode struct {
+	Id       int64  `db:"id"`
+	CodeHash string `db:"device_code_hash"`
+	UserCode string `db:"user_code"`
+	// Device is the name the device gave itself, the api token is labeled with it
+	Device string `db:"device"`
+	// UserId is set once the user signs in
+	UserId       sql.NullInt64 `db:"user_id"`
+	CreatedAt    time.Time     `db:"created_at"`
+	ExpiresAt    time.Time     `db:"expires_at"`
+	LastPolledAt *time.Time    `db:"last_polled_at"`
+	ConsumedAt   *time.Time    `db:"consumed_at"`
+}
+
+func (d *DeviceCode) IsExpired() bool {
+	return d.ExpiresAt.Before(time.Now())
+}
+
+// generateUserCode returns a code like BDFG-HJKL
+func generateUserCode() (string, error) {
+	code := make([]byte, 0, 9)
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(userCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code = append(code, userCodeAlphabet[n.Int64()])
+	}
+	return string(code), nil
+}
+
+// NormalizeUserCode accepts codes typed in lower case, with spaces or without the dash
+func NormalizeUserCode(code string) string {
+	letters := make([]rune, 0, 8)
+	for _, r := range strings.ToUpper(code) {
+		if r >= 'A' && r <= 'Z' {
+			letters = append(letters, r)
+		}
+	}
+	if len(letters) != 8 {
+		return string(letters)
+	}
+	return string(letters[:4]) + "-" + string(letters[4:])
+}
+
+const deviceCodeColumns = "id, device_code_hash, user_code, device, user_id, created_at, expires_at, last_polled_at, consumed_at"
+
+func (s *TokenStore) InsertDeviceCode(d *DeviceCode) error {
+	return s.db.Get(&d.Id, "INSERT INTO device_codes (device_code_hash, user_code, device, created_at, expires_at) VALUES ($1,$2,$3,$4,$5) RETURNING id", d.CodeHash, d.UserCode, d.Device, d.CreatedAt, d.ExpiresAt)
+}
+
+func (s *TokenStore) selectDeviceCode(where string, arg interface{}) (*DeviceCode, error) {
+	d := DeviceCode{}
+	err := s.db.Get(&d, "SELECT "+deviceCodeColumns+" FROM device_codes WHERE "+where, arg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDeviceCodeNotFound
+	}
+	return &d, err
+}
+
+// SelectDeviceCodeByUserCode only returns codes that haven't been used yet
+func (s *TokenStore) SelectDeviceCodeByUserCode(userCode string) (*DeviceCode, error) {
+	// codes are short, an old expired one could have the same
+	return s.selectDeviceCode("user_code = $1 AND consumed_at IS NULL ORDER BY id DESC LIMIT 1", userCode)
+}
+
+func (s *TokenStore) SelectDeviceCodeByHash(hash string) (*DeviceCode, error) {
+	return s.selectDeviceCode("device_code_hash = $1", hash)
+}
+
+// ApproveDeviceCode links the code to the user, it returns ErrDeviceCodeApproved if it already was linked to someone
+func (s *TokenStore) ApproveDeviceCode(id, userId int64) error {
+	res, err := s.db.Exec("UPDATE device_codes SET user_id = $1 WHERE id = $2 AND user_id IS NULL", userId, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrDeviceCodeApproved
+	}
+	return nil
+}
+
+func (s *TokenStore) TouchDeviceCode(id int64, t time.Time) error {
+	_, err := s.db.Exec("UPDATE device_codes SET last_polled_at = $1 WHERE id = $2", t, id)
+	return err
+}
+
+// ConsumeDeviceCode marks the code as used, it returns false if it already was so a token is only issued once
+func (s *TokenStore) ConsumeDeviceCode(id int64) (bool, error) {
+	res, err := s.db.Exec("UPDATE device_codes SET consumed_at = $1 WHERE id = $2 AND consumed_at IS NULL", time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// DeleteExpiredDeviceCodes removes the codes that expired more than a day ago
+func (s *TokenStore) DeleteExpiredDeviceCodes() error {
+	_, err := s.db.Exec("DELETE FROM device_codes WHERE expires_at < $1", time.Now().Add(-24*time.Hour))
+	return err
+}
+
+// StartDeviceLogin creates a pending sign in for a device, it returns the device code the device polls with (only known now) and the user code to show the user
+func (s *Service) StartDeviceLogin(device string) (*DeviceCode, string, error) {
+	if err := s.store.DeleteExpiredDeviceCodes(); err != nil {
+		s.logger.Errorw("could not delete expired device codes: " + err.Error())
+	}
+	userCode, err := generateUserCode()
+	if err != nil {
+		return nil, "", err
+	}
+	deviceCode := uniuri.NewLen(64)
+	now := time.Now()
+	d := &DeviceCode{
+		CodeHash:  s.hasher.Hash(deviceCode),
+		UserCode:  userCode,
+		Device:    device,
+		CreatedAt: now,
+		ExpiresAt: now.Add(DeviceCodeTTL),
+	}
+	if err := s.store.InsertDeviceCode(d); err != nil {
+		return nil, "", err
+	}
+	return d, deviceCode, nil
+}
+
+// PendingDeviceLogin returns the device login waiting for the user to sign in with userCode
+func (s *Service) PendingDeviceLogin(userCode string) (*DeviceCode, error) {
+	d, err := s.store.SelectDeviceCodeByUserCode(NormalizeUserCode(userCode))
+	if err != nil {
+		return nil, err
+	}
+	if d.IsExpired() {
+		return nil, ErrDeviceCodeExpired
+	}
+	return d, nil
+}
+
+// ApproveDeviceLogin gives the device waiting with userCode access to the account of t, next time it polls it gets an api token
+func (s *Service) ApproveDeviceLogin(userCode string, t *UserToken) (*DeviceCode, error) {
+	d, err := s.PendingDeviceLogin(userCode)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.ApproveDeviceCode(d.Id, t.Id); err != nil {
+		return nil, err
+	}
+	s.logger.Infow("device login approved", "email", t.Email, "device", d.Device)
+	return d, nil
+}
+
+// PollDeviceLogin issues an api token for the device once the user signed in, until then it returns ErrAuthorizationPending
+// (or ErrSlowDown if the device polls more often than DevicePollInterval).
+func (s *Service) PollDeviceLogin(deviceCode string) (*UserToken, *APIToken, error) {
+	d, err := s.store.SelectDeviceCodeByHash(s.hasher.Hash(deviceCode))
+	if err != nil {
+		return nil, nil, err
+	}
+	if d.ConsumedAt != nil {
+		return nil, nil, ErrDeviceCodeNotFound
+	}
+	if d.IsExpired() {
+		return nil, nil, ErrDeviceCodeExpired
+	}
+	now := time.Now()
+	// only accepted polls count, a device polling a bit too fast gets slow_down once and not forever
+	if d.LastPolledAt != nil && now.Sub(*d.LastPolledAt) < DevicePollInterval {
+		return nil, nil, ErrSlowDown
+	}
+	if err := s.store.TouchDeviceCode(d.Id, now); err != nil {
+		return nil, nil, err
+	}
+	if !d.UserId.Valid {
+		return nil, nil, ErrAuthorizationPending
+	}
+	consumed, err := s.store.ConsumeDeviceCode(d.Id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !consumed {
+		return nil, nil, ErrDeviceCodeNotFound
+	}
+	user, err := s.store.SelectById(d.UserId.Int64)
+	if err != nil {
+		return nil, nil, err
+	}
+	label := "Device login on " + now.Format("2006-01-02 15:04")
+	if d.Device != "" {
+		label = d.Device
+	}
+	apiToken, err := s.CreateAPIToken(user, label, nil, nil)
+	return user, apiToken, err
+}
@@ -0,0 +1,218 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dchest/uniuri"
+	"github.com/gabzim/meetings/server/services/audit"
+)
+
+// deviceStatePrefix marks the oauth state of sign ins started from the device verification page, the state is device.<user code>.<nonce>
+const deviceStatePrefix = "device."
+
+// maxDeviceNameLength matches the device column of device_codes, in characters
+const maxDeviceNameLength = 100
+
+// truncate cuts s to its first n characters, never in the middle of one
+func truncate(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+type deviceCodeResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+type deviceErrorResponse struct {
+	Error string `json:"error"`
+}
+
+var devicePage = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Sign in a device - meetings</title></head>
+<body>
+{{if .Done}}
+<p>{{if .Device}}{{.Device}}{{else}}Your device{{end}} is now signed in as {{.Email}}, you can close this page.</p>
+{{else if .Confirm}}
+<form method="POST" action="/auth/device/approve">
+  <p>{{if .Device}}<b>{{.Device}}</b>{{else}}A device{{end}} wants to access the calendars of {{.Email}} with the code <b>{{.Code}}</b>.</p>
+  <p>Only allow it if you started signing in on that device yourself and it shows this same code.</p>
+  <input type="hidden" name="code" value="{{.Code}}">
+  <input type="hidden" name="{{.CSRFField}}" value="{{.CSRF}}">
+  <button type="submit">Allow</button>
+  <a href="/account">Cancel</a>
+</form>
+{{else}}
+<form method="GET" action="/auth/device">
+  <p>Enter the code your device shows:</p>
+  <input name="code" value="{{.Code}}" autocomplete="off" autofocus>
+  <button type="submit">Continue with Google</button>
+  {{if .Error}}<p>{{.Error}}</p>{{end}}
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type devicePageData struct {
+	Code   string
+	Error  string
+	Done   bool
+	Device string
+	Email  string
+	// Confirm asks the signed in user to allow the device
+	Confirm   bool
+	CSRF      string
+	CSRFField string
+}
+
+// DeviceCode handles POST /auth/device/code, devices without a browser call it to start signing in. They can send their name in the device param.
+func (c *GoogleAuthController) DeviceCode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	device := truncate(strings.TrimSpace(strings.ToValidUTF8(r.FormValue("device"), "")), maxDeviceNameLength)
+	d, deviceCode, err := c.authServ.StartDeviceLogin(device)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprint(w, err)
+		return
+	}
+	verificationURI := c.hostURL + "/auth/device"
+	WriteJSON(w, 200, deviceCodeResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                d.UserCode,
+		VerificationURI:         verificationURI,
+		VerificationURIComplete: verificationURI + "?code=" + url.QueryEscape(d.UserCode),
+		ExpiresIn:               int(DeviceCodeTTL.Seconds()),
+		Interval:                int(DevicePollInterval.Seconds()),
+	})
+}
+
+// DeviceToken handles POST /auth/device/token with the device_code param. Devices poll it until the user signs in and get their email and api token.
+func (c *GoogleAuthController) DeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	t, apiToken, err := c.authServ.PollDeviceLogin(r.FormValue("device_code"))
+	switch {
+	case err == nil:
+		// the device isn't the user, but it's the one getting the token
+		c.authServ.Audit(audit.RequestOrigin(r, audit.TokenActor(apiToken.Id)), t, audit.ActionTokenCreate, audit.OutcomeSuccess, fmt.Sprintf("token %v: %v", apiToken.Id, apiToken.Label))
+		WriteJSON(w, 200, deviceTokenResponse{Email: t.Email, Token: apiToken.Token})
+	case errors.Is(err, ErrAuthorizationPending), errors.Is(err, ErrSlowDown), errors.Is(err, ErrDeviceCodeExpired):
+		WriteJSON(w, 400, deviceErrorResponse{Error: err.Error()})
+	case errors.Is(err, ErrDeviceCodeNotFound):
+		WriteJSON(w, 400, deviceErrorResponse{Error: "invalid_grant"})
+	default:
+		w.WriteHeader(500)
+		fmt.Fprint(w, err)
+	}
+}
+
+// Device handles GET /auth/device, the page where users enter the code their device shows. Once they do they're sent to sign in with google,
+// and asked to allow the device when they're back.
+func (c *GoogleAuthController) Device(w http.ResponseWriter, r *http.Request) {
+	code := NormalizeUserCode(r.URL.Query().Get("code"))
+	if code == "" {
+		devicePage.Execute(w, devicePageData{})
+		return
+	}
+	_, err := c.authServ.PendingDeviceLogin(code)
+	if errors.Is(err, ErrDeviceCodeNotFound) || errors.Is(err, ErrDeviceCodeExpired) {
+		w.WriteHeader(404)
+		devicePage.Execute(w, devicePageData{Code: code, Error: "That code is not valid or has expired, start signing in on your device again."})
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprint(w, err)
+		return
+	}
+	// gothic uses the state param if there's one, the callback gets it back and knows it has to approve the device
+	state := deviceStatePrefix + code + "." + uniuri.NewLen(32)
+	http.Redirect(w, r, "/auth/google?state="+url.QueryEscape(state), http.StatusFound)
+}
+
+// confirmDevice finishes a sign in started from the device page by asking the user to allow the device, state is the one built by Device.
+// The device is only approved once the user confirms: a link with the code could be sent by whoever is holding the device.
+func (c *GoogleAuthController) confirmDevice(w http.ResponseWriter, r *http.Request, t *UserToken, state string) {
+	code := strings.Split(strings.TrimPrefix(state, deviceStatePrefix), ".")[0]
+	d, err := c.authServ.PendingDeviceLogin(code)
+	if errors.Is(err, ErrDeviceCodeNotFound) || errors.Is(err, ErrDeviceCodeExpired) {
+		c.authServ.Audit(Origin(r, t), t, audit.ActionDeviceLogin, audit.OutcomeFailure, "code not valid or expired")
+		w.WriteHeader(404)
+		devicePage.Execute(w, devicePageData{Error: "That code is not valid or has expired, start signing in on your device again."})
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprint(w, err)
+		return
+	}
+	// the confirmation is posted with the session, so it can't be forged from another site
+	csrf, err := startSession(w, r, t)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprint(w, err)
+		return
+	}
+	devicePage.Execute(w, devicePageData{Confirm: true, Code: d.UserCode, Device: d.Device, Email: t.Email, CSRF: csrf, CSRFField: CSRFField})
+}
+
+// ApproveDevice handles POST /auth/device/approve, the user allows the device they confirmed after signing in
+func (c *GoogleAuthController) ApproveDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	t, err := c.authServ.AuthenticateSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/auth/device", http.StatusFound)
+		return
+	}
+	if !CheckCSRF(r) {
+		c.authServ.Audit(Origin(r, t), t, audit.ActionDeviceLogin, audit.OutcomeDenied, "invalid csrf token")
+		w.WriteHeader(403)
+		fmt.Fprint(w, "Invalid form, go back and try again")
+		return
+	}
+	d, err := c.authServ.ApproveDeviceLogin(r.PostFormValue("code"), t)
+	if errors.Is(err, ErrDeviceCodeNotFound) || errors.Is(err, ErrDeviceCodeExpired) {
+		c.authServ.Audit(Origin(r, t), t, audit.ActionDeviceLogin, audit.OutcomeFailure, "code not valid or expired")
+		w.WriteHeader(404)
+		devicePage.Execute(w, devicePageData{Error: "That code is not valid or has expired, start signing in on your device again."})
+		return
+	} else if errors.Is(err, ErrDeviceCodeApproved) {
+		c.authServ.Audit(Origin(r, t), t, audit.ActionDeviceLogin, audit.OutcomeFailure, "code already approved")
+		w.WriteHeader(409)
+		devicePage.Execute(w, devicePageData{Error: "That code was already used to sign in a device, start signing in on your device again."})
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprint(w, err)
+		return
+	}
+	c.authServ.Audit(Origin(r, t), t, audit.ActionDeviceLogin, audit.OutcomeSuccess, d.Device)
+	devicePage.Execute(w, devicePageData{Done: true, Device: d.Device, Email: t.Email})
+}
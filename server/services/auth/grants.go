@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/plus/v1"
+)
+
+// ErrInsufficientScope means the user hasn't granted the google scope a feature needs, see ScopeError
+var ErrInsufficientScope = errors.New("INSUFFICIENT_GOOGLE_SCOPE")
+
+// Feature is something users turn on that needs more access to their calendar than signing in grants
+type Feature string
+
+const (
+	// FeatureMirror copies events into calendars of the user
+	FeatureMirror Feature = "mirror"
+)
+
+// featureScopes are the google scopes each feature needs
+var featureScopes = map[Feature]string{
+	FeatureMirror: calendar.CalendarEventsScope,
+}
+
+// signInScopes are the scopes every user grants when signing in
+var signInScopes = []string{calendar.CalendarReadonlyScope, plus.UserinfoEmailScope, plus.UserinfoProfileScope}
+
+// broaderScopes lists the scopes that grant everything another one does
+var broaderScopes = map[string][]string{
+	calendar.CalendarReadonlyScope: {calendar.CalendarScope},
+	calendar.CalendarEventsScope:   {calendar.CalendarScope},
+}
+
+// ScopeError is returned when a feature is used by a user that hasn't granted the scope it needs, the user has to grant it at UpgradePath.
+// It's an ErrInsufficientScope.
+type ScopeError struct {
+	Feature Feature
+	Scope   string
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("%v needs access to %v, grant it at %v", e.Feature, e.Scope, e.UpgradePath())
+}
+
+func (e *ScopeError) Unwrap() error {
+	return ErrInsufficientScope
+}
+
+// UpgradePath is where the user grants the scope the feature needs
+func (e *ScopeError) UpgradePath() string {
+	return UpgradePath(e.Feature)
+}
+
+// UpgradePath is where users grant the scope a feature needs
+func UpgradePath(f Feature) string {
+	return "/auth/google/upgrade?feature=" + url.QueryEscape(string(f))
+}
+
+// Features returns every feature that needs more than the sign in scopes, sorted by name
+func Features() []Feature {
+	features := make([]Feature, 0, len(featureScopes))
+	for f := range featureScopes {
+		features = append(features, f)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
+	return features
+}
+
+// ParseFeature returns the feature with the given name
+func ParseFeature(name string) (Feature, error) {
+	f := Feature(name)
+	if _, ok := featureScopes[f]; !ok {
+		return "", fmt.Errorf("unknown feature %q", name)
+	}
+	return f, nil
+}
+
+// GoogleScopes returns the google scopes the user granted us, users from before they were tracked granted the sign in scopes
+func (t *UserToken) GoogleScopes() []string {
+	if t.GrantedScopes == "" {
+		return signInScopes
+	}
+	return strings.Fields(t.GrantedScopes)
+}
+
+// HasGoogleScope tells whether the user granted scope, or one that includes it
+func (t *UserToken) HasGoogleScope(scope string) bool {
+	for _, granted := range t.GoogleScopes() {
+		if granted == scope {
+			return true
+		}
+		for _, broader := range broaderScopes[scope] {
+			if granted == broader {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CanUse tells whether the user granted what f needs
+func (t *UserToken) CanUse(f Feature) bool {
+	return t.RequireFeature(f) == nil
+}
+
+// RequireFeature returns a *ScopeError if the user hasn't granted what f needs
+func (t *UserToken) RequireFeature(f Feature) error {
+	scope, ok := featureScopes[f]
+	if !ok {
+		return fmt.Errorf("unknown feature %q", f)
+	}
+	if !t.HasGoogleScope(scope) {
+		return &ScopeError{Feature: f, Scope: scope}
+	}
+	return nil
+}
+
+// CheckScopeError turns the errors google returns for requests beyond the scopes of the token into a *ScopeError for f,
+// other errors are returned as they are. Our record of the granted scopes can be outdated (eg: the user removed the access in google).
+func CheckScopeError(err error, f Feature) error {
+	var gErr *googleapi.Error
+	if !errors.As(err, &gErr) || gErr.Code != http.StatusForbidden {
+		return err
+	}
+	insufficient := strings.Contains(gErr.Message, "insufficient authentication scopes")
+	for _, item := range gErr.Errors {
+		if item.Reason == "insufficientPermissions" {
+			insufficient = true
+		}
+	}
+	if !insufficient {
+		return err
+	}
+	return &ScopeError{Feature: f, Scope: featureScopes[f]}
+}
+
+// WriteScopeError answers with a 403 telling what to grant if err is a *ScopeError, it returns false (and writes nothing) otherwise
+func WriteScopeError(w http.ResponseWriter, err error) bool {
+	var scopeErr *ScopeError
+	if !errors.As(err, &scopeErr) {
+		return false
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(403)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      "insufficient_scope",
+		"message":    scopeErr.Error(),
+		"feature":    string(scopeErr.Feature),
+		"scope":      scopeErr.Scope,
+		"upgradeUrl": scopeErr.UpgradePath(),
+	})
+	return true
+}
+
+// googleTokenInfoURL tells the scopes and email of an access token
+const googleTokenInfoURL = "https://oauth2.googleapis.com/tokeninfo"
+
+type tokenInfo struct {
+	Scope string `json:"scope"`
+	Email string `json:"email"`
+}
+
+// fetchTokenInfo asks google which scopes and email an access token is for
+func fetchTokenInfo(ctx context.Context, accessToken string) (*tokenInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, googleTokenInfoURL+"?"+url.Values{"access_token": {accessToken}}.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching token info: %v", res.Status)
+	}
+	info := &tokenInfo{}
+	return info, json.NewDecoder(res.Body).Decode(info)
+}
+
+// UpgradeURL returns the google consent url where the user grants what f needs, the scopes granted before are kept
+// (include_granted_scopes). state is sent back to redirectURL.
+func (s *Service) UpgradeURL(t *UserToken, f Feature, redirectURL, state string) (string, error) {
+	scope, ok := featureScopes[f]
+	if !ok {
+		return "", fmt.Errorf("unknown feature %q", f)
+	}
+	cfg := s.upgradeConfig(redirectURL, scope)
+	return cfg.AuthCodeURL(state, oauth2.AccessTypeOffline, oauth2.SetAuthURLParam("include_granted_scopes", "true"),
+		oauth2.SetAuthURLParam("login_hint", t.Email), oauth2.SetAuthURLParam("prompt", "consent")), nil
+}
+
+// CompleteUpgrade exchanges the code google sent back after the user granted more scopes and saves the new grant.
+// It fails if the user signed in to google with another account.
+func (s *Service) CompleteUpgrade(ctx context.Context, t *UserToken, redirectURL, code string) error {
+	cfg := s.upgradeConfig(redirectURL)
+	token, err := cfg.Exchange(ctx, code)
+	if err != nil {
+		return err
+	}
+	info, err := fetchTokenInfo(ctx, token.AccessToken)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(info.Email, t.Email) {
+		return fmt.Errorf("%w: google account %v is not %v", ErrTokenInvalid, info.Email, t.Email)
+	}
+	if err := s.store.UpdateGrant(t.Id, token, info.Scope); err != nil {
+		return err
+	}
+	t.GrantedScopes = info.Scope
+	s.logger.Infow("google scopes granted", "email", t.Email, "scopes", info.Scope)
+	return nil
+}
+
+func (s *Service) upgradeConfig(redirectURL string, scopes ...string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     s.cfg.ClientID,
+		ClientSecret: s.cfg.ClientSecret,
+		Endpoint:     s.cfg.Endpoint,
+		RedirectURL:  redirectURL,
+		Scopes:       scopes,
+	}
+}
@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// tokenPrefixLength is how many characters of a token are stored in plain text to find it without scanning every hash
+const tokenPrefixLength = 8
+
+// TokenHasher hashes api tokens with a server side key, a leaked table of hashes is useless without the key
+type TokenHasher struct {
+	key []byte
+}
+
+func NewTokenHasher(key string) *TokenHasher {
+	return &TokenHasher{key: []byte(key)}
+}
+
+func (h *TokenHasher) Hash(token string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Matches compares the token against a hash in constant time
+func (h *TokenHasher) Matches(token, hash string) bool {
+	expected, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(token))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// equalPlain compares plain text tokens in constant time, for rows that haven't been hashed yet
+func equalPlain(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func tokenPrefix(token string) string {
+	if len(token) < tokenPrefixLength {
+		return token
+	}
+	return token[:tokenPrefixLength]
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// headers api clients can use instead of the email and token query params
+const (
+	EmailHeader = "X-Meetings-Email"
+	TokenHeader = "X-Meetings-Token"
+)
+
+// browsers can't set headers on websocket connections, they can send the token as a subprotocol instead:
+// new WebSocket(url, ["meetings", "meetings.token." + token]). The server answers with the "meetings" subprotocol.
+const (
+	Subprotocol            = "meetings"
+	TokenSubprotocolPrefix = "meetings.token."
+)
+
+// QueryTokenWarning is sent in the Warning header of responses to requests authenticated with the query string
+const QueryTokenWarning = `299 - "token and email query params are deprecated, use the Authorization header"`
+
+// AuthenticateRequest authenticates the user making an api request. The token is taken from, in order:
+// the Authorization: Bearer header, a meetings.token.<token> websocket subprotocol, the X-Meetings-Token header (X-Meetings-Email is optional
+// and checked if present) or the deprecated email and token query params, unless they were disabled.
+// The first time a token is used from an address it's recorded in the audit log, and so are rejected credentials.
+func (s *Service) AuthenticateRequest(r *http.Request) (*UserToken, error) {
+	t, err := s.authenticateRequest(r)
+	if err == nil {
+		s.checkTokenIP(r, t)
+	} else {
+		s.auditRejectedRequest(r, err)
+	}
+	return t, err
+}
+
+func (s *Service) authenticateRequest(r *http.Request) (*UserToken, error) {
+	if token, ok := bearerToken(r); ok {
+		return s.AuthenticateToken(token)
+	}
+	if token, ok := subprotocolToken(r); ok {
+		return s.AuthenticateToken(token)
+	}
+	if token := r.Header.Get(TokenHeader); token != "" {
+		return s.AuthenticateUser(r.Header.Get(EmailHeader), token)
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		if s.queryTokenDisabled {
+			return nil, ErrQueryTokenDisabled
+		}
+		s.logger.Warnw("request authenticated with deprecated query string credentials", "path", r.URL.Path)
+		return s.AuthenticateUser(r.URL.Query().Get("email"), token)
+	}
+	return nil, ErrTokenInvalid
+}
+
+// Authenticate authenticates an api request for a controller, see AuthenticateRequest. If it's rejected it answers 401 and returns false,
+// whether the token is unknown or its user is gone, so the answer doesn't tell which.
+func (s *Service) Authenticate(w http.ResponseWriter, r *http.Request) (*UserToken, bool) {
+	WarnQueryToken(w, r)
+	user, err := s.AuthenticateRequest(r)
+	if errors.Is(err, ErrTokenInvalid) || errors.Is(err, ErrUserNotFound) {
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "Token provided is not valid")
+		return nil, false
+	} else if err != nil {
+		s.logger.Errorf("could not authenticate request: %v", err)
+		w.WriteHeader(500)
+		return nil, false
+	}
+	return user, true
+}
+
+// WriteJSON answers with v encoded as json
+func WriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// WarnQueryToken adds QueryTokenWarning to the response if the request carries its credentials in the deprecated query params
+func WarnQueryToken(w http.ResponseWriter, r *http.Request) {
+	_, bearer := bearerToken(r)
+	_, subprotocol := subprotocolToken(r)
+	if !bearer && !subprotocol && r.Header.Get(TokenHeader) == "" && r.URL.Query().Get("token") != "" {
+		w.Header().Add("Warning", QueryTokenWarning)
+	}
+}
+
+// hasCredentials tells whether the request carries a token anywhere AuthenticateRequest looks for one
+func hasCredentials(r *http.Request) bool {
+	_, bearer := bearerToken(r)
+	_, subprotocol := subprotocolToken(r)
+	return bearer || subprotocol || r.Header.Get(TokenHeader) != "" || r.URL.Query().Get("token") != ""
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+func subprotocolToken(r *http.Request) (string, bool) {
+	for _, header := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(header, ",") {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, TokenSubprotocolPrefix) && len(p) > len(TokenSubprotocolPrefix) {
+				return strings.TrimPrefix(p, TokenSubprotocolPrefix), true
+			}
+		}
+	}
+	return "", false
+}
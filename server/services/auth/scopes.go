@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gabzim/meetings/server/eventfields"
+)
+
+// capabilities a token can be given
+const (
+	// CapabilityREST is the read only rest api: events, calendars, free/busy
+	CapabilityREST = "rest"
+	// CapabilityWebhook is the streaming of events, over the /notifications websocket or grpc
+	CapabilityWebhook = "webhook"
+	// CapabilityAdmin is managing the account: tokens, feeds, settings, export and deletion
+	CapabilityAdmin = "admin"
+)
+
+var capabilities = []string{CapabilityREST, CapabilityWebhook, CapabilityAdmin}
+
+var (
+	ErrCalendarNotAllowed = errors.New("CALENDAR_NOT_ALLOWED_FOR_TOKEN")
+	ErrFieldNotAllowed    = errors.New("FIELD_NOT_ALLOWED_FOR_TOKEN")
+)
+
+// Scopes restrict what a token can do, tokens without scopes (nil) can do everything. Empty lists don't restrict either,
+// eg: a token with only Calendars set can use every capability on those calendars.
+type Scopes struct {
+	// Calendars the token can read, "primary" and the email of the user are the same calendar
+	Calendars []string `json:"calendars,omitempty"`
+	// Fields of the events the token gets, see eventfields. Id and status are always sent.
+	Fields []string `json:"fields,omitempty"`
+	// Capabilities the token can use: rest, webhook and admin
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+func (s *Scopes) Validate() error {
+	if s == nil {
+		return nil
+	}
+	for _, c := range s.Capabilities {
+		if !contains(capabilities, c) {
+			return fmt.Errorf("unknown capability %q, valid ones are %v", c, capabilities)
+		}
+	}
+	for _, c := range s.Calendars {
+		if strings.TrimSpace(c) == "" {
+			return errors.New("calendars can't be empty")
+		}
+	}
+	return eventfields.Validate(s.Fields)
+}
+
+// Can tells whether the scopes grant the capability
+func (s *Scopes) Can(capability string) bool {
+	return s == nil || len(s.Capabilities) == 0 || contains(s.Capabilities, capability)
+}
+
+// AllowsCalendar tells whether the scopes let the user (with email) read the calendar
+func (s *Scopes) AllowsCalendar(calendarName, email string) bool {
+	if s == nil || len(s.Calendars) == 0 {
+		return true
+	}
+	for _, c := range s.Calendars {
+		if c == calendarName || (isPrimary(c, email) && isPrimary(calendarName, email)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrimary(calendarName, email string) bool {
+	return calendarName == "primary" || strings.EqualFold(calendarName, email)
+}
+
+// Within tells whether s grants nothing parent doesn't, tokens can only mint tokens within their own scopes
+func (s *Scopes) Within(parent *Scopes, email string) bool {
+	if parent == nil {
+		return true
+	}
+	if s == nil {
+		s = &Scopes{}
+	}
+	if len(parent.Capabilities) > 0 && (len(s.Capabilities) == 0 || !allAllowed(parent.Capabilities, s.Capabilities)) {
+		return false
+	}
+	if len(parent.Fields) > 0 && (len(s.Fields) == 0 || !allAllowed(parent.Fields, s.Fields)) {
+		return false
+	}
+	if len(parent.Calendars) > 0 {
+		if len(s.Calendars) == 0 {
+			return false
+		}
+		for _, c := range s.Calendars {
+			if !parent.AllowsCalendar(c, email) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// String describes the scopes for humans
+func (s *Scopes) String() string {
+	if s == nil {
+		return "full access"
+	}
+	parts := make([]string, 0, 3)
+	if len(s.Calendars) > 0 {
+		parts = append(parts, "calendars: "+strings.Join(s.Calendars, ", "))
+	}
+	if len(s.Fields) > 0 {
+		parts = append(parts, "fields: "+strings.Join(s.Fields, ", "))
+	}
+	if len(s.Capabilities) > 0 {
+		parts = append(parts, "apis: "+strings.Join(s.Capabilities, ", "))
+	}
+	if len(parts) == 0 {
+		return "full access"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Value stores scopes as json, nil scopes are stored as NULL
+func (s Scopes) Value() (driver.Value, error) {
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+func (s *Scopes) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		return json.Unmarshal([]byte(v), s)
+	case []byte:
+		return json.Unmarshal(v, s)
+	}
+	return fmt.Errorf("can't scan %T into scopes", src)
+}
+
+// Scopes returns the scopes of the token the user authenticated with, nil if it has none or it signed in with google (the account pages)
+func (t *UserToken) Scopes() *Scopes {
+	if t.APIToken == nil {
+		return nil
+	}
+	return t.APIToken.Scopes
+}
+
+// Can tells whether the user can use the capability with the token it authenticated with
+func (t *UserToken) Can(capability string) bool {
+	return t.Scopes().Can(capability)
+}
+
+// AllowsCalendar tells whether the user can read the calendar with the token it authenticated with
+func (t *UserToken) AllowsCalendar(calendarName string) bool {
+	return t.Scopes().AllowsCalendar(calendarName, t.Email)
+}
+
+// AllowsFields tells whether the user can see every one of the event fields with the token it authenticated with
+func (t *UserToken) AllowsFields(fields []string) bool {
+	allowed := t.EventFields()
+	return len(allowed) == 0 || allAllowed(allowed, fields)
+}
+
+// EventFields are the event fields the user gets with the token it authenticated with, nil for all of them
+func (t *UserToken) EventFields() []string {
+	if s := t.Scopes(); s != nil {
+		return s.Fields
+	}
+	return nil
+}
+
+// RequireCapability answers 403 if the user can't use the capability, handlers return if it's false
+func RequireCapability(w http.ResponseWriter, t *UserToken, capability string) bool {
+	if t.Can(capability) {
+		return true
+	}
+	w.WriteHeader(403)
+	fmt.Fprintf(w, "This token can't use the %v api", capability)
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func allAllowed(allowed, requested []string) bool {
+	for _, r := range requested {
+		if !contains(allowed, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,26 +1,53 @@
 package auth
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/gabzim/meetings/server/services/audit"
 	"github.com/markbates/goth"
 	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrTokenInvalid = errors.New("TOKEN_INVALID_FOR_USER")
+	// ErrQueryTokenDisabled is returned for requests with credentials in the query string when that's turned off, it's an ErrTokenInvalid
+	ErrQueryTokenDisabled = fmt.Errorf("%w: credentials in the query string are disabled", ErrTokenInvalid)
+	ErrInvalidScopes      = errors.New("INVALID_SCOPES")
+	// ErrAccountDeleted is sent to the clients of a user when it deletes its account
+	ErrAccountDeleted = errors.New("ACCOUNT_DELETED")
 )
 
 type Service struct {
 	logger *zap.SugaredLogger
-	store  *TokenStore
+	store  Store
+	// cfg is used to refresh the google access tokens of the users
+	cfg    *oauth2.Config
+	hasher *TokenHasher
+	// queryTokenDisabled rejects requests with their credentials in the query string
+	queryTokenDisabled bool
+	listenersMu        sync.RWMutex
+	revokedListeners   []GrantRevokedListener
+	deletingListeners  []UserDeletingListener
+	// audit is where security relevant actions are recorded, nil if they aren't
+	audit *audit.Service
+	// tokenIPs are the "token:<id> <ip>" already recorded, so the store isn't hit on every request
+	tokenIPs sync.Map
+	// rejections limits how often rejected requests are recorded
+	rejections rejectionLimiter
 }
 
-func NewService(logger *zap.SugaredLogger, ts *TokenStore) *Service {
+func NewService(logger *zap.SugaredLogger, ts Store, cfg *oauth2.Config, hasher *TokenHasher) *Service {
 	l := logger.With("service", "AuthService")
-	return &Service{store: ts, logger: l}
+	return &Service{store: ts, logger: l, cfg: cfg, hasher: hasher}
 }
 
-func (s *Service) RegisterUser(u *goth.User) (*UserToken, error) {
+// SaveUser saves the google credentials of a user that just signed in
+func (s *Service) SaveUser(u *goth.User) (*UserToken, error) {
 	t := &UserToken{
 		AccessToken:  u.AccessToken,
 		RefreshToken: u.RefreshToken,
@@ -29,21 +56,164 @@ func (s *Service) RegisterUser(u *goth.User) (*UserToken, error) {
 		FirstName:    u.FirstName,
 		LastName:     u.LastName,
 	}
+	// signing in again only grants the sign in scopes, record what the new token can do
+	if info, err := fetchTokenInfo(context.Background(), u.AccessToken); err != nil {
+		s.logger.Warnw("could not tell which scopes the user granted: "+err.Error(), "email", u.Email)
+	} else {
+		t.GrantedScopes = info.Scope
+	}
 	t, err := s.store.UpsertToken(t)
+	if err != nil {
+		return nil, err
+	}
 	s.logger.Infow("User signed up", "email", t.Email)
-	return t, err
+	return t, nil
+}
+
+// DisableQueryToken makes AuthenticateRequest reject credentials sent in the query string
+func (s *Service) DisableQueryToken() {
+	s.queryTokenDisabled = true
+}
+
+// AuthenticateToken returns the user one of its api tokens belongs to, or an error
+func (s *Service) AuthenticateToken(token string) (*UserToken, error) {
+	if token == "" {
+		return nil, ErrTokenInvalid
+	}
+	apiToken, err := s.findAPIToken(token)
+	if errors.Is(err, ErrAPITokenNotFound) {
+		return nil, ErrTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if !apiToken.IsValid() {
+		return nil, &rejectedTokenError{token: apiToken}
+	}
+	user, err := s.store.SelectById(apiToken.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.TouchAPIToken(apiToken); err != nil {
+		s.logger.Errorw("could not update token last use: "+err.Error(), "email", user.Email)
+	}
+	user.APIToken = apiToken
+	return user, nil
 }
 
-// AuthenticateUser given a token will authenticate a user and return it, or an error
+// AuthenticateUser is AuthenticateToken for clients that also send their email, the token has to belong to that email.
+// An empty email is not checked, the token alone identifies the user.
 func (s *Service) AuthenticateUser(email string, token string) (*UserToken, error) {
-	tokens, err := s.store.SelectByEmail(email)
+	user, err := s.AuthenticateToken(token)
 	if err != nil {
 		return nil, err
 	}
-	for _, t := range tokens {
-		if t.MeetingsToken == token {
-			return t, err
+	if email != "" && !strings.EqualFold(strings.TrimSpace(email), user.Email) {
+		return nil, &rejectedTokenError{token: user.APIToken, reason: "email doesn't match the token"}
+	}
+	return user, nil
+}
+
+// findAPIToken looks the token up by its prefix and compares it in constant time with the candidates.
+// Tokens still stored in plain text are hashed the first time they are used.
+func (s *Service) findAPIToken(token string) (*APIToken, error) {
+	prefix := tokenPrefix(token)
+	candidates, err := s.store.SelectAPITokensByPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range candidates {
+		if c.Hash != "" {
+			if s.hasher.Matches(token, c.Hash) {
+				return c, nil
+			}
+			continue
+		}
+		if equalPlain(token, c.PlainToken) {
+			c.Hash = s.hasher.Hash(token)
+			c.Prefix = prefix
+			c.PlainToken = ""
+			if err := s.store.HashAPIToken(c.Id, c.Prefix, c.Hash); err != nil {
+				s.logger.Errorw("could not hash plain text api token: "+err.Error(), "token", c.Id)
+			}
+			return c, nil
 		}
 	}
-	return nil, ErrTokenInvalid
+	return nil, ErrAPITokenNotFound
+}
+
+// CreateAPIToken issues a new api token for the user, expiresAt is optional. The returned token is the only place its value is available.
+// scopes (nil for full access) can't grant more than the token t authenticated with.
+func (s *Service) CreateAPIToken(t *UserToken, label string, expiresAt *time.Time, scopes *Scopes) (*APIToken, error) {
+	if scopes != nil && scopes.Calendars == nil && scopes.Fields == nil && scopes.Capabilities == nil {
+		scopes = nil
+	}
+	if err := scopes.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidScopes, err)
+	}
+	if !scopes.Within(t.Scopes(), t.Email) {
+		return nil, fmt.Errorf("%w: a token can't grant more than it has", ErrInvalidScopes)
+	}
+	apiToken := &APIToken{UserId: t.Id, Label: label, ExpiresAt: expiresAt, Scopes: scopes}
+	apiToken.GenerateToken()
+	apiToken.Prefix = tokenPrefix(apiToken.Token)
+	apiToken.Hash = s.hasher.Hash(apiToken.Token)
+	apiToken, err := s.store.InsertAPIToken(apiToken)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Infow("api token created", "email", t.Email, "token", apiToken.Id)
+	return apiToken, nil
+}
+
+// ListAPITokens returns the api tokens of the user, without their values
+func (s *Service) ListAPITokens(t *UserToken) ([]*APIToken, error) {
+	return s.store.SelectAPITokensByUser(t.Id)
+}
+
+func (s *Service) RevokeAPIToken(t *UserToken, id int64) error {
+	err := s.store.RevokeAPIToken(t.Id, id)
+	if err == nil {
+		s.logger.Infow("api token revoked", "email", t.Email, "token", id)
+	}
+	return err
+}
+
+// GetUser returns the user with the given id, used when a user is identified by something other than its meetings token (eg: a feed token)
+func (s *Service) GetUser(id int64) (*UserToken, error) {
+	return s.store.SelectById(id)
+}
+
+func (s *Service) GetUserByEmail(email string) (*UserToken, error) {
+	users, err := s.store.SelectByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return users[0], nil
+}
+
+// DeleteUser removes every row of the user, it doesn't touch google: see RevokeGoogleGrant
+func (s *Service) DeleteUser(t *UserToken) error {
+	err := s.store.DeleteUser(t.Id)
+	if err == nil {
+		s.logger.Infow("user deleted", "email", t.Email)
+	}
+	return err
+}
+
+// SetShareFreeBusy opts the user in or out of sharing its free/busy information with other users of the server
+func (s *Service) SetShareFreeBusy(t *UserToken, share bool) error {
+	err := s.store.SetShareFreeBusy(t.Id, share)
+	if err == nil {
+		t.ShareFreeBusy = share
+		s.logger.Infow("free/busy sharing changed", "email", t.Email, "share", share)
+	}
+	return err
+}
+
+// UsersSharingFreeBusy returns the users among emails that opted in to share their free/busy information
+func (s *Service) UsersSharingFreeBusy(emails []string) ([]*UserToken, error) {
+	return s.store.SelectSharingFreeBusy(emails)
 }
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/sessions"
+	"github.com/markbates/goth/gothic"
+)
+
+// accountSession is the cookie of users signed in to the account pages
+const accountSession = "meetings_account"
+
+// CSRFField is the form field account pages must send the csrf token of the session in
+const CSRFField = "csrf"
+
+var ErrNoSession = errors.New("NO_SESSION")
+
+// ConfigureSessions sets up the cookie store used by gothic during sign in and by the account pages, cookies are signed and
+// encrypted with keys derived from secret. secure should be true when the server is behind https.
+func ConfigureSessions(secret string, secure bool) {
+	hashKey := sha256.Sum256([]byte("hash:" + secret))
+	blockKey := sha256.Sum256([]byte("block:" + secret))
+	store := sessions.NewCookieStore(hashKey[:], blockKey[:])
+	store.Options = &sessions.Options{
+		Path:     "/",
+		MaxAge:   30 * 24 * 60 * 60,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+	gothic.Store = store
+}
+
+// StartSession signs the user in to the account pages, every session gets its own csrf token
+func StartSession(w http.ResponseWriter, r *http.Request, t *UserToken) error {
+	_, err := startSession(w, r, t)
+	return err
+}
+
+// startSession is StartSession returning the csrf token, pages rendered in the same response can't read it from the request yet
+func startSession(w http.ResponseWriter, r *http.Request, t *UserToken) (string, error) {
+	sess, _ := gothic.Store.New(r, accountSession)
+	csrf := uniuri.NewLen(32)
+	sess.Values["user_id"] = t.Id
+	sess.Values["csrf"] = csrf
+	return csrf, sess.Save(r, w)
+}
+
+// EndSession signs the user out of the account pages
+func EndSession(w http.ResponseWriter, r *http.Request) error {
+	sess, _ := gothic.Store.Get(r, accountSession)
+	sess.Options.MaxAge = -1
+	return sess.Save(r, w)
+}
+
+// AuthenticateSession returns the user signed in to the account pages
+func (s *Service) AuthenticateSession(r *http.Request) (*UserToken, error) {
+	sess, err := gothic.Store.Get(r, accountSession)
+	if err != nil {
+		return nil, ErrNoSession
+	}
+	id, ok := sess.Values["user_id"].(int64)
+	if !ok {
+		return nil, ErrNoSession
+	}
+	return s.GetUser(id)
+}
+
+// CSRFToken returns the csrf token of the session, forms of the account pages send it in CSRFField
+func CSRFToken(r *http.Request) string {
+	sess, err := gothic.Store.Get(r, accountSession)
+	if err != nil {
+		return ""
+	}
+	token, _ := sess.Values["csrf"].(string)
+	return token
+}
+
+// CheckCSRF tells whether the form posted carries the csrf token of the session
+func CheckCSRF(r *http.Request) bool {
+	expected := CSRFToken(r)
+	return expected != "" && equalPlain(expected, r.PostFormValue(CSRFField))
+}
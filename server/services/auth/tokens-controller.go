@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gabzim/meetings/server/services/audit"
+	"go.uber.org/zap"
+)
+
+func NewTokensController(authServ *Service, log *zap.SugaredLogger) *TokensController {
+	l := log.With("controller", "TokensController")
+	return &TokensController{authServ: authServ, log: l}
+}
+
+// TokensController lets users manage their api tokens
+type TokensController struct {
+	log      *zap.SugaredLogger
+	authServ *Service
+}
+
+type createTokenRequest struct {
+	Label string `json:"label"`
+	// ExpiresIn is a duration (eg: 720h), tokens don't expire if it's empty
+	ExpiresIn string `json:"expiresIn"`
+	// Scopes restrict the token, it has full access if they're not set
+	Scopes *Scopes `json:"scopes"`
+}
+
+// Tokens handles GET /api/v1/tokens to list the tokens of the user and POST /api/v1/tokens to create one
+func (c *TokensController) Tokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.authServ.Authenticate(w, r)
+	if !ok || !RequireCapability(w, user, CapabilityAdmin) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := c.authServ.ListAPITokens(user)
+		if err != nil {
+			c.log.Errorf("could not list api tokens: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		WriteJSON(w, 200, tokens)
+	case http.MethodPost:
+		var req createTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid body: %v", err)
+			return
+		}
+		if strings.TrimSpace(req.Label) == "" {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "label is required")
+			return
+		}
+		var expiresAt *time.Time
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil || d <= 0 {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "expiresIn must be a positive duration, eg: 720h")
+				return
+			}
+			t := time.Now().Add(d)
+			expiresAt = &t
+		}
+		t, err := c.authServ.CreateAPIToken(user, req.Label, expiresAt, req.Scopes)
+		if errors.Is(err, ErrInvalidScopes) {
+			c.authServ.Audit(Origin(r, user), user, audit.ActionTokenCreate, audit.OutcomeDenied, err.Error())
+			w.WriteHeader(400)
+			fmt.Fprint(w, err)
+			return
+		} else if err != nil {
+			c.log.Errorf("could not create api token: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		c.authServ.Audit(Origin(r, user), user, audit.ActionTokenCreate, audit.OutcomeSuccess, fmt.Sprintf("token %v: %v", t.Id, t.Label))
+		WriteJSON(w, 201, t)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// Token handles DELETE /api/v1/tokens/<id>, which revokes the token
+func (c *TokensController) Token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.authServ.Authenticate(w, r)
+	if !ok || !RequireCapability(w, user, CapabilityAdmin) {
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid token id")
+		return
+	}
+	err = c.authServ.RevokeAPIToken(user, id)
+	if errors.Is(err, ErrAPITokenNotFound) {
+		c.authServ.Audit(Origin(r, user), user, audit.ActionTokenRevoke, audit.OutcomeFailure, fmt.Sprintf("token %v not found", id))
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Token not found")
+		return
+	} else if err != nil {
+		c.log.Errorf("could not revoke api token: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	c.authServ.Audit(Origin(r, user), user, audit.ActionTokenRevoke, audit.OutcomeSuccess, fmt.Sprintf("token %v", id))
+	w.WriteHeader(204)
+}
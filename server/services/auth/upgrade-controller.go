@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/dchest/uniuri"
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/markbates/goth/gothic"
+)
+
+// upgradeCallbackPath is where google sends users back after granting more scopes, it has to be an authorized redirect uri of the oauth client
+const upgradeCallbackPath = "/auth/google/upgrade/callback"
+
+// Upgrade handles GET /auth/google/upgrade?feature=<feature>, it sends the user signed in to the account pages to google to grant
+// what the feature needs. Multiple features can be asked for at once, they are granted one after the other.
+func (c *GoogleAuthController) Upgrade(w http.ResponseWriter, r *http.Request) {
+	user, err := c.authServ.AuthenticateSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/auth/google", http.StatusFound)
+		return
+	}
+	features := make([]Feature, 0)
+	for _, name := range r.URL.Query()["feature"] {
+		f, err := ParseFeature(name)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprint(w, err)
+			return
+		}
+		if !user.CanUse(f) {
+			features = append(features, f)
+		}
+	}
+	if len(features) == 0 {
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	sess, err := gothic.Store.Get(r, accountSession)
+	if err != nil {
+		http.Redirect(w, r, "/auth/google", http.StatusFound)
+		return
+	}
+	state := uniuri.NewLen(32)
+	sess.Values["upgrade_state"] = state
+	// the ones left are asked for once google sends the user back
+	pending := make([]string, 0, len(features)-1)
+	for _, f := range features[1:] {
+		pending = append(pending, string(f))
+	}
+	sess.Values["upgrade_pending"] = pending
+	if err := sess.Save(r, w); err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	authURL, err := c.authServ.UpgradeURL(user, features[0], c.hostURL+upgradeCallbackPath, state)
+	if err != nil {
+		fmt.Fprint(w, err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// UpgradeCallback handles GET /auth/google/upgrade/callback, google sends users here after they grant (or deny) more scopes
+func (c *GoogleAuthController) UpgradeCallback(w http.ResponseWriter, r *http.Request) {
+	user, err := c.authServ.AuthenticateSession(r)
+	if err != nil {
+		http.Redirect(w, r, "/auth/google", http.StatusFound)
+		return
+	}
+	sess, err := gothic.Store.Get(r, accountSession)
+	if err != nil {
+		http.Redirect(w, r, "/auth/google", http.StatusFound)
+		return
+	}
+	expected, _ := sess.Values["upgrade_state"].(string)
+	pending, _ := sess.Values["upgrade_pending"].([]string)
+	delete(sess.Values, "upgrade_state")
+	delete(sess.Values, "upgrade_pending")
+	sess.Save(r, w)
+	if expected == "" || !equalPlain(expected, r.URL.Query().Get("state")) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "This link expired, go back to your account and try again")
+		return
+	}
+	if r.URL.Query().Get("error") != "" {
+		// the user said no, features that need the scope keep failing with a ScopeError
+		c.authServ.Audit(Origin(r, user), user, audit.ActionGoogleGrant, audit.OutcomeDenied, r.URL.Query().Get("error"))
+		http.Redirect(w, r, "/account", http.StatusFound)
+		return
+	}
+	err = c.authServ.CompleteUpgrade(r.Context(), user, c.hostURL+upgradeCallbackPath, r.URL.Query().Get("code"))
+	if err != nil {
+		c.authServ.Audit(Origin(r, user), user, audit.ActionGoogleGrant, audit.OutcomeFailure, err.Error())
+	} else {
+		c.authServ.Audit(Origin(r, user), user, audit.ActionGoogleGrant, audit.OutcomeSuccess, user.GrantedScopes)
+	}
+	if errors.Is(err, ErrTokenInvalid) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Sign in to google as %v to grant access to its calendar", user.Email)
+		return
+	} else if err != nil {
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "Could not complete the grant with google: %v", err)
+		return
+	}
+	if len(pending) > 0 {
+		http.Redirect(w, r, "/auth/google/upgrade?"+url.Values{"feature": pending}.Encode(), http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/account", http.StatusFound)
+}
+
+// lostFeatures returns the features the user could use before signing in again and can't anymore, signing in only grants
+// the sign in scopes
+func lostFeatures(before, after *UserToken) []Feature {
+	lost := make([]Feature, 0)
+	if before == nil {
+		return lost
+	}
+	for f := range featureScopes {
+		if before.CanUse(f) && !after.CanUse(f) {
+			lost = append(lost, f)
+		}
+	}
+	return lost
+}
@@ -0,0 +1,52 @@
+package calendars
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+func NewController(calendarsServ *Service, authServ *auth.Service, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "CalendarsController")
+	return &Controller{serv: calendarsServ, auth: authServ, log: l}
+}
+
+type Controller struct {
+	log  *zap.SugaredLogger
+	serv *Service
+	auth *auth.Service
+}
+
+// List handles GET /api/v1/calendars
+func (c *Controller) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok {
+		return
+	}
+	if !auth.RequireCapability(w, user, auth.CapabilityREST) {
+		return
+	}
+	cals, err := c.serv.List(r.Context(), user)
+	if err != nil {
+		c.log.Errorw("could not list calendars: "+err.Error(), "email", user.Email)
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "Could not retrieve calendars from google calendar")
+		return
+	}
+	// only list the calendars the token can read
+	allowed := make([]*Calendar, 0, len(cals))
+	for _, cal := range cals {
+		if user.AllowsCalendar(cal.Id) || (cal.Primary && user.AllowsCalendar("primary")) {
+			allowed = append(allowed, cal)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(allowed)
+}
@@ -0,0 +1,54 @@
+package calendars
+
+import (
+	"context"
+
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+// Calendar is an entry of the user calendar list, Id is what clients pass as calendar to the other endpoints
+type Calendar struct {
+	Id         string `json:"id"`
+	Summary    string `json:"summary"`
+	Color      string `json:"color"`
+	AccessRole string `json:"accessRole"`
+	Primary    bool   `json:"primary"`
+}
+
+type Service struct {
+	logger   *zap.SugaredLogger
+	authServ *auth.Service
+}
+
+func NewService(logger *zap.SugaredLogger, authServ *auth.Service) *Service {
+	l := logger.With("service", "CalendarsService")
+	return &Service{logger: l, authServ: authServ}
+}
+
+// List returns every calendar in the user calendar list
+func (s *Service) List(ctx context.Context, t *auth.UserToken) ([]*Calendar, error) {
+	calServ, err := s.authServ.CalendarService(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*Calendar, 0)
+	pageToken := ""
+	for {
+		list, err := calServ.CalendarList.List().PageToken(pageToken).Context(ctx).Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range list.Items {
+			summary := c.Summary
+			if c.SummaryOverride != "" {
+				summary = c.SummaryOverride
+			}
+			res = append(res, &Calendar{Id: c.Id, Summary: summary, Color: c.BackgroundColor, AccessRole: c.AccessRole, Primary: c.Primary})
+		}
+		pageToken = list.NextPageToken
+		if pageToken == "" {
+			return res, nil
+		}
+	}
+}
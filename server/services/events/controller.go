@@ -0,0 +1,115 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gabzim/meetings/server/eventfields"
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+func NewController(eventsServ *Service, authServ *auth.Service, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "EventsController")
+	return &Controller{serv: eventsServ, auth: authServ, log: l}
+}
+
+type Controller struct {
+	log  *zap.SugaredLogger
+	serv *Service
+	auth *auth.Service
+}
+
+// List handles GET /api/v1/events?calendar=&from=&to=&pageSize=&pageToken= plus the filters of eventfilter.ParseQuery.
+// from and to are RFC3339 and default to now and 24 hours from now.
+func (c *Controller) List(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok {
+		return
+	}
+	if !auth.RequireCapability(w, user, auth.CapabilityREST) {
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, err)
+		return
+	}
+	if !user.AllowsCalendar(q.Calendar) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "This token can't read calendar %v", q.Calendar)
+		return
+	}
+	if !user.AllowsFields(q.Filter.Fields()) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "This token can't filter on fields it can't see")
+		return
+	}
+
+	page, err := c.serv.List(r.Context(), user, q)
+	if errors.Is(err, ErrBadPageToken) {
+		w.WriteHeader(400)
+		fmt.Fprint(w, err)
+		return
+	} else if err != nil {
+		c.log.Errorw("could not list events: "+err.Error(), "email", user.Email, "calendar", q.Calendar)
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "Could not retrieve events from google calendar")
+		return
+	}
+	page.Items = eventfields.ProjectAll(page.Items, user.EventFields())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func parseQuery(r *http.Request) (*Query, error) {
+	params := r.URL.Query()
+	q := &Query{
+		Calendar:  params.Get("calendar"),
+		From:      time.Now(),
+		PageSize:  DefaultPageSize,
+		PageToken: params.Get("pageToken"),
+	}
+	if q.Calendar == "" {
+		q.Calendar = "primary"
+	}
+	var err error
+	if from := params.Get("from"); from != "" {
+		q.From, err = time.Parse(time.RFC3339, from)
+		if err != nil {
+			return nil, fmt.Errorf("from must be an RFC3339 date: %w", err)
+		}
+	}
+	q.To = q.From.Add(24 * time.Hour)
+	if to := params.Get("to"); to != "" {
+		q.To, err = time.Parse(time.RFC3339, to)
+		if err != nil {
+			return nil, fmt.Errorf("to must be an RFC3339 date: %w", err)
+		}
+	}
+	if !q.To.After(q.From) {
+		return nil, fmt.Errorf("to must be after from")
+	}
+	if size := params.Get("pageSize"); size != "" {
+		q.PageSize, err = strconv.Atoi(size)
+		if err != nil || q.PageSize < 1 || q.PageSize > MaxPageSize {
+			return nil, fmt.Errorf("pageSize must be a number between 1 and %d", MaxPageSize)
+		}
+	}
+	q.Filter, err = eventfilter.ParseQuery(params)
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
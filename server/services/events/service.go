@@ -0,0 +1,166 @@
+package events
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gabzim/meetings/server/calendarwh"
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/notifications"
+	"go.uber.org/zap"
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	DefaultPageSize = 250
+	MaxPageSize     = 2500
+)
+
+// where the events of a response came from
+const (
+	SourceCache  = "cache"
+	SourceGoogle = "google"
+)
+
+// fromTolerance is how far in the past From can be and still count as now (it defaults to the time the request was parsed)
+const fromTolerance = time.Minute
+
+var ErrBadPageToken = errors.New("BAD_PAGE_TOKEN")
+
+// Query selects a page of events of a calendar between From and To
+type Query struct {
+	Calendar  string
+	From      time.Time
+	To        time.Time
+	Filter    *eventfilter.Filter
+	PageSize  int
+	PageToken string
+}
+
+type Page struct {
+	Items         []*calendar.Event `json:"items"`
+	NextPageToken string            `json:"nextPageToken,omitempty"`
+	Source        string            `json:"source"`
+}
+
+type Service struct {
+	logger    *zap.SugaredLogger
+	authServ  *auth.Service
+	notifServ *notifications.Service
+}
+
+func NewService(logger *zap.SugaredLogger, authServ *auth.Service, notifServ *notifications.Service) *Service {
+	l := logger.With("service", "EventsService")
+	return &Service{logger: l, authServ: authServ, notifServ: notifServ}
+}
+
+// List returns the events that overlap the query range. It uses the snapshot of the calendar webhook if some client is subscribed to it,
+// otherwise it asks google.
+func (s *Service) List(ctx context.Context, t *auth.UserToken, q *Query) (*Page, error) {
+	offset, err := decodePageToken(q.PageToken)
+	if err != nil {
+		return nil, err
+	}
+	matching, source, err := s.matching(ctx, t, q)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Items: []*calendar.Event{}, Source: source}
+	if offset >= len(matching) {
+		return page, nil
+	}
+	end := offset + q.PageSize
+	if end < len(matching) {
+		page.NextPageToken = encodePageToken(end)
+	} else {
+		end = len(matching)
+	}
+	page.Items = matching[offset:end]
+	return page, nil
+}
+
+// All returns every event that overlaps the query range without paging, it fetches them once
+func (s *Service) All(ctx context.Context, t *auth.UserToken, q *Query) ([]*calendar.Event, error) {
+	events, _, err := s.matching(ctx, t, q)
+	return events, err
+}
+
+// matching returns the events that overlap the query range and pass its filter, and where they came from
+func (s *Service) matching(ctx context.Context, t *auth.UserToken, q *Query) ([]*calendar.Event, string, error) {
+	events, source, err := s.fetch(ctx, t, q)
+	if err != nil {
+		return nil, "", err
+	}
+	matching := make([]*calendar.Event, 0, len(events))
+	for _, e := range events {
+		if overlaps(e, q.From, q.To) && q.Filter.Match(e) {
+			matching = append(matching, e)
+		}
+	}
+	return matching, source, nil
+}
+
+func (s *Service) fetch(ctx context.Context, t *auth.UserToken, q *Query) ([]*calendar.Event, string, error) {
+	// the snapshots only keep the events that haven't ended, from now on (a From slightly in the past, eg: the default, is now too)
+	// until their last full sync plus the window. Queries outside of that go to google
+	if !q.From.Before(time.Now().Add(-fromTolerance)) {
+		if events, until, ok := s.notifServ.Snapshot(t.Email, q.Calendar); ok && !q.To.After(until) {
+			return events, SourceCache, nil
+		}
+	}
+	calServ, err := s.authServ.CalendarService(ctx, t)
+	if err != nil {
+		return nil, "", err
+	}
+	var events []*calendar.Event
+	pageToken := ""
+	for {
+		res, err := calServ.Events.List(q.Calendar).
+			SingleEvents(true).
+			OrderBy("startTime").
+			MaxResults(MaxPageSize).
+			TimeMin(q.From.Format(time.RFC3339)).
+			TimeMax(q.To.Format(time.RFC3339)).
+			PageToken(pageToken).
+			Context(ctx).
+			Do()
+		if err != nil {
+			return nil, "", err
+		}
+		events = append(events, res.Items...)
+		pageToken = res.NextPageToken
+		if pageToken == "" {
+			return events, SourceGoogle, nil
+		}
+	}
+}
+
+func overlaps(e *calendar.Event, from, to time.Time) bool {
+	start, end := calendarwh.EventTime(e.Start), calendarwh.EventTime(e.End)
+	return start.Before(to) && end.After(from)
+}
+
+// page tokens are just the offset of the first item of the page, opaque to clients
+func encodePageToken(offset int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodePageToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, ErrBadPageToken
+	}
+	offset, err := strconv.Atoi(string(b))
+	if err != nil || offset < 0 {
+		return 0, ErrBadPageToken
+	}
+	return offset, nil
+}
@@ -0,0 +1,140 @@
+package feeds
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+func NewController(feedsServ *Service, authServ *auth.Service, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "FeedsController")
+	return &Controller{serv: feedsServ, auth: authServ, log: l}
+}
+
+type Controller struct {
+	log  *zap.SugaredLogger
+	serv *Service
+	auth *auth.Service
+}
+
+type createFeedRequest struct {
+	Label    string              `json:"label"`
+	Calendar string              `json:"calendar"`
+	Privacy  string              `json:"privacy"`
+	Filters  *eventfilter.Filter `json:"filters"`
+}
+
+// feedResponse has the url of the feed only when it's created, its token isn't stored
+type feedResponse struct {
+	*FeedToken
+	URL string `json:"url,omitempty"`
+}
+
+// ServeFeed handles GET /ical/<feed-token>.ics, the feed token is the only credential needed
+func (c *Controller) ServeFeed(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/ical/"), ".ics")
+	var buf bytes.Buffer
+	err := c.serv.Render(r.Context(), token, &buf)
+	if errors.Is(err, ErrFeedNotFound) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Feed not found")
+		return
+	} else if err != nil {
+		c.log.Errorf("could not render feed: %v", err)
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "Could not retrieve events from google calendar")
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Feeds handles GET /api/v1/feeds to list the feeds of the user and POST /api/v1/feeds to create one
+func (c *Controller) Feeds(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok || !auth.RequireCapability(w, user, auth.CapabilityAdmin) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		feeds, err := c.serv.List(user)
+		if err != nil {
+			c.log.Errorf("could not list feeds: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		res := make([]feedResponse, len(feeds))
+		for i, f := range feeds {
+			res[i] = feedResponse{FeedToken: f, URL: c.serv.URL(f)}
+		}
+		auth.WriteJSON(w, 200, res)
+	case http.MethodPost:
+		var req createFeedRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid body: %v", err)
+			return
+		}
+		if req.Calendar == "" {
+			req.Calendar = "primary"
+		}
+		f, err := c.serv.Create(user, req.Label, req.Calendar, req.Privacy, req.Filters)
+		if errors.Is(err, auth.ErrCalendarNotAllowed) {
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "This token can't read calendar %v", req.Calendar)
+			return
+		} else if errors.Is(err, auth.ErrFieldNotAllowed) {
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "This token can't see the fields of the feed, pick another privacy: %v", err)
+			return
+		} else if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprint(w, err)
+			return
+		}
+		c.auth.Audit(auth.Origin(r, user), user, audit.ActionFeedCreate, audit.OutcomeSuccess, fmt.Sprintf("feed %v: %v", f.Id, f.Label))
+		auth.WriteJSON(w, 201, feedResponse{FeedToken: f, URL: c.serv.URL(f)})
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// Feed handles DELETE /api/v1/feeds/<id>, which revokes the feed token
+func (c *Controller) Feed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok || !auth.RequireCapability(w, user, auth.CapabilityAdmin) {
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, "/api/v1/feeds/"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid feed id")
+		return
+	}
+	err = c.serv.Revoke(user, id)
+	if errors.Is(err, ErrFeedNotFound) {
+		c.auth.Audit(auth.Origin(r, user), user, audit.ActionFeedRevoke, audit.OutcomeFailure, fmt.Sprintf("feed %v not found", id))
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Feed not found")
+		return
+	} else if err != nil {
+		c.log.Errorf("could not revoke feed: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionFeedRevoke, audit.OutcomeSuccess, fmt.Sprintf("feed %v", id))
+	w.WriteHeader(204)
+}
@@ -0,0 +1,148 @@
+package feeds
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/jmoiron/sqlx"
+)
+
+// Privacy modes of a feed
+const (
+	// PrivacyFull shows events as they are
+	PrivacyFull = "full"
+	// PrivacyNoDetails hides descriptions, locations and attendees
+	PrivacyNoDetails = "no-details"
+	// PrivacyBusy only shows when you're busy, every event is a private "Busy" block
+	PrivacyBusy = "busy"
+)
+
+// privacyFields are the event fields (see eventfields) each privacy mode shows
+var privacyFields = map[string][]string{
+	PrivacyFull:      {"summary", "description", "location", "start", "end", "attendees", "organizer", "htmlLink", "updated", "transparency"},
+	PrivacyNoDetails: {"summary", "start", "end", "updated", "transparency"},
+	PrivacyBusy:      {"start", "end", "transparency"},
+}
+
+var ErrFeedNotFound = errors.New("FEED_NOT_FOUND")
+
+// FeedToken is a credential that gives read access to an ics rendering of a calendar, it's separate from the meetings token so it can be
+// shared with other calendar apps and revoked without affecting anything else. Only a hash of the token is stored, like api tokens.
+type FeedToken struct {
+	Id     int64 `db:"id" json:"id"`
+	UserId int64 `db:"user_id" json:"-"`
+	// Token is only known when the feed is created
+	Token     string     `db:"token" json:"token,omitempty"`
+	TokenHash string     `db:"token_hash" json:"-"`
+	Label     string     `db:"label" json:"label"`
+	Calendar  string     `db:"calendar" json:"calendar"`
+	FilterRaw string     `db:"filter" json:"-"`
+	Privacy   string     `db:"privacy" json:"privacy"`
+	CreatedAt *time.Time `db:"created_at" json:"createdAt"`
+	RevokedAt *time.Time `db:"revoked_at" json:"revokedAt,omitempty"`
+}
+
+func (f *FeedToken) GenerateToken() {
+	f.Token = uniuri.NewLen(32)
+}
+
+// IsRevoked tells whether the token of the feed stopped working
+func (f *FeedToken) IsRevoked() bool {
+	return f.RevokedAt != nil
+}
+
+// Filter decodes the filter stored with the feed
+func (f *FeedToken) Filter() (*eventfilter.Filter, error) {
+	var filter eventfilter.Filter
+	err := json.Unmarshal([]byte(f.FilterRaw), &filter)
+	return &filter, err
+}
+
+func (f *FeedToken) SetFilter(filter *eventfilter.Filter) error {
+	if filter == nil {
+		filter = &eventfilter.Filter{}
+	}
+	b, err := json.Marshal(filter)
+	f.FilterRaw = string(b)
+	return err
+}
+
+// Store keeps the feeds of the users, FeedStore implements it on postgres and sqlite
+type Store interface {
+	// SelectByHash returns the feed whose token hashes to hash, revoked feeds are not found
+	SelectByHash(hash string) (*FeedToken, error)
+	// SelectByPlainToken returns the feed created before tokens were hashed with that token, revoked feeds are not found
+	SelectByPlainToken(token string) (*FeedToken, error)
+	// HashToken replaces the plain token of the feed with its hash
+	HashToken(id int64, hash string) error
+	// SelectByUser returns the feeds of the user without their tokens
+	SelectByUser(userId int64) ([]*FeedToken, error)
+	// Insert saves the feed with its TokenHash, the token itself isn't stored
+	Insert(f *FeedToken) (*FeedToken, error)
+	Revoke(userId, id int64) error
+}
+
+type FeedStore struct {
+	db *sqlx.DB
+}
+
+func NewFeedStore(db *sqlx.DB) *FeedStore {
+	return &FeedStore{db}
+}
+
+const feedColumns = "id, user_id, COALESCE(token_hash, '') AS token_hash, label, calendar, filter, privacy, created_at, revoked_at"
+
+func (s *FeedStore) selectFeed(where string, arg interface{}) (*FeedToken, error) {
+	f := FeedToken{}
+	err := s.db.Get(&f, "SELECT "+feedColumns+" FROM feed_tokens WHERE "+where+" AND revoked_at IS NULL", arg)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrFeedNotFound
+	}
+	return &f, err
+}
+
+func (s *FeedStore) SelectByHash(hash string) (*FeedToken, error) {
+	return s.selectFeed("token_hash = $1", hash)
+}
+
+func (s *FeedStore) SelectByPlainToken(token string) (*FeedToken, error) {
+	return s.selectFeed("token = $1 AND token_hash IS NULL", token)
+}
+
+func (s *FeedStore) HashToken(id int64, hash string) error {
+	_, err := s.db.Exec("UPDATE feed_tokens SET token_hash = $1, token = NULL WHERE id = $2", hash, id)
+	return err
+}
+
+func (s *FeedStore) SelectByUser(userId int64) ([]*FeedToken, error) {
+	feeds := make([]*FeedToken, 0)
+	err := s.db.Select(&feeds, "SELECT "+feedColumns+" FROM feed_tokens WHERE user_id = $1 ORDER BY id", userId)
+	return feeds, err
+}
+
+func (s *FeedStore) Insert(f *FeedToken) (*FeedToken, error) {
+	if f.TokenHash == "" {
+		return nil, errors.New("feeds are stored with the hash of their token")
+	}
+	now := time.Now()
+	f.CreatedAt = &now
+	err := s.db.Get(&f.Id, "INSERT INTO feed_tokens (user_id, token_hash, label, calendar, filter, privacy, created_at) VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id", f.UserId, f.TokenHash, f.Label, f.Calendar, f.FilterRaw, f.Privacy, f.CreatedAt)
+	return f, err
+}
+
+// Revoke marks the feed of the user as revoked, the token stops working right away
+func (s *FeedStore) Revoke(userId, id int64) error {
+	res, err := s.db.Exec("UPDATE feed_tokens SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL", time.Now(), id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrFeedNotFound
+	}
+	return err
+}
@@ -0,0 +1,146 @@
+package feeds
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gabzim/meetings/server/calendarwh"
+	"google.golang.org/api/calendar/v3"
+)
+
+const (
+	icalDateTime = "20060102T150405Z"
+	icalDate     = "20060102"
+	// lines longer than this many octets must be folded (RFC 5545 3.1)
+	icalLineLength = 75
+)
+
+// icalWriter writes RFC 5545 content lines, folding and terminating them with CRLF
+type icalWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (iw *icalWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	l := name + ":" + value
+	var b strings.Builder
+	// continuation lines start with a space, which counts towards their length
+	max := icalLineLength
+	for len(l) > max {
+		cut := max
+		// don't split utf-8 sequences
+		for cut > 0 && l[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		b.WriteString(l[:cut] + "\r\n ")
+		l = l[cut:]
+		max = icalLineLength - 1
+	}
+	b.WriteString(l + "\r\n")
+	_, iw.err = io.WriteString(iw.w, b.String())
+}
+
+func (iw *icalWriter) text(name, value string) {
+	if value == "" {
+		return
+	}
+	iw.line(name, escapeText(value))
+}
+
+func escapeText(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+	return r.Replace(s)
+}
+
+// WriteCalendar renders the events as an iCalendar document, applying the privacy mode
+func WriteCalendar(w io.Writer, name string, events []*calendar.Event, privacy string) error {
+	iw := &icalWriter{w: w}
+	now := time.Now().UTC().Format(icalDateTime)
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//gabzim//meetings//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	iw.line("METHOD", "PUBLISH")
+	iw.text("X-WR-CALNAME", name)
+	for _, e := range events {
+		if privacy == PrivacyBusy && e.Transparency == "transparent" {
+			// events that don't block your time aren't busy blocks
+			continue
+		}
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", e.Id+"@meetings")
+		iw.line("DTSTAMP", now)
+		writeEventTime(iw, "DTSTART", e.Start)
+		writeEventTime(iw, "DTEND", e.End)
+		if e.Status != "" {
+			iw.line("STATUS", strings.ToUpper(e.Status))
+		}
+		if privacy == PrivacyBusy {
+			iw.line("SUMMARY", "Busy")
+			iw.line("CLASS", "PRIVATE")
+			iw.line("END", "VEVENT")
+			continue
+		}
+		iw.text("SUMMARY", e.Summary)
+		if e.Updated != "" {
+			if t, err := time.Parse(time.RFC3339, e.Updated); err == nil {
+				iw.line("LAST-MODIFIED", t.UTC().Format(icalDateTime))
+			}
+		}
+		if e.Transparency == "transparent" {
+			iw.line("TRANSP", "TRANSPARENT")
+		}
+		if privacy == PrivacyFull {
+			iw.text("DESCRIPTION", e.Description)
+			iw.text("LOCATION", e.Location)
+			if e.HtmlLink != "" {
+				iw.line("URL", e.HtmlLink)
+			}
+			if e.Organizer != nil && e.Organizer.Email != "" {
+				iw.line("ORGANIZER"+commonName(e.Organizer.DisplayName), "mailto:"+e.Organizer.Email)
+			}
+			for _, a := range e.Attendees {
+				iw.line(fmt.Sprintf("ATTENDEE%s;PARTSTAT=%s", commonName(a.DisplayName), partStat(a.ResponseStatus)), "mailto:"+a.Email)
+			}
+		}
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
+
+func writeEventTime(iw *icalWriter, name string, d *calendar.EventDateTime) {
+	if d == nil {
+		return
+	}
+	if d.Date != "" {
+		t := calendarwh.EventTime(d)
+		iw.line(name+";VALUE=DATE", t.Format(icalDate))
+		return
+	}
+	iw.line(name, calendarwh.EventTime(d).UTC().Format(icalDateTime))
+}
+
+func commonName(name string) string {
+	if name == "" {
+		return ""
+	}
+	return `;CN="` + strings.ReplaceAll(name, `"`, "'") + `"`
+}
+
+func partStat(responseStatus string) string {
+	switch responseStatus {
+	case "accepted":
+		return "ACCEPTED"
+	case "declined":
+		return "DECLINED"
+	case "tentative":
+		return "TENTATIVE"
+	}
+	return "NEEDS-ACTION"
+}
@@ -0,0 +1,143 @@
+package feeds
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/events"
+	"go.uber.org/zap"
+)
+
+const (
+	// feeds show a week of past events and two months of upcoming ones
+	feedPast   = 7 * 24 * time.Hour
+	feedFuture = 60 * 24 * time.Hour
+)
+
+type Service struct {
+	logger     *zap.SugaredLogger
+	store      Store
+	authServ   *auth.Service
+	eventsServ *events.Service
+	// hasher hashes feed tokens with the key api tokens are hashed with
+	hasher  *auth.TokenHasher
+	hostURL string
+}
+
+func NewService(logger *zap.SugaredLogger, store Store, authServ *auth.Service, eventsServ *events.Service, hasher *auth.TokenHasher, hostURL string) *Service {
+	l := logger.With("service", "FeedsService")
+	return &Service{logger: l, store: store, authServ: authServ, eventsServ: eventsServ, hasher: hasher, hostURL: hostURL}
+}
+
+// URL is where calendar apps can subscribe to the feed, it's only known when the feed is created (the token isn't stored)
+func (s *Service) URL(f *FeedToken) string {
+	if f.Token == "" {
+		return ""
+	}
+	return s.hostURL + "/ical/" + f.Token + ".ics"
+}
+
+// Create creates a feed of the calendar. Feeds are served with the credentials of the user, so the token creating it has to be able to
+// read the calendar and see the fields the privacy mode and the filter use, it fails with auth.ErrCalendarNotAllowed or
+// auth.ErrFieldNotAllowed otherwise.
+func (s *Service) Create(t *auth.UserToken, label, calendarName, privacy string, filter *eventfilter.Filter) (*FeedToken, error) {
+	if calendarName == "" {
+		calendarName = "primary"
+	}
+	if privacy == "" {
+		privacy = PrivacyFull
+	}
+	fields, ok := privacyFields[privacy]
+	if !ok {
+		return nil, fmt.Errorf("privacy must be one of %s, %s or %s", PrivacyFull, PrivacyNoDetails, PrivacyBusy)
+	}
+	if filter != nil {
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if !t.AllowsCalendar(calendarName) {
+		return nil, auth.ErrCalendarNotAllowed
+	}
+	if !t.AllowsFields(fields) {
+		return nil, fmt.Errorf("%w: privacy %v shows %v", auth.ErrFieldNotAllowed, privacy, strings.Join(fields, ", "))
+	}
+	if !t.AllowsFields(filter.Fields()) {
+		return nil, auth.ErrFieldNotAllowed
+	}
+	f := &FeedToken{UserId: t.Id, Label: label, Calendar: calendarName, Privacy: privacy}
+	f.GenerateToken()
+	f.TokenHash = s.hasher.Hash(f.Token)
+	if err := f.SetFilter(filter); err != nil {
+		return nil, err
+	}
+	f, err := s.store.Insert(f)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Infow("feed created", "email", t.Email, "feed", f.Id)
+	return f, nil
+}
+
+func (s *Service) List(t *auth.UserToken) ([]*FeedToken, error) {
+	return s.store.SelectByUser(t.Id)
+}
+
+func (s *Service) Revoke(t *auth.UserToken, id int64) error {
+	err := s.store.Revoke(t.Id, id)
+	if err == nil {
+		s.logger.Infow("feed revoked", "email", t.Email, "feed", id)
+	}
+	return err
+}
+
+// find returns the feed with the token, feeds created before tokens were hashed are hashed the first time they're used
+func (s *Service) find(token string) (*FeedToken, error) {
+	if token == "" {
+		return nil, ErrFeedNotFound
+	}
+	f, err := s.store.SelectByHash(s.hasher.Hash(token))
+	if !errors.Is(err, ErrFeedNotFound) {
+		return f, err
+	}
+	f, err = s.store.SelectByPlainToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.store.HashToken(f.Id, s.hasher.Hash(token)); err != nil {
+		s.logger.Errorw("could not hash feed token: "+err.Error(), "feed", f.Id)
+	}
+	return f, nil
+}
+
+// Render writes the ics document of the feed with the given token
+func (s *Service) Render(ctx context.Context, token string, w io.Writer) error {
+	f, err := s.find(token)
+	if err != nil {
+		return err
+	}
+	user, err := s.authServ.GetUser(f.UserId)
+	if err != nil {
+		return err
+	}
+	filter, err := f.Filter()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	all, err := s.eventsServ.All(ctx, user, &events.Query{Calendar: f.Calendar, From: now.Add(-feedPast), To: now.Add(feedFuture), Filter: filter})
+	if err != nil {
+		return err
+	}
+	name := f.Label
+	if name == "" {
+		name = f.Calendar
+	}
+	return WriteCalendar(w, name, all, f.Privacy)
+}
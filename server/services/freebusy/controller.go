@@ -0,0 +1,90 @@
+package freebusy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+func NewController(freeBusyServ *Service, authServ *auth.Service, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "FreeBusyController")
+	return &Controller{serv: freeBusyServ, auth: authServ, log: l}
+}
+
+type Controller struct {
+	log  *zap.SugaredLogger
+	serv *Service
+	auth *auth.Service
+}
+
+type sharingRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Query handles POST /api/v1/freebusy with a Query as body
+func (c *Controller) Query(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok || !auth.RequireCapability(w, user, auth.CapabilityREST) {
+		return
+	}
+	// the query always includes the primary calendar of the user
+	if !user.AllowsCalendar("primary") {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "This token can't read your primary calendar")
+		return
+	}
+	var q Query
+	if err := json.NewDecoder(r.Body).Decode(&q); err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid body: %v", err)
+		return
+	}
+	res, err := c.serv.Query(r.Context(), user, &q)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// Sharing handles GET and PUT /api/v1/freebusy/sharing, users must opt in before others can see their free/busy information
+func (c *Controller) Sharing(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		if !auth.RequireCapability(w, user, auth.CapabilityAdmin) {
+			return
+		}
+		var req sharingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid body: %v", err)
+			return
+		}
+		if err := c.auth.SetShareFreeBusy(user, req.Enabled); err != nil {
+			c.log.Errorf("could not update free/busy sharing: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		c.auth.Audit(auth.Origin(r, user), user, audit.ActionSharingChange, audit.OutcomeSuccess, fmt.Sprintf("share: %v", req.Enabled))
+	default:
+		w.WriteHeader(405)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sharingRequest{Enabled: user.ShareFreeBusy})
+}
@@ -0,0 +1,168 @@
+package freebusy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+	"google.golang.org/api/calendar/v3"
+)
+
+// maxRange is the longest span a query can cover, google rejects longer ones anyway
+const maxRange = 62 * 24 * time.Hour
+
+// Query asks for the free/busy information of some users between From and To. If Duration is set, common free slots at least that long
+// are suggested, within WorkingHours in every one of TimeZones (UTC if none given).
+type Query struct {
+	Emails       []string      `json:"emails"`
+	From         time.Time     `json:"from"`
+	To           time.Time     `json:"to"`
+	Duration     string        `json:"duration,omitempty"`
+	WorkingHours *WorkingHours `json:"workingHours,omitempty"`
+	TimeZones    []string      `json:"timeZones,omitempty"`
+}
+
+type Result struct {
+	// Busy has the merged busy intervals of each user included
+	Busy map[string][]Interval `json:"busy"`
+	// Excluded are the emails that are not registered, didn't opt in, or whose calendar couldn't be read
+	Excluded []string   `json:"excluded"`
+	Slots    []Interval `json:"slots,omitempty"`
+}
+
+type Service struct {
+	logger   *zap.SugaredLogger
+	authServ *auth.Service
+}
+
+func NewService(logger *zap.SugaredLogger, authServ *auth.Service) *Service {
+	l := logger.With("service", "FreeBusyService")
+	return &Service{logger: l, authServ: authServ}
+}
+
+// Query returns the busy intervals of the users in the query that opted in to share them, the requester is always included.
+func (s *Service) Query(ctx context.Context, requester *auth.UserToken, q *Query) (*Result, error) {
+	d, locs, err := q.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := s.authServ.UsersSharingFreeBusy(q.Emails)
+	if err != nil {
+		return nil, err
+	}
+	byEmail := map[string]*auth.UserToken{strings.ToLower(requester.Email): requester}
+	for _, u := range users {
+		byEmail[strings.ToLower(u.Email)] = u
+	}
+
+	res := &Result{Busy: make(map[string][]Interval), Excluded: make([]string, 0)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for email, u := range byEmail {
+		wg.Add(1)
+		go func(email string, u *auth.UserToken) {
+			defer wg.Done()
+			busy, err := s.busy(ctx, u, q.From, q.To)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				s.logger.Errorw("could not query free/busy: "+err.Error(), "email", email)
+				res.Excluded = append(res.Excluded, email)
+				return
+			}
+			res.Busy[email] = busy
+		}(email, u)
+	}
+	wg.Wait()
+	for _, e := range q.Emails {
+		if _, ok := byEmail[strings.ToLower(strings.TrimSpace(e))]; !ok {
+			res.Excluded = append(res.Excluded, e)
+		}
+	}
+
+	if d > 0 {
+		all := make([]Interval, 0)
+		for _, busy := range res.Busy {
+			all = append(all, busy...)
+		}
+		res.Slots, err = FindSlots(all, q.From, q.To, d, q.WorkingHours, locs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// busy queries google with the user own credentials for the busy intervals of its primary calendar
+func (s *Service) busy(ctx context.Context, t *auth.UserToken, from, to time.Time) ([]Interval, error) {
+	calServ, err := s.authServ.CalendarService(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	res, err := calServ.Freebusy.Query(&calendar.FreeBusyRequest{
+		TimeMin: from.Format(time.RFC3339),
+		TimeMax: to.Format(time.RFC3339),
+		Items:   []*calendar.FreeBusyRequestItem{{Id: "primary"}},
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	intervals := make([]Interval, 0)
+	for _, cal := range res.Calendars {
+		if len(cal.Errors) > 0 {
+			return nil, fmt.Errorf("free/busy error: %v", cal.Errors[0].Reason)
+		}
+		for _, b := range cal.Busy {
+			start, err1 := time.Parse(time.RFC3339, b.Start)
+			end, err2 := time.Parse(time.RFC3339, b.End)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			intervals = append(intervals, Interval{Start: start, End: end})
+		}
+	}
+	return mergeIntervals(intervals), nil
+}
+
+func (q *Query) validate() (time.Duration, []*time.Location, error) {
+	if q.From.IsZero() || q.To.IsZero() || !q.To.After(q.From) {
+		return 0, nil, fmt.Errorf("from and to are required and to must be after from")
+	}
+	if q.To.Sub(q.From) > maxRange {
+		return 0, nil, fmt.Errorf("the range can't be longer than %v days", int(maxRange.Hours()/24))
+	}
+	var d time.Duration
+	if q.Duration != "" {
+		var err error
+		d, err = time.ParseDuration(q.Duration)
+		if err != nil || d <= 0 {
+			return 0, nil, fmt.Errorf("duration must be a positive duration, eg: 30m")
+		}
+	}
+	if q.WorkingHours != nil {
+		start, end, err := q.WorkingHours.parse()
+		if err != nil {
+			return 0, nil, fmt.Errorf("working hours must be HH:MM clock times")
+		}
+		if !start.Before(end) {
+			return 0, nil, fmt.Errorf("working hours must start before they end")
+		}
+	}
+	locs := make([]*time.Location, 0, len(q.TimeZones))
+	for _, tz := range q.TimeZones {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return 0, nil, fmt.Errorf("unknown time zone %q", tz)
+		}
+		locs = append(locs, loc)
+	}
+	if len(locs) == 0 {
+		locs = append(locs, time.UTC)
+	}
+	return d, locs, nil
+}
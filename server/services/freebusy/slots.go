@@ -0,0 +1,159 @@
+package freebusy
+
+import (
+	"sort"
+	"time"
+)
+
+// Interval is a span of time, Start inclusive and End exclusive
+type Interval struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// WorkingHours is the part of the day, in every time zone of the query, where slots can be suggested. Start and End are "15:04" clock times.
+type WorkingHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// clock is a time of the day
+type clock struct {
+	hour, min int
+}
+
+func (c clock) Before(o clock) bool {
+	return c.hour < o.hour || c.hour == o.hour && c.min < o.min
+}
+
+// on is the clock on the given day, days when the clocks change aren't 24 hours long so it can't be an offset from midnight
+func (c clock) on(y int, m time.Month, d int, loc *time.Location) time.Time {
+	return time.Date(y, m, d, c.hour, c.min, 0, 0, loc)
+}
+
+func (wh WorkingHours) parse() (start, end clock, err error) {
+	s, err := time.Parse("15:04", wh.Start)
+	if err != nil {
+		return clock{}, clock{}, err
+	}
+	e, err := time.Parse("15:04", wh.End)
+	if err != nil {
+		return clock{}, clock{}, err
+	}
+	return clock{s.Hour(), s.Minute()}, clock{e.Hour(), e.Minute()}, nil
+}
+
+// mergeIntervals sorts the intervals and merges the ones that overlap or touch
+func mergeIntervals(intervals []Interval) []Interval {
+	if len(intervals) == 0 {
+		return []Interval{}
+	}
+	sorted := make([]Interval, len(intervals))
+	copy(sorted, intervals)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start.Before(sorted[j].Start) })
+	merged := []Interval{sorted[0]}
+	for _, in := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if !in.Start.After(last.End) {
+			if in.End.After(last.End) {
+				last.End = in.End
+			}
+			continue
+		}
+		merged = append(merged, in)
+	}
+	return merged
+}
+
+// freeIntervals returns the gaps between the merged busy intervals within [from, to)
+func freeIntervals(busy []Interval, from, to time.Time) []Interval {
+	free := make([]Interval, 0)
+	cursor := from
+	for _, b := range busy {
+		if !b.End.After(cursor) {
+			continue
+		}
+		if !b.Start.Before(to) {
+			break
+		}
+		if b.Start.After(cursor) {
+			free = append(free, Interval{Start: cursor, End: b.Start})
+		}
+		cursor = b.End
+	}
+	if cursor.Before(to) {
+		free = append(free, Interval{Start: cursor, End: to})
+	}
+	return free
+}
+
+// workingIntervals returns the working hours of every day in [from, to) in the given location
+func workingIntervals(from, to time.Time, loc *time.Location, startOfDay, endOfDay clock) []Interval {
+	res := make([]Interval, 0)
+	f := from.In(loc)
+	day := time.Date(f.Year(), f.Month(), f.Day(), 0, 0, 0, 0, loc)
+	for day.Before(to) {
+		y, m, d := day.Date()
+		start := startOfDay.on(y, m, d, loc)
+		end := endOfDay.on(y, m, d, loc)
+		if end.After(from) && start.Before(to) {
+			res = append(res, Interval{Start: maxTime(start, from), End: minTime(end, to)})
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return res
+}
+
+// intersect returns the spans covered by both lists, both must be sorted and without overlaps
+func intersect(a, b []Interval) []Interval {
+	res := make([]Interval, 0)
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		start := maxTime(a[i].Start, b[j].Start)
+		end := minTime(a[i].End, b[j].End)
+		if start.Before(end) {
+			res = append(res, Interval{Start: start, End: end})
+		}
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return res
+}
+
+// FindSlots returns the free intervals of at least d within [from, to) that fall in the working hours of every location
+func FindSlots(busy []Interval, from, to time.Time, d time.Duration, wh *WorkingHours, locs []*time.Location) ([]Interval, error) {
+	free := freeIntervals(mergeIntervals(busy), from, to)
+	if wh != nil {
+		startOfDay, endOfDay, err := wh.parse()
+		if err != nil {
+			return nil, err
+		}
+		for _, loc := range locs {
+			free = intersect(free, workingIntervals(from, to, loc, startOfDay, endOfDay))
+		}
+	}
+	slots := make([]Interval, 0)
+	for _, f := range free {
+		if f.End.Sub(f.Start) >= d {
+			slots = append(slots, Interval{Start: f.Start.UTC(), End: f.End.UTC()})
+		}
+	}
+	return slots, nil
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
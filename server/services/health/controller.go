@@ -0,0 +1,43 @@
+package health
+
+import (
+	"net/http"
+
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+// NewController returns the controller of the probes, showErrors tells whether a request can see why checks failed (they can
+// mention internal hosts), everyone sees the status of each check
+func NewController(healthServ *Service, showErrors func(r *http.Request) bool, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "HealthController")
+	return &Controller{serv: healthServ, showErrors: showErrors, log: l}
+}
+
+type Controller struct {
+	log        *zap.SugaredLogger
+	serv       *Service
+	showErrors func(r *http.Request) bool
+}
+
+// Healthz handles GET /healthz, the liveness probe: it only tells the server answers requests
+func (c *Controller) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	auth.WriteJSON(w, 200, map[string]string{"status": StatusOK})
+}
+
+// Readyz handles GET /readyz, the readiness probe: 200 if every check passes, 503 if any fails or the server is shutting down
+func (c *Controller) Readyz(w http.ResponseWriter, r *http.Request) {
+	report := c.serv.Ready(r.Context())
+	if !c.showErrors(r) {
+		for _, res := range report.Checks {
+			res.Error = ""
+		}
+	}
+	status := 200
+	if report.Status != StatusOK {
+		status = 503
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	auth.WriteJSON(w, status, report)
+}
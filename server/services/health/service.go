@@ -0,0 +1,147 @@
+// Package health tells whether the server is alive and whether it can serve: the dependencies it needs respond and it's not
+// shutting down.
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// checkTimeout is how long a check can take before it counts as failed
+const checkTimeout = 2 * time.Second
+
+// Check tells whether a dependency works, it should give up when ctx is done
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a check
+type Result struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+	// CheckedAt is when the check ran, checks with a ttl can be older than the report
+	CheckedAt time.Time `json:"checkedAt"`
+	Cached    bool      `json:"cached,omitempty"`
+}
+
+// Report is the outcome of every readiness check
+type Report struct {
+	Status       string             `json:"status"`
+	ShuttingDown bool               `json:"shuttingDown,omitempty"`
+	Checks       map[string]*Result `json:"checks"`
+}
+
+type check struct {
+	name  string
+	ttl   time.Duration
+	check Check
+	// last is the last result, reused while it's younger than ttl
+	mu   sync.Mutex
+	last *Result
+}
+
+type Service struct {
+	logger       *zap.SugaredLogger
+	checks       []*check
+	shuttingDown atomic.Bool
+}
+
+func NewService(logger *zap.SugaredLogger) *Service {
+	l := logger.With("service", "HealthService")
+	return &Service{logger: l}
+}
+
+// Add registers a readiness check. Checks with a ttl reuse their last result for that long, use it for dependencies that shouldn't
+// be asked on every probe (eg: google). Call it before serving.
+func (s *Service) Add(name string, ttl time.Duration, c Check) {
+	s.checks = append(s.checks, &check{name: name, ttl: ttl, check: c})
+}
+
+// ShutDown makes the server unready for good, so it stops getting new requests while it drains the ones it has
+func (s *Service) ShutDown() {
+	s.shuttingDown.Store(true)
+}
+
+// Ready runs every check at once, the server is ready if they all pass and it's not shutting down
+func (s *Service) Ready(ctx context.Context) *Report {
+	report := &Report{Status: StatusOK, Checks: make(map[string]*Result, len(s.checks))}
+	if s.shuttingDown.Load() {
+		report.Status = StatusFail
+		report.ShuttingDown = true
+		return report
+	}
+	results := make([]*Result, len(s.checks))
+	var wg sync.WaitGroup
+	for i, c := range s.checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			results[i] = c.run(ctx)
+		}(i, c)
+	}
+	wg.Wait()
+	for i, c := range s.checks {
+		report.Checks[c.name] = results[i]
+		if results[i].Status != StatusOK {
+			report.Status = StatusFail
+			if !results[i].Cached {
+				s.logger.Warnw("readiness check failed: "+results[i].Error, "check", c.name)
+			}
+		}
+	}
+	return report
+}
+
+func (c *check) run(ctx context.Context) *Result {
+	// concurrent probes wait for the one running the check instead of running it again
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.last != nil && time.Since(c.last.CheckedAt) < c.ttl {
+		cached := *c.last
+		cached.Cached = true
+		return &cached
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.check(ctx)
+	res := &Result{Status: StatusOK, Duration: time.Since(start).Round(time.Millisecond).String(), CheckedAt: start}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+	c.last = res
+	// callers get their own copy, the controller edits it
+	out := *res
+	return &out
+}
+
+// Reachable returns a check that passes if url answers at all, any status below 500 will do (eg: a 405 from an endpoint that
+// only takes POST)
+func Reachable(client *http.Client, url string) Check {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode >= 500 {
+			return fmt.Errorf("%v answered %v", url, res.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,183 @@
+package mirrors
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gabzim/meetings/server/calendarsync"
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"go.uber.org/zap"
+)
+
+func NewController(mirrorsServ *Service, authServ *auth.Service, log *zap.SugaredLogger) *Controller {
+	l := log.With("controller", "MirrorsController")
+	return &Controller{serv: mirrorsServ, auth: authServ, log: l}
+}
+
+type Controller struct {
+	log  *zap.SugaredLogger
+	serv *Service
+	auth *auth.Service
+}
+
+type createMirrorRequest struct {
+	SourceCalendar string             `json:"sourceCalendar"`
+	TargetEmail    string             `json:"targetEmail"`
+	TargetCalendar string             `json:"targetCalendar"`
+	Rule           *calendarsync.Rule `json:"rule"`
+	// DryRun returns the changes the mirror would make instead of creating it
+	DryRun bool `json:"dryRun"`
+}
+
+// Mirrors handles GET /api/v1/mirrors to list the mirrors the user is part of and POST /api/v1/mirrors to mirror one of its calendars
+func (c *Controller) Mirrors(w http.ResponseWriter, r *http.Request) {
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok || !auth.RequireCapability(w, user, auth.CapabilityAdmin) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		mirrors, err := c.serv.List(user)
+		if err != nil {
+			c.log.Errorf("could not list mirrors: %v", err)
+			w.WriteHeader(500)
+			return
+		}
+		auth.WriteJSON(w, 200, mirrors)
+	case http.MethodPost:
+		var req createMirrorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Invalid body: %v", err)
+			return
+		}
+		if req.TargetEmail == "" {
+			req.TargetEmail = user.Email
+		}
+		if req.SourceCalendar == "" {
+			req.SourceCalendar = "primary"
+		}
+		if req.TargetCalendar == "" {
+			req.TargetCalendar = "primary"
+		}
+		if !user.AllowsCalendar(req.SourceCalendar) {
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "This token can't read calendar %v", req.SourceCalendar)
+			return
+		}
+		if req.DryRun {
+			changes, err := c.serv.DryRun(r.Context(), user, req.SourceCalendar, req.TargetEmail, req.TargetCalendar, req.Rule)
+			if c.writeCreateError(w, req, err) {
+				return
+			}
+			auth.WriteJSON(w, 200, map[string]interface{}{"changes": changes})
+			return
+		}
+		m, err := c.serv.Create(user, req.SourceCalendar, req.TargetEmail, req.TargetCalendar, req.Rule)
+		if c.writeCreateError(w, req, err) {
+			return
+		}
+		c.auth.Audit(auth.Origin(r, user), user, audit.ActionMirrorCreate, audit.OutcomeSuccess,
+			fmt.Sprintf("mirror %v: %v into %v of %v", m.Id, m.SourceCalendar, m.TargetCalendar, m.TargetEmail))
+		auth.WriteJSON(w, 201, m)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// writeCreateError answers with the error creating the mirror, if there's one
+func (c *Controller) writeCreateError(w http.ResponseWriter, req createMirrorRequest, err error) bool {
+	if err == nil {
+		return false
+	}
+	var ruleErr *RuleError
+	if auth.WriteScopeError(w, err) {
+		return true
+	} else if errors.As(err, &ruleErr) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid rule: %v", ruleErr.Err)
+	} else if errors.Is(err, auth.ErrUserNotFound) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "There's no user with email %v", req.TargetEmail)
+	} else if errors.Is(err, ErrSameCalendar) {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "A calendar can't be mirrored into itself")
+	} else if errors.Is(err, ErrCalendarNotAllowed) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "This token can't write into calendar %v", req.TargetCalendar)
+	} else {
+		c.log.Errorf("could not create mirror: %v", err)
+		w.WriteHeader(500)
+	}
+	return true
+}
+
+// Mirror handles POST /api/v1/mirrors/<id>/accept, which the owner of the target calendar uses to start the mirror, and
+// DELETE /api/v1/mirrors/<id>, which stops it and removes its upcoming blocks
+func (c *Controller) Mirror(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/mirrors/")
+	accept := strings.HasSuffix(path, "/accept")
+	if accept && r.Method != http.MethodPost || !accept && r.Method != http.MethodDelete {
+		w.WriteHeader(405)
+		return
+	}
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok || !auth.RequireCapability(w, user, auth.CapabilityAdmin) {
+		return
+	}
+	id, err := strconv.ParseInt(strings.TrimSuffix(path, "/accept"), 10, 64)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "Invalid mirror id")
+		return
+	}
+	if accept {
+		c.accept(w, r, user, id)
+		return
+	}
+	err = c.serv.Delete(user, id)
+	if errors.Is(err, ErrMirrorNotFound) {
+		c.auth.Audit(auth.Origin(r, user), user, audit.ActionMirrorDelete, audit.OutcomeFailure, fmt.Sprintf("mirror %v not found", id))
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Mirror not found")
+		return
+	} else if err != nil {
+		c.log.Errorf("could not delete mirror: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionMirrorDelete, audit.OutcomeSuccess, fmt.Sprintf("mirror %v", id))
+	w.WriteHeader(204)
+}
+
+func (c *Controller) accept(w http.ResponseWriter, r *http.Request, user *auth.UserToken, id int64) {
+	m, err := c.serv.Accept(user, id)
+	if auth.WriteScopeError(w, err) {
+		return
+	} else if errors.Is(err, ErrMirrorNotFound) {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Mirror not found")
+		return
+	} else if errors.Is(err, ErrNotTarget) {
+		c.auth.Audit(auth.Origin(r, user), user, audit.ActionMirrorAccept, audit.OutcomeDenied, fmt.Sprintf("mirror %v", id))
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Only the owner of the target calendar can accept the mirror")
+		return
+	} else if errors.Is(err, ErrCalendarNotAllowed) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "This token can't use the target calendar of the mirror")
+		return
+	} else if err != nil {
+		c.log.Errorf("could not accept mirror: %v", err)
+		w.WriteHeader(500)
+		return
+	}
+	c.auth.Audit(auth.Origin(r, user), user, audit.ActionMirrorAccept, audit.OutcomeSuccess,
+		fmt.Sprintf("mirror %v: %v of %v", m.Id, m.SourceCalendar, m.SourceEmail))
+	auth.WriteJSON(w, 200, m)
+}
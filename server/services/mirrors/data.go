@@ -0,0 +1,135 @@
+package mirrors
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gabzim/meetings/server/calendarsync"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrMirrorNotFound = errors.New("MIRROR_NOT_FOUND")
+
+// Mirror writes a private busy block into the target calendar for every event that makes the source calendar busy. The calendars can belong
+// to different users, the owner of the target calendar has to accept the mirror before any block is written.
+type Mirror struct {
+	Id             int64      `db:"id" json:"id"`
+	SourceUserId   int64      `db:"source_user_id" json:"-"`
+	SourceEmail    string     `db:"source_email" json:"sourceEmail"`
+	SourceCalendar string     `db:"source_calendar" json:"sourceCalendar"`
+	TargetUserId   int64      `db:"target_user_id" json:"-"`
+	TargetEmail    string     `db:"target_email" json:"targetEmail"`
+	TargetCalendar string     `db:"target_calendar" json:"targetCalendar"`
+	CreatedAt      time.Time  `db:"created_at" json:"createdAt"`
+	AcceptedAt     *time.Time `db:"accepted_at" json:"acceptedAt,omitempty"`
+	// RuleRaw is the copy rule as json, mirrors without one write busy blocks
+	RuleRaw string             `db:"rule" json:"-"`
+	Rule    *calendarsync.Rule `db:"-" json:"rule,omitempty"`
+	// Status is filled by the service: pending, running or stopped
+	Status string `db:"-" json:"status"`
+	// Error is why a stopped mirror stopped
+	Error string `db:"-" json:"error,omitempty"`
+	// Conflicts are the copies that weren't updated because both them and their events were edited
+	Conflicts []*calendarsync.Change `db:"-" json:"conflicts,omitempty"`
+}
+
+// ParseRule decodes the copy rule stored with the mirror, nil if it writes busy blocks
+func (m *Mirror) ParseRule() (*calendarsync.Rule, error) {
+	if m.RuleRaw == "" {
+		return nil, nil
+	}
+	var rule calendarsync.Rule
+	err := json.Unmarshal([]byte(m.RuleRaw), &rule)
+	return &rule, err
+}
+
+func (m *Mirror) SetRule(rule *calendarsync.Rule) error {
+	m.Rule = rule
+	if rule == nil {
+		m.RuleRaw = ""
+		return nil
+	}
+	b, err := json.Marshal(rule)
+	m.RuleRaw = string(b)
+	return err
+}
+
+// Store keeps the mirrors, MirrorStore implements it on postgres and sqlite
+type Store interface {
+	Insert(m *Mirror) error
+	SelectById(id int64) (*Mirror, error)
+	// SelectByUser returns the mirrors the user is the source or the target of
+	SelectByUser(userId int64) ([]*Mirror, error)
+	SelectAccepted() ([]*Mirror, error)
+	// Accept marks the mirror with the given id and target as accepted
+	Accept(id, targetUserId int64, at time.Time) error
+	// Delete deletes the mirror with the given id if the user is its source or its target
+	Delete(id, userId int64) error
+}
+
+type MirrorStore struct {
+	db *sqlx.DB
+}
+
+func NewMirrorStore(db *sqlx.DB) *MirrorStore {
+	return &MirrorStore{db}
+}
+
+// selectMirrors joins the emails of both users
+const selectMirrors = `SELECT m.id, m.source_user_id, s.email AS source_email, m.source_calendar, m.target_user_id, t.email AS target_email, m.target_calendar,
+	m.created_at, m.accepted_at, m.rule FROM mirrors m JOIN user_tokens s ON s.id = m.source_user_id JOIN user_tokens t ON t.id = m.target_user_id`
+
+func (s *MirrorStore) Insert(m *Mirror) error {
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = time.Now()
+	}
+	return s.db.Get(&m.Id, "INSERT INTO mirrors (source_user_id, source_calendar, target_user_id, target_calendar, created_at, accepted_at, rule) VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id",
+		m.SourceUserId, m.SourceCalendar, m.TargetUserId, m.TargetCalendar, m.CreatedAt, m.AcceptedAt, m.RuleRaw)
+}
+
+func (s *MirrorStore) SelectById(id int64) (*Mirror, error) {
+	m := Mirror{}
+	err := s.db.Get(&m, selectMirrors+" WHERE m.id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMirrorNotFound
+	}
+	return &m, err
+}
+
+func (s *MirrorStore) SelectByUser(userId int64) ([]*Mirror, error) {
+	mirrors := make([]*Mirror, 0)
+	err := s.db.Select(&mirrors, selectMirrors+" WHERE m.source_user_id = $1 OR m.target_user_id = $1 ORDER BY m.id", userId)
+	return mirrors, err
+}
+
+func (s *MirrorStore) SelectAccepted() ([]*Mirror, error) {
+	mirrors := make([]*Mirror, 0)
+	err := s.db.Select(&mirrors, selectMirrors+" WHERE m.accepted_at IS NOT NULL ORDER BY m.id")
+	return mirrors, err
+}
+
+func (s *MirrorStore) Accept(id, targetUserId int64, at time.Time) error {
+	res, err := s.db.Exec("UPDATE mirrors SET accepted_at = $1 WHERE id = $2 AND target_user_id = $3 AND accepted_at IS NULL", at, id, targetUserId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrMirrorNotFound
+	}
+	return err
+}
+
+func (s *MirrorStore) Delete(id, userId int64) error {
+	res, err := s.db.Exec("DELETE FROM mirrors WHERE id = $1 AND (source_user_id = $2 OR target_user_id = $2)", id, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err == nil && n == 0 {
+		return ErrMirrorNotFound
+	}
+	return err
+}
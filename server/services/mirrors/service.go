@@ -0,0 +1,636 @@
+// Package mirrors runs the calendar mirrors of the users: the events that make a calendar busy are copied as private busy blocks into
+// another calendar, maybe of another google account, or copied following a rule. Mirrors follow their calendars through their webhooks,
+// see calendarsync.
+package mirrors
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gabzim/meetings/server/calendarsync"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/notifications"
+	"go.uber.org/zap"
+	"google.golang.org/api/calendar/v3"
+)
+
+// statuses of a mirror
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusStopped = "stopped"
+)
+
+var (
+	// ErrNotTarget is returned when someone other than the owner of the target calendar accepts a mirror
+	ErrNotTarget = errors.New("NOT_THE_TARGET_OF_THE_MIRROR")
+	// ErrSameCalendar is returned when a calendar is mirrored into itself
+	ErrSameCalendar = errors.New("A_CALENDAR_CANT_BE_MIRRORED_INTO_ITSELF")
+	// ErrCalendarNotAllowed is returned when the token creating or accepting a mirror can't use its calendars
+	ErrCalendarNotAllowed = errors.New("CALENDAR_NOT_ALLOWED")
+)
+
+// RuleError is returned when the rule of a mirror isn't valid
+type RuleError struct {
+	Err error
+}
+
+func (e *RuleError) Error() string {
+	return "invalid rule: " + e.Err.Error()
+}
+
+func (e *RuleError) Unwrap() error {
+	return e.Err
+}
+
+type Service struct {
+	logger *zap.SugaredLogger
+	store  Store
+	auth   *auth.Service
+	notif  *notifications.Service
+	// running are the runners of the accepted mirrors by id, stopped ones stay until the mirror is deleted or started again
+	mu      sync.Mutex
+	running map[int64]*runner
+}
+
+func NewService(logger *zap.SugaredLogger, store Store, authServ *auth.Service, notifServ *notifications.Service) *Service {
+	l := logger.With("service", "MirrorsService")
+	s := &Service{logger: l, store: store, auth: authServ, notif: notifServ, running: make(map[int64]*runner)}
+	authServ.OnGrantRevoked(s.stopMirrorsOf)
+	authServ.OnUserDeleting(s.deleteMirrorsOf)
+	return s
+}
+
+// Start runs every accepted mirror, it's called once when the server starts
+func (s *Service) Start() error {
+	accepted, err := s.store.SelectAccepted()
+	if err != nil {
+		return err
+	}
+	for _, m := range accepted {
+		s.start(m)
+	}
+	return nil
+}
+
+// Stop stops every running mirror when the server shuts down, the next server to start runs them again
+func (s *Service) Stop() {
+	s.mu.Lock()
+	stopping := make([]*runner, 0, len(s.running))
+	for _, r := range s.running {
+		stopping = append(stopping, r)
+	}
+	s.mu.Unlock()
+	for _, r := range stopping {
+		r.stop(nil)
+	}
+}
+
+// List returns the mirrors the user is the source or the target of
+func (s *Service) List(t *auth.UserToken) ([]*Mirror, error) {
+	userMirrors, err := s.store.SelectByUser(t.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range userMirrors {
+		s.fillStatus(m)
+	}
+	return userMirrors, nil
+}
+
+// Create mirrors sourceCalendar of the user into targetCalendar of the user with targetEmail, as busy blocks or as copies if there's a
+// rule. A mirror between two calendars of the same user starts right away, it needs auth.FeatureMirror. Otherwise it waits for the
+// target to accept it.
+func (s *Service) Create(t *auth.UserToken, sourceCalendar, targetEmail, targetCalendar string, rule *calendarsync.Rule) (*Mirror, error) {
+	m, err := s.newMirror(t, sourceCalendar, targetEmail, targetCalendar, rule)
+	if err != nil {
+		return nil, err
+	}
+	if m.TargetUserId == t.Id {
+		now := time.Now()
+		m.AcceptedAt = &now
+	}
+	if err := s.store.Insert(m); err != nil {
+		return nil, err
+	}
+	s.logger.Infow("mirror created", "email", t.Email, "mirror", m.Id, "target", m.TargetEmail)
+	if m.AcceptedAt != nil {
+		s.start(m)
+	}
+	s.fillStatus(m)
+	return m, nil
+}
+
+// DryRun returns what Create would write right now without creating the mirror. The target calendar is only read if it's the
+// user's, so into the calendar of another user every event is planned as an insert and two way rules only plan the source calendar.
+func (s *Service) DryRun(ctx context.Context, t *auth.UserToken, sourceCalendar, targetEmail, targetCalendar string, rule *calendarsync.Rule) ([]*calendarsync.Change, error) {
+	m, err := s.newMirror(t, sourceCalendar, targetEmail, targetCalendar, rule)
+	if err != nil {
+		return nil, err
+	}
+	return s.plan(ctx, m, m.TargetUserId == t.Id)
+}
+
+// Plan returns what the mirror with the given id would write right now, it's what meetings-server mirror-plan prints
+func (s *Service) Plan(ctx context.Context, id int64) (*Mirror, []*calendarsync.Change, error) {
+	m, err := s.store.SelectById(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := s.plan(ctx, m, true)
+	return m, changes, err
+}
+
+// newMirror checks the mirror the user asks for, before it's created
+func (s *Service) newMirror(t *auth.UserToken, sourceCalendar, targetEmail, targetCalendar string, rule *calendarsync.Rule) (*Mirror, error) {
+	if sourceCalendar == "" {
+		sourceCalendar = "primary"
+	}
+	if targetCalendar == "" {
+		targetCalendar = "primary"
+	}
+	if rule != nil {
+		if err := rule.Validate(); err != nil {
+			return nil, &RuleError{Err: err}
+		}
+	}
+	target, err := s.auth.GetUserByEmail(targetEmail)
+	if err != nil {
+		return nil, err
+	}
+	if target.Id == t.Id && sourceCalendar == targetCalendar {
+		return nil, ErrSameCalendar
+	}
+	// the copies back of two way rules are written into the source calendar, and the blocks into the target one if it's the user's
+	if !t.AllowsCalendar(sourceCalendar) || target.Id == t.Id && !t.AllowsCalendar(targetCalendar) {
+		return nil, ErrCalendarNotAllowed
+	}
+	m := &Mirror{SourceUserId: t.Id, SourceEmail: t.Email, SourceCalendar: sourceCalendar, TargetUserId: target.Id, TargetEmail: target.Email, TargetCalendar: targetCalendar}
+	if err := m.SetRule(rule); err != nil {
+		return nil, err
+	}
+	// the user writes into its own calendars if the target is one of them, or for the copies back of two way rules
+	if target.Id == t.Id || rule != nil && rule.TwoWay {
+		if err := t.RequireFeature(auth.FeatureMirror); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// plan returns the changes that would bring the mirror up to date, without the target calendar the copies in it are unknown
+func (s *Service) plan(ctx context.Context, m *Mirror, readTarget bool) ([]*calendarsync.Change, error) {
+	rule, err := m.ParseRule()
+	if err != nil {
+		return nil, err
+	}
+	source, err := s.auth.GetUser(m.SourceUserId)
+	if err != nil {
+		return nil, err
+	}
+	sourceSrv, err := s.auth.CalendarService(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	target := &auth.UserToken{Id: m.TargetUserId, Email: m.TargetEmail}
+	var targetSrv *calendar.Service
+	if readTarget {
+		if target, err = s.auth.GetUser(m.TargetUserId); err != nil {
+			return nil, err
+		}
+		if targetSrv, err = s.auth.CalendarService(ctx, target); err != nil {
+			return nil, err
+		}
+	}
+	forward, reverse := syncers(m, rule, source, target, sourceSrv, targetSrv)
+	events, err := calendarsync.UpcomingEvents(ctx, sourceSrv, m.SourceCalendar)
+	if err != nil {
+		return nil, err
+	}
+	var copies []*calendar.Event
+	if targetSrv != nil {
+		if copies, err = forward.Copies(ctx); err != nil {
+			return nil, err
+		}
+	}
+	changes, err := forward.Plan(ctx, events, copies)
+	if err != nil || reverse == nil || targetSrv == nil {
+		return changes, err
+	}
+	targetEvents, err := calendarsync.UpcomingEvents(ctx, targetSrv, m.TargetCalendar)
+	if err != nil {
+		return nil, err
+	}
+	if copies, err = reverse.Copies(ctx); err != nil {
+		return nil, err
+	}
+	back, err := reverse.Plan(ctx, targetEvents, copies)
+	return append(changes, back...), err
+}
+
+// syncers returns the syncer writing into the target calendar and, for two way rules, the one writing into the source calendar
+func syncers(m *Mirror, rule *calendarsync.Rule, source, target *auth.UserToken, sourceSrv, targetSrv *calendar.Service) (forward, reverse *calendarsync.Syncer) {
+	forward = calendarsync.NewSyncer(mirrorKey(m), target, targetSrv, m.TargetCalendar)
+	if rule == nil {
+		return forward, nil
+	}
+	forward.CopyWith(rule)
+	if rule.TwoWay {
+		reverse = calendarsync.NewSyncer(mirrorKey(m), source, sourceSrv, m.SourceCalendar)
+		reverse.CopyWith(rule)
+	}
+	return forward, reverse
+}
+
+// Accept starts a mirror into a calendar of the user, it needs auth.FeatureMirror
+func (s *Service) Accept(t *auth.UserToken, id int64) (*Mirror, error) {
+	m, err := s.store.SelectById(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.TargetUserId != t.Id {
+		if m.SourceUserId == t.Id {
+			return nil, ErrNotTarget
+		}
+		return nil, ErrMirrorNotFound
+	}
+	if !t.AllowsCalendar(m.TargetCalendar) {
+		return nil, ErrCalendarNotAllowed
+	}
+	if err := t.RequireFeature(auth.FeatureMirror); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if m.AcceptedAt == nil {
+		if err := s.store.Accept(id, t.Id, now); err != nil {
+			return nil, err
+		}
+		m.AcceptedAt = &now
+		s.logger.Infow("mirror accepted", "email", t.Email, "mirror", m.Id)
+	}
+	// accepting a stopped mirror again (eg: after granting access) starts it
+	s.start(m)
+	s.fillStatus(m)
+	return m, nil
+}
+
+// Delete stops the mirror and deletes its upcoming blocks, either user can delete it
+func (s *Service) Delete(t *auth.UserToken, id int64) error {
+	m, err := s.store.SelectById(id)
+	if err != nil {
+		return err
+	}
+	if err := s.store.Delete(id, t.Id); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	r := s.running[id]
+	delete(s.running, id)
+	s.mu.Unlock()
+	if r != nil {
+		r.stop(nil)
+	}
+	s.logger.Infow("mirror deleted", "email", t.Email, "mirror", id)
+	if m.AcceptedAt != nil {
+		go s.removeBlocksLater(m, 0)
+	}
+	return nil
+}
+
+// removeBlocksLater removes the blocks of the mirror in the background, see removeBlocks
+func (s *Service) removeBlocksLater(m *Mirror, skipUserId int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	s.removeBlocks(ctx, m, skipUserId)
+}
+
+// removeBlocks deletes the blocks or copies the mirror wrote from now on, except the ones in the calendars of the user with id skipUserId
+func (s *Service) removeBlocks(ctx context.Context, m *Mirror, skipUserId int64) {
+	rule, _ := m.ParseRule()
+	userIds, calendarIds := []int64{m.TargetUserId}, []string{m.TargetCalendar}
+	if rule != nil && rule.TwoWay {
+		userIds, calendarIds = append(userIds, m.SourceUserId), append(calendarIds, m.SourceCalendar)
+	}
+	for i, calendarId := range calendarIds {
+		if userIds[i] == skipUserId {
+			continue
+		}
+		user, err := s.auth.GetUser(userIds[i])
+		if err != nil {
+			s.logger.Errorw("could not remove the blocks of the mirror: "+err.Error(), "mirror", m.Id)
+			continue
+		}
+		srv, err := s.auth.CalendarService(ctx, user)
+		if err == nil {
+			err = calendarsync.NewSyncer(mirrorKey(m), user, srv, calendarId).RemoveAll(ctx)
+		}
+		if err != nil {
+			s.logger.Errorw("could not remove the blocks of the mirror: "+err.Error(), "mirror", m.Id, "email", user.Email)
+		}
+	}
+}
+
+// start runs the mirror, unless it's running already
+func (s *Service) start(m *Mirror) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.running[m.Id]; ok && r.err() == nil {
+		return
+	}
+	r := &runner{serv: s, mirror: m, wake: make(chan struct{}, 1), done: make(chan struct{})}
+	s.running[m.Id] = r
+	go r.run()
+}
+
+// stopMirrorsOf stops the mirrors the user is the source or the target of, its google grant was revoked. Their blocks in the calendars
+// of the other users are removed since nothing keeps them up to date anymore, accepting the mirror again writes them back.
+func (s *Service) stopMirrorsOf(t *auth.UserToken) {
+	s.mu.Lock()
+	stopping := make([]*runner, 0)
+	for _, r := range s.running {
+		if (r.mirror.SourceUserId == t.Id || r.mirror.TargetUserId == t.Id) && r.err() == nil {
+			stopping = append(stopping, r)
+		}
+	}
+	s.mu.Unlock()
+	for _, r := range stopping {
+		r.stop(auth.ErrGrantRevoked)
+		// the calendars of the user can't be written without its grant
+		go s.removeBlocksLater(r.mirror, t.Id)
+	}
+}
+
+// deleteMirrorsOf stops the mirrors the user is the source or the target of and removes their blocks, the user is being deleted and its
+// mirrors go with it. It runs before its grant is revoked so the blocks in its own calendars are removed too.
+func (s *Service) deleteMirrorsOf(ctx context.Context, t *auth.UserToken) {
+	userMirrors, err := s.store.SelectByUser(t.Id)
+	if err != nil {
+		s.logger.Errorw("could not stop the mirrors of deleted user: "+err.Error(), "email", t.Email)
+		return
+	}
+	for _, m := range userMirrors {
+		s.mu.Lock()
+		r := s.running[m.Id]
+		delete(s.running, m.Id)
+		s.mu.Unlock()
+		if r != nil {
+			r.stop(nil)
+		}
+		if m.AcceptedAt != nil {
+			s.removeBlocks(ctx, m, 0)
+		}
+	}
+}
+
+func (s *Service) fillStatus(m *Mirror) {
+	m.Rule, _ = m.ParseRule()
+	if m.AcceptedAt == nil {
+		m.Status = StatusPending
+		return
+	}
+	s.mu.Lock()
+	r, ok := s.running[m.Id]
+	s.mu.Unlock()
+	if !ok {
+		m.Status = StatusStopped
+		return
+	}
+	m.Conflicts = r.conflicts()
+	if err := r.err(); err != nil {
+		m.Status = StatusStopped
+		m.Error = err.Error()
+		return
+	}
+	m.Status = StatusRunning
+}
+
+// mirrorKey identifies the blocks of the mirror in the target calendar
+func mirrorKey(m *Mirror) string {
+	return strconv.FormatInt(m.Id, 10)
+}
+
+// runner follows the calendars of a mirror and writes its blocks or copies. It subscribes to the source calendar, and to the target
+// calendar for two way rules. Events are queued so the webhooks forwarding them don't wait for google.
+type runner struct {
+	serv   *Service
+	mirror *Mirror
+	mu     sync.Mutex
+	subIds []string
+	queue  []queued
+	// forward writes into the target calendar, reverse into the source calendar for two way rules
+	forward *calendarsync.Syncer
+	reverse *calendarsync.Syncer
+	// stopErr is why it stopped, errStopped if it was stopped on purpose
+	stopErr error
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+type queued struct {
+	reverse bool
+	e       *calendar.Event
+}
+
+var errStopped = errors.New("STOPPED")
+
+func (r *runner) run() {
+	log := r.serv.logger.With("mirror", r.mirror.Id)
+	rule, err := r.mirror.ParseRule()
+	if err != nil {
+		r.stop(err)
+		return
+	}
+	source, err := r.serv.auth.GetUser(r.mirror.SourceUserId)
+	if err != nil {
+		r.stop(err)
+		return
+	}
+	target, err := r.serv.auth.GetUser(r.mirror.TargetUserId)
+	if err != nil {
+		r.stop(err)
+		return
+	}
+	if err := target.RequireFeature(auth.FeatureMirror); err != nil {
+		r.stop(err)
+		return
+	}
+	if rule != nil && rule.TwoWay {
+		if err := source.RequireFeature(auth.FeatureMirror); err != nil {
+			r.stop(err)
+			return
+		}
+	}
+	ctx := context.Background()
+	sourceSrv, err := r.serv.auth.CalendarService(ctx, source)
+	if err != nil {
+		r.stop(err)
+		return
+	}
+	targetSrv, err := r.serv.auth.CalendarService(ctx, target)
+	if err != nil {
+		r.stop(err)
+		return
+	}
+	forward, reverse := syncers(r.mirror, rule, source, target, sourceSrv, targetSrv)
+	r.mu.Lock()
+	r.forward, r.reverse = forward, reverse
+	r.mu.Unlock()
+	// subscribe first so nothing that changes while reconciling is missed
+	if !r.subscribe(source, r.mirror.SourceCalendar, false) {
+		return
+	}
+	if reverse != nil && !r.subscribe(target, r.mirror.TargetCalendar, true) {
+		return
+	}
+	// catch up with what changed while the mirror wasn't running
+	if err := reconcile(ctx, forward, sourceSrv, r.mirror.SourceCalendar); err != nil {
+		log.Errorf("could not reconcile the mirror: %v", err)
+	}
+	if reverse != nil {
+		if err := reconcile(ctx, reverse, targetSrv, r.mirror.TargetCalendar); err != nil {
+			log.Errorf("could not reconcile the mirror into its source: %v", err)
+		}
+	}
+	if conflicts := r.conflicts(); len(conflicts) > 0 {
+		log.Warnf("mirror has %v conflicts", len(conflicts))
+	}
+	log.Infow("mirror running", "source", source.Email, "target", target.Email)
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-r.wake:
+		}
+		for _, q := range r.take() {
+			syncer, writer := forward, target
+			if q.reverse {
+				syncer, writer = reverse, source
+			}
+			err := syncer.SyncEvent(ctx, q.e)
+			if errors.Is(err, auth.ErrInsufficientScope) {
+				log.Warnw("mirror stopped, a user didn't grant access to write events", "email", writer.Email)
+				r.stop(err)
+				return
+			} else if err != nil {
+				log.Errorw("could not sync event: "+err.Error(), "event", q.e.Id)
+			}
+		}
+	}
+}
+
+// subscribe follows the calendar of the user, it returns false if the runner is stopped
+func (r *runner) subscribe(t *auth.UserToken, calendarName string, reverse bool) bool {
+	subId, err := r.serv.notif.Subscribe(t, calendarName, nil, listener{r: r, reverse: reverse})
+	if err != nil {
+		r.stop(err)
+		return false
+	}
+	r.mu.Lock()
+	r.subIds = append(r.subIds, subId)
+	stopped := r.stopErr != nil
+	r.mu.Unlock()
+	if stopped {
+		r.serv.notif.Unsubscribe(subId)
+		return false
+	}
+	return true
+}
+
+func reconcile(ctx context.Context, syncer *calendarsync.Syncer, srv *calendar.Service, calendarId string) error {
+	events, err := calendarsync.UpcomingEvents(ctx, srv, calendarId)
+	if err != nil {
+		return err
+	}
+	return syncer.Reconcile(ctx, events)
+}
+
+// take empties the queue
+func (r *runner) take() []queued {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := r.queue
+	r.queue = nil
+	return events
+}
+
+func (r *runner) enqueue(reverse bool, e *calendar.Event) {
+	r.mu.Lock()
+	r.queue = append(r.queue, queued{reverse: reverse, e: e})
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// conflicts are the copies the runner left alone because both them and their events were edited
+func (r *runner) conflicts() []*calendarsync.Change {
+	r.mu.Lock()
+	forward, reverse := r.forward, r.reverse
+	r.mu.Unlock()
+	conflicts := make([]*calendarsync.Change, 0)
+	if forward != nil {
+		conflicts = append(conflicts, forward.Conflicts()...)
+	}
+	if reverse != nil {
+		conflicts = append(conflicts, reverse.Conflicts()...)
+	}
+	return conflicts
+}
+
+// stop stops following the calendars, err is why (nil if it was stopped on purpose)
+func (r *runner) stop(err error) {
+	if err == nil {
+		err = errStopped
+	}
+	r.mu.Lock()
+	if r.stopErr != nil {
+		r.mu.Unlock()
+		return
+	}
+	r.stopErr = err
+	subIds := r.subIds
+	r.subIds = nil
+	r.mu.Unlock()
+	close(r.done)
+	for _, subId := range subIds {
+		// it can be called from the notifications run loop (a revoked grant), don't wait for it
+		go r.serv.notif.Unsubscribe(subId)
+	}
+	if err != errStopped {
+		r.serv.logger.Warnw("mirror stopped: "+err.Error(), "mirror", r.mirror.Id)
+	}
+}
+
+// err is why the runner stopped, nil if it's running
+func (r *runner) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stopErr
+}
+
+// listener queues the events of one of the calendars of a mirror for its runner
+type listener struct {
+	r       *runner
+	reverse bool
+}
+
+func (l listener) SendEvent(subscriptionId string, e *calendar.Event) {
+	l.r.enqueue(l.reverse, e)
+}
+
+// SendError stops the runner, the subscription is removed by notifications
+func (l listener) SendError(subscriptionId string, err error) {
+	l.r.mu.Lock()
+	for i, id := range l.r.subIds {
+		if id == subscriptionId {
+			l.r.subIds = append(l.r.subIds[:i], l.r.subIds[i+1:]...)
+			break
+		}
+	}
+	l.r.mu.Unlock()
+	l.r.stop(err)
+}
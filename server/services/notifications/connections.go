@@ -0,0 +1,77 @@
+package notifications
+
+import (
+	"sort"
+	"time"
+)
+
+// ConnectionInfo describes an open websocket connection of a user
+type ConnectionInfo struct {
+	// Device is empty for clients that didn't identify their device
+	Device       string
+	Protocol     int
+	RemoteAddr   string
+	ConnectedAt  time.Time
+	LastActivity time.Time
+	// Calendars the connection is subscribed to
+	Calendars []string
+}
+
+// WatchedCalendar is a calendar of a user someone is subscribed to
+type WatchedCalendar struct {
+	Calendar      string
+	Subscriptions int
+	// WebhookRunning is true while google pushes the changes of the calendar to us
+	WebhookRunning bool
+}
+
+func (s *Service) trackConnection(c *wsClient) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns[c] = struct{}{}
+}
+
+func (s *Service) untrackConnection(c *wsClient) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, c)
+}
+
+// Connections returns the open websocket connections of the user, oldest first
+func (s *Service) Connections(email string) []ConnectionInfo {
+	s.connsMu.RLock()
+	res := make([]ConnectionInfo, 0)
+	for c := range s.conns {
+		if c.t.Email == email {
+			res = append(res, c.info())
+		}
+	}
+	s.connsMu.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ConnectedAt.Before(res[j].ConnectedAt)
+	})
+	return res
+}
+
+// WatchedCalendars returns the calendars of the user with at least one subscription (websocket or grpc)
+func (s *Service) WatchedCalendars(email string) []WatchedCalendar {
+	counts := make(map[string]int)
+	s.subsMu.RLock()
+	for _, sub := range s.subscriptions {
+		if sub.t.Email == email {
+			counts[sub.calendarName]++
+		}
+	}
+	s.subsMu.RUnlock()
+	res := make([]WatchedCalendar, 0, len(counts))
+	s.clientsMu.RLock()
+	for cal, n := range counts {
+		whWithClients, ok := s.clients[email+"_"+cal]
+		res = append(res, WatchedCalendar{Calendar: cal, Subscriptions: n, WebhookRunning: ok && whWithClients.IsRunning()})
+	}
+	s.clientsMu.RUnlock()
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Calendar < res[j].Calendar
+	})
+	return res
+}
@@ -1,18 +1,20 @@
 package notifications
 
 import (
-	"errors"
 	"fmt"
 	"github.com/gabzim/meetings/server/services/auth"
 	"github.com/gorilla/websocket"
 	"go.uber.org/zap"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	// browsers sending their token as a subprotocol need one back or they drop the connection
+	Subprotocols: []string{auth.Subprotocol},
 }
 
 func NewController(notifServ *Service, authServ *auth.Service, log *zap.SugaredLogger) *Controller {
@@ -26,25 +28,35 @@ type Controller struct {
 	auth *auth.Service
 }
 
+// RegisterClient upgrades the request to a websocket, see auth.AuthenticateRequest for the ways clients can authenticate
 func (c *Controller) RegisterClient(w http.ResponseWriter, r *http.Request) {
-	t := r.URL.Query().Get("token")
-	email := r.URL.Query().Get("email")
 	calendarName := r.URL.Query().Get("calendar")
+	device := r.URL.Query().Get("device")
+	protocol := ProtocolLegacy
+	if r.URL.Query().Get("protocol") == strconv.Itoa(ProtocolV2) {
+		protocol = ProtocolV2
+	}
+
+	user, ok := c.auth.Authenticate(w, r)
+	if !ok {
+		return
+	}
 
-	user, err := c.auth.AuthenticateUser(email, t)
-	if errors.Is(err, auth.ErrUserNotFound) {
-		w.WriteHeader(404)
-		fmt.Fprintf(w, "User not found")
-		c.log.Errorf("could not authenticate user: %v", err)
+	if user.NeedsReconsent {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "Google access was revoked, sign in again at /auth/google")
 		return
-	} else if errors.Is(err, auth.ErrTokenInvalid) {
-		w.WriteHeader(401)
-		fmt.Fprintf(w, "Token provided is not valid")
-		c.log.Errorf("could not authenticate user: %v", err)
+	}
+	if !auth.RequireCapability(w, user, auth.CapabilityWebhook) {
+		return
+	}
+	if (protocol == ProtocolLegacy || calendarName != "") && !user.AllowsCalendar(calendarName) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "This token can't read calendar %v", calendarName)
 		return
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, w.Header())
 	if err != nil {
 		c.log.Errorf("could not upgrade connection: %v", err)
 		w.WriteHeader(400)
@@ -52,7 +64,7 @@ func (c *Controller) RegisterClient(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	c.serv.RegisterClient(user, calendarName, conn)
+	c.serv.RegisterClient(user, ClientOptions{Calendar: calendarName, Protocol: protocol, Device: device, Origin: auth.Origin(r, user)}, conn)
 }
 
 func (c *Controller) ReceivePushFromGoogle(w http.ResponseWriter, req *http.Request) {
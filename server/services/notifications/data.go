@@ -0,0 +1,78 @@
+package notifications
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gabzim/meetings/server/calendarwh"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/api/calendar/v3"
+)
+
+// Store keeps the snapshots of the calendars being watched so a restarted server can resume them, SnapshotStore implements it on postgres and sqlite
+type Store interface {
+	// SelectSnapshot returns nil (and no error) if there's no snapshot of the calendar
+	SelectSnapshot(userId int64, calendarName string) (*calendarwh.Snapshot, error)
+	UpsertSnapshot(userId int64, calendarName string, s *calendarwh.Snapshot) error
+	// DeleteSnapshotsBefore deletes the snapshots synced before t
+	DeleteSnapshotsBefore(t time.Time) error
+}
+
+type SnapshotStore struct {
+	db *sqlx.DB
+}
+
+func NewSnapshotStore(db *sqlx.DB) *SnapshotStore {
+	return &SnapshotStore{db}
+}
+
+type snapshotRow struct {
+	SyncToken string    `db:"sync_token"`
+	Events    string    `db:"events"`
+	SyncedAt  time.Time `db:"synced_at"`
+}
+
+func (s *SnapshotStore) SelectSnapshot(userId int64, calendarName string) (*calendarwh.Snapshot, error) {
+	row := snapshotRow{}
+	err := s.db.Get(&row, "SELECT sync_token, events, synced_at FROM event_snapshots WHERE user_id = $1 AND calendar = $2", userId, calendarName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshot := &calendarwh.Snapshot{SyncToken: row.SyncToken, SyncedAt: row.SyncedAt, Events: make([]*calendar.Event, 0)}
+	return snapshot, json.Unmarshal([]byte(row.Events), &snapshot.Events)
+}
+
+func (s *SnapshotStore) UpsertSnapshot(userId int64, calendarName string, snapshot *calendarwh.Snapshot) error {
+	events, err := json.Marshal(snapshot.Events)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO event_snapshots (user_id, calendar, sync_token, events, synced_at) VALUES ($1,$2,$3,$4,$5)
+		ON CONFLICT (user_id, calendar) DO UPDATE SET sync_token = excluded.sync_token, events = excluded.events, synced_at = excluded.synced_at`,
+		userId, calendarName, snapshot.SyncToken, string(events), snapshot.SyncedAt)
+	return err
+}
+
+func (s *SnapshotStore) DeleteSnapshotsBefore(t time.Time) error {
+	_, err := s.db.Exec("DELETE FROM event_snapshots WHERE synced_at < $1", t)
+	return err
+}
+
+// calendarSnapshots is the snapshot of one calendar of a user in the store, it's what its webhook persists to
+type calendarSnapshots struct {
+	store        Store
+	userId       int64
+	calendarName string
+}
+
+func (c *calendarSnapshots) LoadSnapshot() (*calendarwh.Snapshot, error) {
+	return c.store.SelectSnapshot(c.userId, c.calendarName)
+}
+
+func (c *calendarSnapshots) SaveSnapshot(s *calendarwh.Snapshot) error {
+	return c.store.UpsertSnapshot(c.userId, c.calendarName, s)
+}
@@ -0,0 +1,162 @@
+package notifications
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// defaultMaxUnacked is how many deliveries we keep per device, when a device goes over it the oldest ones are dropped
+	defaultMaxUnacked = 1000
+	// defaultUnackedTTL is how long we keep a device outbox around after its last connection closed
+	defaultUnackedTTL = 24 * time.Hour
+)
+
+var unackedEvents = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "unacked_events",
+	Help: "Number of events delivered to devices that haven't acknowledged them yet",
+})
+
+// outbox keeps the event frames sent to a device until it acknowledges them, so they can be redelivered if the device
+// reconnects after the socket died with events in flight. Sequence numbers are per device and keep growing across connections,
+// a device has one connection open at a time.
+type outbox struct {
+	mu      sync.Mutex
+	lastSeq uint64
+	pending []*Frame
+	// conn is the connection of the device currently open and lastSeen when the last one closed, used to expire outboxes of devices
+	// that never come back
+	conn     *wsClient
+	lastSeen time.Time
+	// max and ttl are the limits of the outboxes it belongs to
+	max int
+	ttl time.Duration
+}
+
+// add assigns the next sequence number to the frame and keeps it until it's acked, it returns nil if c isn't the connection of the device
+func (o *outbox) add(c *wsClient, f *Frame) *Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn != c {
+		return nil
+	}
+	o.lastSeq++
+	f.Seq = o.lastSeq
+	o.pending = append(o.pending, f)
+	unackedEvents.Inc()
+	if len(o.pending) > o.max {
+		o.pending = o.pending[1:]
+		unackedEvents.Dec()
+	}
+	return f
+}
+
+// ack drops every pending frame up to seq (inclusive), acks are cumulative
+func (o *outbox) ack(seq uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	i := 0
+	for i < len(o.pending) && o.pending[i].Seq <= seq {
+		i++
+	}
+	o.pending = o.pending[i:]
+	unackedEvents.Sub(float64(i))
+}
+
+// unacked returns copies of the pending frames of the calendar flagged as redelivered. Subscription ids don't outlive their
+// connection, the copies carry subscriptionId, the subscription of the new connection for the same calendar.
+func (o *outbox) unacked(calendarName, subscriptionId string) []*Frame {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	res := make([]*Frame, 0)
+	for _, f := range o.pending {
+		if f.calendar != calendarName {
+			continue
+		}
+		redelivery := *f
+		redelivery.Subscription = subscriptionId
+		redelivery.Redelivered = true
+		res = append(res, &redelivery)
+	}
+	return res
+}
+
+// attach hands the outbox to a new connection of the device, it returns the connection it had if it's still open. A device whose
+// socket died may reconnect before the server notices, the newest connection wins.
+func (o *outbox) attach(c *wsClient) *wsClient {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	prev := o.conn
+	o.conn = c
+	return prev
+}
+
+// detach takes the outbox from c, unless a newer connection of the device took it already
+func (o *outbox) detach(c *wsClient) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.conn != c {
+		return
+	}
+	o.conn = nil
+	o.lastSeen = time.Now()
+}
+
+func (o *outbox) expired() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.conn == nil && time.Since(o.lastSeen) > o.ttl
+}
+
+func (o *outbox) size() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.pending)
+}
+
+// outboxes indexes outboxes by device identity (email + device id the client chose)
+type outboxes struct {
+	mu  sync.Mutex
+	all map[string]*outbox
+	// max is how many deliveries each outbox keeps and ttl how long it's kept after the last connection of its device closed,
+	// the defaults are used if they're 0
+	max int
+	ttl time.Duration
+}
+
+// get returns the outbox of the device, creating it if needed
+func (b *outboxes) get(email, device string) *outbox {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.all == nil {
+		b.all = make(map[string]*outbox)
+	}
+	key := email + "_" + device
+	o, ok := b.all[key]
+	if !ok {
+		o = &outbox{max: b.max, ttl: b.ttl}
+		if o.max == 0 {
+			o.max = defaultMaxUnacked
+		}
+		if o.ttl == 0 {
+			o.ttl = defaultUnackedTTL
+		}
+		b.all[key] = o
+	}
+	return o
+}
+
+// cleanup forgets outboxes of devices that haven't connected in their ttl
+func (b *outboxes) cleanup() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, o := range b.all {
+		if o.expired() {
+			unackedEvents.Sub(float64(o.size()))
+			delete(b.all, key)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package notifications
+
+import (
+	"github.com/gabzim/meetings/server/eventfilter"
+	"google.golang.org/api/calendar/v3"
+)
+
+// Websocket protocols. Legacy connections get a single subscription and raw calendar events written to the socket, anything the client sends is discarded.
+// V2 connections exchange Command and Frame messages, so a single socket can subscribe to several calendars and change filters on the fly.
+const (
+	ProtocolLegacy = 1
+	ProtocolV2     = 2
+)
+
+// commands clients send over a V2 connection
+const (
+	CommandSubscribe     = "subscribe"
+	CommandUnsubscribe   = "unsubscribe"
+	CommandUpdateFilters = "update-filters"
+	CommandPing          = "ping"
+	// CommandAck acknowledges every event frame up to Seq, only for connections that identify their device
+	CommandAck = "ack"
+)
+
+// frames the server sends over a V2 connection
+const (
+	FrameAck   = "ack"
+	FrameError = "error"
+	FramePong  = "pong"
+	FrameEvent = "event"
+)
+
+// ErrorReauthRequired is the code of the error frame sent when google rejects the user credentials, the user needs to sign in again
+const ErrorReauthRequired = "reauth_required"
+
+// CloseReauthRequired is the close code legacy connections get for the same reason, they can't receive error frames
+const CloseReauthRequired = 4001
+
+// CloseDeviceReplaced is the close code of the connection of a device that connected again, the newest connection gets its unacked events
+const CloseDeviceReplaced = 4009
+
+// Command is a message sent by the client. Id is chosen by the client and echoed back in the ack/error that answers it.
+type Command struct {
+	Type string `json:"type"`
+	Id   string `json:"id,omitempty"`
+	// Calendar to subscribe to, used by subscribe
+	Calendar string `json:"calendar,omitempty"`
+	// Subscription id returned in the ack of a subscribe, used by unsubscribe and update-filters
+	Subscription string              `json:"subscription,omitempty"`
+	Filters      *eventfilter.Filter `json:"filters,omitempty"`
+	// Seq of the last event frame received, used by ack
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// Frame is a message sent by the server, either an answer to a Command or an event for one of the subscriptions.
+type Frame struct {
+	Type         string `json:"type"`
+	Id           string `json:"id,omitempty"`
+	Subscription string `json:"subscription,omitempty"`
+	Error        string `json:"error,omitempty"`
+	// Code is a machine readable reason for some errors, eg: ErrorReauthRequired
+	Code  string          `json:"code,omitempty"`
+	Event *calendar.Event `json:"event,omitempty"`
+	// Seq numbers event frames sent to connections that identify their device, they must be acked with CommandAck
+	// or they will be redelivered (with Redelivered set) when the device reconnects.
+	Seq         uint64 `json:"seq,omitempty"`
+	Redelivered bool   `json:"redelivered,omitempty"`
+	// calendar of the subscription of an event frame, it's redelivered to the subscription for the same calendar of the next connection
+	calendar string
+}
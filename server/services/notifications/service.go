@@ -1,21 +1,32 @@
 package notifications
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/gabzim/meetings/server/calendarwh"
+	"github.com/gabzim/meetings/server/eventfilter"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"go.uber.org/zap"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gabzim/meetings/server/services/audit"
 	"github.com/gabzim/meetings/server/services/auth"
-	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
 )
 
 const (
 	pongWait  = 45 * time.Second
 	writeWait = 20 * time.Second
+	// snapshotWait is how long a new subscriber waits for the webhook to start before asking google for the events itself
+	snapshotWait = 10 * time.Second
+	// maxConnectionSubscriptions is how many subscriptions a websocket connection can have, each one can start a webhook
+	maxConnectionSubscriptions = 50
 )
 
 var (
@@ -30,39 +41,105 @@ var (
 	})
 )
 
+var ErrSubscriptionNotFound = errors.New("SUBSCRIPTION_NOT_FOUND")
+
+// ErrShuttingDown is sent to every listener when the server shuts down, and returned to the ones subscribing after that
+var ErrShuttingDown = errors.New("SERVER_SHUTTING_DOWN")
+
+// ErrTooManySubscriptions is returned when a connection subscribes more than maxConnectionSubscriptions times
+var ErrTooManySubscriptions = fmt.Errorf("TOO_MANY_SUBSCRIPTIONS: a connection can have up to %v", maxConnectionSubscriptions)
+
+// unregistration asks the run loop to remove a subscription, done (if set) is closed once it's removed and its webhook stopped if it was the last one
+type unregistration struct {
+	id   string
+	done chan struct{}
+}
+
 type Service struct {
 	logger *zap.SugaredLogger
-	// cfg oauth config, used by NewWsClient so each ws clients can have a calendar service to query their calendars
-	cfg        *oauth2.Config
-	clients    map[string]*webhookWithClients
-	register   chan *wsClient
-	unregister chan *wsClient
-	hostURL    string
+	// authServ gives each subscription a calendar service to query the calendars of its user
+	authServ *auth.Service
+	clients  map[string]*webhookWithClients
+	// clientsMu guards clients, the run loop is the only writer but http handlers read it
+	clientsMu sync.RWMutex
+	// subscriptions indexes every registered subscription by its id
+	subscriptions map[string]*subscription
+	subsMu        sync.RWMutex
+	register      chan *subscription
+	unregister    chan unregistration
+	hostURL       string
+	// outboxes keep unacked events per device so they can be redelivered
+	outboxes outboxes
+	// conns are the open websocket connections
+	conns   map[*wsClient]struct{}
+	connsMu sync.RWMutex
+	// snapshots persists the events of the calendars being watched, nil keeps them in memory only
+	snapshots Store
+	// pings are picked up by the run loop, see Ping
+	pings chan struct{}
+	// shuttingDown is set by Shutdown, no one can connect or subscribe after that
+	shuttingDown atomic.Bool
 }
 
 // NewService returns new notificationServ
-func NewService(logger *zap.SugaredLogger, cfg *oauth2.Config, url string) *Service {
+func NewService(logger *zap.SugaredLogger, authServ *auth.Service, url string) *Service {
 	l := logger.With("notificationServ", "NotificationService")
 	serv := &Service{
-		cfg:        cfg,
-		clients:    make(map[string]*webhookWithClients, 0),
-		register:   make(chan *wsClient, 1),
-		unregister: make(chan *wsClient, 1),
-		logger:     l,
-		hostURL:    url,
+		authServ:      authServ,
+		clients:       make(map[string]*webhookWithClients, 0),
+		subscriptions: make(map[string]*subscription),
+		conns:         make(map[*wsClient]struct{}),
+		register:      make(chan *subscription, 1),
+		unregister:    make(chan unregistration, 1),
+		pings:         make(chan struct{}),
+		logger:        l,
+		hostURL:       url,
 	}
 
+	authServ.OnGrantRevoked(serv.dropSubscriptionsOf)
 	go serv.run()
 
 	return serv
 }
 
+// PersistSnapshots keeps the events of the calendars being watched in store too, so after a restart they're served right away and google
+// is only asked for what changed. Call it before anyone subscribes.
+func (s *Service) PersistSnapshots(store Store) {
+	s.snapshots = store
+}
+
+// LimitOutboxes changes how many unacked events are kept per device (max) and for how long after the device disconnects (ttl).
+// Call it before anyone connects.
+func (s *Service) LimitOutboxes(max int, ttl time.Duration) {
+	s.outboxes.max = max
+	s.outboxes.ttl = ttl
+}
+
+// Ping fails if the run loop doesn't pick it up before ctx is done, eg: it's stuck registering a subscription
+func (s *Service) Ping(ctx context.Context) error {
+	select {
+	case s.pings <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the run loop didn't respond: %w", ctx.Err())
+	}
+}
+
 func (s *Service) run() {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
 	for {
 		select {
 		case c := <-s.register:
+			s.subsMu.RLock()
+			_, stillSubscribed := s.subscriptions[c.id]
+			s.subsMu.RUnlock()
+			if !stillSubscribed {
+				// it was unsubscribed before we got to register it
+				continue
+			}
 			s.logger.Infow("registering new clients\n", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
 			calServ := c.GetCalendarService()
 			emailAndCalName := c.GetEmailAndCalendar()
@@ -70,16 +147,27 @@ func (s *Service) run() {
 			if !ok {
 				// no webhook set up for this email + calendar. Set it up and add clients to the list of listeners
 				whWithClients = &webhookWithClients{
-					logger: s.logger,
-					base:   s.hostURL + "/push/",
+					logger:    s.logger,
+					base:      s.hostURL + "/push/",
+					snapshots: s.snapshots,
 				}
+				s.clientsMu.Lock()
 				s.clients[emailAndCalName] = whWithClients
+				s.clientsMu.Unlock()
 			}
 			// there's already a webhook set up with at least one clients, add this clients to the list and continue
 			whWithClients.AddClient(c)
 			go func() {
-				twoWeeks := time.Now().Add(14 * 24 * time.Hour)
-				events, err := calServ.Events.List(c.calendarName).MaxResults(2500).SingleEvents(true).TimeMin(time.Now().Format(time.RFC3339)).TimeMax(twoWeeks.Format(time.RFC3339)).Do()
+				// the webhook already has the events if it was running or its snapshot was restored, google is only asked otherwise
+				whWithClients.waitStarted(snapshotWait)
+				if events, ok := whWithClients.Snapshot(); ok {
+					for _, e := range events {
+						c.SendEvent(e)
+					}
+					return
+				}
+				until := time.Now().Add(calendarwh.Window)
+				events, err := calServ.Events.List(c.calendarName).MaxResults(2500).SingleEvents(true).TimeMin(time.Now().Format(time.RFC3339)).TimeMax(until.Format(time.RFC3339)).Do()
 				if err != nil {
 					s.logger.Errorw("error sending events to recently registerd clients:"+err.Error(), "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
 					return
@@ -89,61 +177,262 @@ func (s *Service) run() {
 				}
 			}()
 			s.updateCounters()
-		case c := <-s.unregister:
-			s.logger.Infow("unregistering clients\n", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
-			emailAndCal := c.GetEmailAndCalendar()
-			whWithClients, ok := s.clients[emailAndCal]
-			if !ok {
-				s.logger.Errorw("we couldn't find any webhook with clients while unregistering this clients", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
-				continue
-			}
-			isEmpty, err := whWithClients.RemoveClient(c)
-			if err != nil {
-				s.logger.Errorw("we couldn't find an entry in the webhook with clients for the clients being unregistered", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
-				continue
-			}
-			if isEmpty {
-				delete(s.clients, emailAndCal)
+		case u := <-s.unregister:
+			s.unsubscribe(u.id)
+			if u.done != nil {
+				close(u.done)
 			}
-			s.updateCounters()
+		case <-s.pings:
 		case <-ticker.C:
 			s.updateCounters()
+		case <-cleanup.C:
+			s.outboxes.cleanup()
+			if s.snapshots != nil {
+				// they're too old to resume from
+				if err := s.snapshots.DeleteSnapshotsBefore(time.Now().Add(-calendarwh.MaxSnapshotAge)); err != nil {
+					s.logger.Errorw("could not delete old snapshots", "error", err)
+				}
+			}
 		}
 	}
 }
 
+// unsubscribe removes a subscription and stops its webhook if no one else is listening to it, only the run loop calls it
+func (s *Service) unsubscribe(id string) {
+	s.subsMu.Lock()
+	c, ok := s.subscriptions[id]
+	delete(s.subscriptions, id)
+	s.subsMu.Unlock()
+	if !ok {
+		return
+	}
+	s.logger.Infow("unregistering clients\n", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
+	emailAndCal := c.GetEmailAndCalendar()
+	whWithClients, ok := s.clients[emailAndCal]
+	if !ok {
+		s.logger.Errorw("we couldn't find any webhook with clients while unregistering this clients", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
+		return
+	}
+	isEmpty, err := whWithClients.RemoveClient(c)
+	if err != nil {
+		s.logger.Errorw("we couldn't find an entry in the webhook with clients for the clients being unregistered", "email", c.t.Email, "calendar", c.calendarName, "id", c.id)
+		return
+	}
+	if isEmpty {
+		s.clientsMu.Lock()
+		delete(s.clients, emailAndCal)
+		s.clientsMu.Unlock()
+	}
+	s.updateCounters()
+}
+
 func (s *Service) updateCounters() {
 	webhooksCount := len(s.clients)
 	webhooksOn.Set(float64(webhooksCount))
-	i := 0
-	for _, wh := range s.clients {
-		i += len(wh.clients)
+	s.subsMu.RLock()
+	clientsConnected.Set(float64(len(s.subscriptions)))
+	s.subsMu.RUnlock()
+}
+
+// ClientOptions describe how a websocket client wants to be served
+type ClientOptions struct {
+	// Calendar to subscribe to right away, required for ProtocolLegacy
+	Calendar string
+	// Protocol is ProtocolLegacy or ProtocolV2
+	Protocol int
+	// Device identifies the client across connections (eg: "office-pi"). When set on a ProtocolV2 connection, event frames are numbered
+	// and kept until the client acks them, unacked ones are redelivered next time a connection for the same email + device subscribes to
+	// their calendar. A device has one connection open at a time, when it connects again the previous connection is closed with
+	// CloseDeviceReplaced.
+	Device string
+	// Origin is who opened the connection and from where, the connection and disconnection are recorded in the audit log with it
+	Origin audit.Origin
+}
+
+// RegisterClient Register a websocket clients to receive event notifications.
+// With ProtocolLegacy the connection gets a single subscription for the calendar, with ProtocolV2 the client can manage its subscriptions
+// sending commands.
+func (s *Service) RegisterClient(token *auth.UserToken, opts ClientOptions, conn *websocket.Conn) {
+	if s.shuttingDown.Load() {
+		msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+		conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+		conn.Close()
+		return
 	}
-	clientsConnected.Set(float64(i))
+	var o *outbox
+	if opts.Protocol == ProtocolV2 && opts.Device != "" {
+		o = s.outboxes.get(token.Email, opts.Device)
+	}
+	NewWsClient(s, token, conn, opts.Calendar, opts.Protocol, opts.Device, opts.Origin, o)
+}
+
+// Subscribe registers a listener for the events of the given calendar that pass filter (nil for all of them),
+// the listener gets every event until Unsubscribe is called with the returned id. Events only carry the fields the token of the user can see,
+// and it fails with auth.ErrCalendarNotAllowed if the token can't read the calendar, or auth.ErrGrantRevoked if the user has to sign in again.
+func (s *Service) Subscribe(token *auth.UserToken, calendarName string, filter *eventfilter.Filter, listener Listener) (string, error) {
+	sub, err := s.newSubscription(token, calendarName, filter, listener)
+	if err != nil {
+		return "", err
+	}
+	s.register <- sub
+	return sub.id, nil
+}
+
+// newSubscription indexes a subscription without handing it to the run loop, it gets no events until it's sent to s.register
+func (s *Service) newSubscription(token *auth.UserToken, calendarName string, filter *eventfilter.Filter, listener Listener) (*subscription, error) {
+	if s.shuttingDown.Load() {
+		return nil, ErrShuttingDown
+	}
+	if !token.AllowsCalendar(calendarName) {
+		return nil, auth.ErrCalendarNotAllowed
+	}
+	if !token.AllowsFields(filter.Fields()) {
+		return nil, auth.ErrFieldNotAllowed
+	}
+	if token.NeedsReconsent {
+		return nil, auth.ErrGrantRevoked
+	}
+	calServ, err := s.authServ.CalendarService(context.Background(), token)
+	if err != nil {
+		return nil, err
+	}
+	sub := &subscription{
+		id:           generateId(),
+		t:            token,
+		calendarName: calendarName,
+		calendarServ: calServ,
+		listener:     listener,
+		filter:       filter,
+	}
+	// index it right away so it can be updated even before the run loop picks it up
+	s.subsMu.Lock()
+	s.subscriptions[sub.id] = sub
+	s.subsMu.Unlock()
+	return sub, nil
+}
+
+// Unsubscribe stops sending events to the subscription with the given id, if it was the last one listening to a calendar its webhook is stopped.
+func (s *Service) Unsubscribe(id string) {
+	s.unregister <- unregistration{id: id}
+}
+
+// UpdateFilter replaces the filter of a subscription, the events sent from now on will be the ones that pass it
+func (s *Service) UpdateFilter(id string, filter *eventfilter.Filter) error {
+	s.subsMu.RLock()
+	sub, ok := s.subscriptions[id]
+	s.subsMu.RUnlock()
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	if !sub.t.AllowsFields(filter.Fields()) {
+		return auth.ErrFieldNotAllowed
+	}
+	sub.SetFilter(filter)
+	return nil
+}
+
+// dropSubscriptionsOf tells every listener of the user that its google grant was revoked and removes their subscriptions,
+// they can't get any more events until the user signs in again.
+func (s *Service) dropSubscriptionsOf(t *auth.UserToken) {
+	// this can be called from the run loop itself (stopping a webhook refreshes the token), so don't wait for it
+	s.dropSubscriptions(t.Email, auth.ErrGrantRevoked, false)
 }
 
-// RegisterClient Register a clients to receive event notifications, returns an id of the clients
-func (s *Service) RegisterClient(token *auth.UserToken, calendarName string, conn *websocket.Conn) string {
-	c := NewWsClient(s, token, conn, calendarName)
-	s.register <- c
-	return c.id
+// dropSubscriptions sends reason to the listeners of every subscription of the user and removes them. If wait is true it returns once
+// they're removed and the webhooks no one else was listening to are stopped.
+func (s *Service) dropSubscriptions(email string, reason error, wait bool) {
+	s.subsMu.RLock()
+	dropped := make([]*subscription, 0)
+	for _, sub := range s.subscriptions {
+		if sub.t.Email == email {
+			dropped = append(dropped, sub)
+		}
+	}
+	s.subsMu.RUnlock()
+	for _, sub := range dropped {
+		sub.listener.SendError(sub.id, reason)
+		if !wait {
+			s.Unsubscribe(sub.id)
+			continue
+		}
+		done := make(chan struct{})
+		s.unregister <- unregistration{id: sub.id, done: done}
+		<-done
+	}
 }
 
-// UnregisterClient unregister a clients using its id. (We could improve complexity, maybe index by id)
-func (s *Service) UnregisterClient(clientId string) error {
-	// find clients to unregister
-	for _, clientsForEmailAndCAl := range s.clients {
-		c, ok := clientsForEmailAndCAl.clients[clientId]
-		if ok {
-			s.unregister <- c
+// DisconnectUser drops every subscription of the user, stops the google channels of its calendars and closes its websocket connections.
+// Listeners get reason as their error.
+func (s *Service) DisconnectUser(email string, reason error) {
+	s.dropSubscriptions(email, reason, true)
+	s.connsMu.RLock()
+	closing := make([]*wsClient, 0)
+	for c := range s.conns {
+		if c.t.Email == email {
+			closing = append(closing, c)
 		}
 	}
-	return fmt.Errorf("id not found among registered clients")
+	s.connsMu.RUnlock()
+	for _, c := range closing {
+		c.Close()
+	}
+}
+
+// Shutdown closes every websocket connection with a going away close frame, so clients reconnect to another server, tells the
+// other listeners (grpc streams, mirrors) with ErrShuttingDown and stops the google channels of every calendar. It returns once they're
+// stopped, or with the error of ctx if it's done first. The http server doesn't wait for websockets, they're hijacked connections.
+func (s *Service) Shutdown(ctx context.Context) error {
+	s.shuttingDown.Store(true)
+	s.connsMu.RLock()
+	closing := make([]*wsClient, 0, len(s.conns))
+	for c := range s.conns {
+		closing = append(closing, c)
+	}
+	s.connsMu.RUnlock()
+	for _, c := range closing {
+		c.closeWith(websocket.CloseGoingAway, "server shutting down")
+	}
+	s.subsMu.RLock()
+	dropped := make([]*subscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		dropped = append(dropped, sub)
+	}
+	s.subsMu.RUnlock()
+	for _, sub := range dropped {
+		sub.listener.SendError(sub.id, ErrShuttingDown)
+		done := make(chan struct{})
+		select {
+		case s.unregister <- unregistration{id: sub.id, done: done}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	s.logger.Infow("notifications stopped", "connections", len(closing), "subscriptions", len(dropped))
+	return nil
+}
+
+// Snapshot returns the current events of a calendar as known by its running webhook and how far ahead it has all of them, ok is false
+// if no one is subscribed to it or the webhook hasn't synced yet.
+func (s *Service) Snapshot(email, calendarName string) (events []*calendar.Event, until time.Time, ok bool) {
+	s.clientsMu.RLock()
+	whWithClients, ok := s.clients[email+"_"+calendarName]
+	s.clientsMu.RUnlock()
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	return whWithClients.SnapshotUntil()
 }
 
 // DispatchPushToClients We received a notification from google hitting our ws. Dispatch it to the right webhook
 func (s *Service) DispatchPushToClients(w http.ResponseWriter, req *http.Request, emailAndCalendar string) {
+	s.clientsMu.RLock()
 	whWithClients, ok := s.clients[emailAndCalendar]
+	s.clientsMu.RUnlock()
 	if ok {
 		whWithClients.wh.Handler(w, req)
 		return
@@ -0,0 +1,56 @@
+package notifications
+
+import (
+	"sync"
+
+	"github.com/gabzim/meetings/server/eventfields"
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/gabzim/meetings/server/services/auth"
+	"google.golang.org/api/calendar/v3"
+)
+
+// Listener is whoever receives the events of a subscription, a websocket connection or a grpc stream.
+// It receives the id of the subscription so a connection with several subscriptions can tell them apart.
+type Listener interface {
+	// SendEvent must not block for long, it's called from the goroutine forwarding events to every listener of the calendar
+	SendEvent(subscriptionId string, e *calendar.Event)
+	// SendError tells the listener the subscription can't go on (eg: ErrGrantRevoked), it's unsubscribed right after
+	SendError(subscriptionId string, err error)
+}
+
+// subscription is a listener for the events of a calendar. Several subscriptions for the same email + calendar share the same webhook.
+type subscription struct {
+	id           string
+	t            *auth.UserToken
+	calendarName string
+	calendarServ *calendar.Service
+	listener     Listener
+	// filter can be updated by the client while events are being forwarded
+	mu     sync.RWMutex
+	filter *eventfilter.Filter
+}
+
+func (s *subscription) GetCalendarService() *calendar.Service {
+	return s.calendarServ
+}
+
+func (s *subscription) GetEmailAndCalendar() string {
+	return s.t.Email + "_" + s.calendarName
+}
+
+// SendEvent forwards the event to the listener if it passes the subscription filter
+func (s *subscription) SendEvent(e *calendar.Event) {
+	s.mu.RLock()
+	f := s.filter
+	s.mu.RUnlock()
+	if !f.Match(e) {
+		return
+	}
+	s.listener.SendEvent(s.id, eventfields.Project(e, s.t.EventFields()))
+}
+
+func (s *subscription) SetFilter(f *eventfilter.Filter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.filter = f
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"github.com/gabzim/meetings/server/calendarwh"
 	"go.uber.org/zap"
+	"google.golang.org/api/calendar/v3"
+	"sync"
+	"time"
 )
 
 // a webhook is an endpoint where google calendar pushes updates to us. Multiple web socket connections can subscribe to it.
@@ -14,31 +17,45 @@ type webhookWithClients struct {
 	base   string
 	// the webhook where google will push updates
 	wh *calendarwh.CalendarWebHookManaged
-	// the web socket clients to whom we must forward the updates that come from google
-	clients map[string]*wsClient
+	// the subscriptions (web socket or grpc clients) to whom we must forward the updates that come from google
+	clients map[string]*subscription
+	// started is closed once the last start of the webhook returned
+	started chan struct{}
+	// snapshots persists the events of the calendar if set
+	snapshots Store
+	// mu guards clients, which are added/removed by the service while the webhook goroutine forwards events to them
+	mu sync.RWMutex
 }
 
 // AddClient Add a clients, if the webhook is not running, then run it.
-func (w *webhookWithClients) AddClient(c *wsClient) {
+func (w *webhookWithClients) AddClient(c *subscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	// if this is the first clients being added, initialize
 	if w.clients == nil {
-		w.clients = make(map[string]*wsClient)
+		w.clients = make(map[string]*subscription)
 	}
 	if w.wh == nil {
 		calServ := c.GetCalendarService()
 		w.wh = calendarwh.New(calServ, c.calendarName, w.base+c.GetEmailAndCalendar(), w.logger)
+		if w.snapshots != nil {
+			w.wh.PersistTo(&calendarSnapshots{store: w.snapshots, userId: c.t.Id, calendarName: c.calendarName})
+		}
 	}
 
 	w.clients[c.id] = c
 
 	if !w.wh.IsRunning() {
-		go w.StartWebhookAndForwardToAllClients()
+		w.started = make(chan struct{})
+		go w.StartWebhookAndForwardToAllClients(w.started)
 	}
 }
 
 // RemoveClient remove a web socket clients, if it's the last one, tell google to stop updates to the webhook
 // it returns true if the list of clients is empty and webhook was stopped, false if there are still clients connected to that wh
-func (w *webhookWithClients) RemoveClient(c *wsClient) (bool, error) {
+func (w *webhookWithClients) RemoveClient(c *subscription) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	// find which of the clients listening to that email & calendar disconnected (you may have more than one)
 	_, found := w.clients[c.id]
 	if !found {
@@ -55,17 +72,73 @@ func (w *webhookWithClients) RemoveClient(c *wsClient) (bool, error) {
 	return noClientsLeft, nil
 }
 
-func (w *webhookWithClients) StartWebhookAndForwardToAllClients() error {
+// IsRunning tells whether google is pushing updates to the webhook
+func (w *webhookWithClients) IsRunning() bool {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.wh != nil && w.wh.IsRunning()
+}
+
+// Snapshot returns the events currently in the calendar if the webhook is running and synced
+func (w *webhookWithClients) Snapshot() ([]*calendar.Event, bool) {
+	w.mu.RLock()
+	wh := w.wh
+	w.mu.RUnlock()
+	if wh == nil || !wh.IsRunning() {
+		return nil, false
+	}
+	return wh.Snapshot()
+}
+
+// SnapshotUntil is Snapshot along with how far ahead it has every event
+func (w *webhookWithClients) SnapshotUntil() ([]*calendar.Event, time.Time, bool) {
+	w.mu.RLock()
+	wh := w.wh
+	w.mu.RUnlock()
+	if wh == nil || !wh.IsRunning() {
+		return nil, time.Time{}, false
+	}
+	return wh.SnapshotUntil()
+}
+
+// waitStarted waits up to timeout for the webhook to start (or fail to), a restored snapshot is ready once it has
+func (w *webhookWithClients) waitStarted(timeout time.Duration) {
+	w.mu.RLock()
+	started := w.started
+	w.mu.RUnlock()
+	if started == nil {
+		return
+	}
+	select {
+	case <-started:
+	case <-time.After(timeout):
+	}
+}
+
+func (w *webhookWithClients) StartWebhookAndForwardToAllClients(started chan struct{}) error {
 	events, err := w.wh.Start()
+	close(started)
 	if err != nil {
 		w.logger.Errorf("error starting webhook for clients: %v", err)
 		return err
 	}
 	// forward each one of the events received by the webhook to all the clients for that email + calendar
 	for e := range events {
-		for _, ws := range w.clients {
-			ws.SendEvent(e)
-		}
+		w.forward(e)
 	}
 	return nil
 }
+
+// forward sends the event to every client. The lock isn't held while sending, listeners may be waiting for the run loop, which may be
+// waiting for the lock to remove a client.
+func (w *webhookWithClients) forward(e *calendar.Event) {
+	w.mu.RLock()
+	clients := make([]*subscription, 0, len(w.clients))
+	for _, c := range w.clients {
+		clients = append(clients, c)
+	}
+	w.mu.RUnlock()
+	for _, c := range clients {
+		c.SendEvent(e)
+	}
+}
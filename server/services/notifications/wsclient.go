@@ -1,13 +1,17 @@
 package notifications
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/dchest/uniuri"
+	"github.com/gabzim/meetings/server/eventfilter"
+	"github.com/gabzim/meetings/server/services/audit"
 	"github.com/gabzim/meetings/server/services/auth"
 	"github.com/gorilla/websocket"
 	"google.golang.org/api/calendar/v3"
-	"google.golang.org/api/option"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,51 +19,231 @@ func generateId() string {
 	return uniuri.New()
 }
 
-func NewWsClient(s *Service, t *auth.UserToken, conn *websocket.Conn, calendarName string) *wsClient {
-	ts := s.cfg.TokenSource(context.Background(), t.GetOauthToken())
-	serv, _ := calendar.NewService(context.Background(), option.WithTokenSource(ts))
+func NewWsClient(s *Service, t *auth.UserToken, conn *websocket.Conn, calendarName string, protocol int, device string, origin audit.Origin, o *outbox) *wsClient {
 	c := wsClient{
 		id:               generateId(),
 		conn:             conn,
-		calendarName:     calendarName,
-		events:           make(chan *calendar.Event),
+		protocol:         protocol,
+		device:           device,
+		origin:           origin,
+		connectedAt:      time.Now(),
+		outbox:           o,
+		redelivered:      make(map[string]bool),
+		messages:         make(chan interface{}),
+		done:             make(chan struct{}),
+		subscriptions:    make(map[string]string),
 		t:                t,
 		notificationServ: s,
-		calendarServ:     serv,
 	}
 
+	if o != nil {
+		// the device may not have noticed its previous socket died, don't wait for the pongs to time out. The previous connection can't
+		// add events to the outbox anymore, the close frame may take a while to write on a dead socket.
+		if prev := o.attach(&c); prev != nil {
+			go prev.closeWith(CloseDeviceReplaced, "device "+device+" connected again")
+		}
+	}
+	c.touch()
 	c.conn.SetPongHandler(func(appData string) error {
+		c.touch()
 		c.conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
+	s.trackConnection(&c)
+	s.authServ.Audit(origin, t, audit.ActionConnect, audit.OutcomeSuccess, c.describe())
 
-	go c.ReadPump()
 	go c.WritePump()
 
+	if protocol == ProtocolLegacy || calendarName != "" {
+		// the controller already checked the token can read the calendar
+		var ack *Frame
+		if protocol == ProtocolV2 {
+			ack = &Frame{Type: FrameAck}
+		}
+		if _, err := c.subscribe(calendarName, nil, ack); err != nil && protocol == ProtocolV2 {
+			c.send(&Frame{Type: FrameError, Code: errorCode(err), Error: err.Error()})
+		}
+	}
+
+	if protocol == ProtocolV2 {
+		go c.ReadCommands()
+	} else {
+		go c.ReadPump()
+	}
+
 	return &c
 }
 
 type wsClient struct {
-	id               string
-	conn             *websocket.Conn
-	calendarName     string
-	events           chan *calendar.Event
+	id       string
+	conn     *websocket.Conn
+	protocol int
+	device   string
+	// origin is who opened the connection and from where
+	origin audit.Origin
+	// connectedAt and lastActivity (unix nanos of the last message or pong received) are shown to the user in the account page
+	connectedAt  time.Time
+	lastActivity atomic.Int64
+	// outbox tracks the event frames the device hasn't acked, nil if the client didn't identify its device. redelivered are the
+	// calendars its unacked frames were sent again for.
+	outbox      *outbox
+	redelivered map[string]bool
+	// messages to write to the socket, raw *calendar.Event for legacy clients, *Frame for V2 clients
+	messages chan interface{}
+	// done is closed when the connection is closed so no one blocks sending messages to it
+	done      chan struct{}
+	closeOnce sync.Once
+	// subscriptions maps the ids of the subscriptions of this connection to their calendar
+	mu               sync.Mutex
+	subscriptions    map[string]string
 	t                *auth.UserToken
 	notificationServ *Service
-	calendarServ     *calendar.Service
 }
 
-func (c *wsClient) GetCalendarService() *calendar.Service {
-	return c.calendarServ
+// describe tells the connection apart in the audit log
+func (c *wsClient) describe() string {
+	device := c.device
+	if device == "" {
+		device = "unnamed device"
+	}
+	return fmt.Sprintf("%v, protocol %v", device, c.protocol)
+}
+
+func (c *wsClient) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *wsClient) info() ConnectionInfo {
+	c.mu.Lock()
+	calendars := make([]string, 0, len(c.subscriptions))
+	for _, cal := range c.subscriptions {
+		calendars = append(calendars, cal)
+	}
+	c.mu.Unlock()
+	return ConnectionInfo{
+		Device:       c.device,
+		Protocol:     c.protocol,
+		RemoteAddr:   c.conn.RemoteAddr().String(),
+		ConnectedAt:  c.connectedAt,
+		LastActivity: time.Unix(0, c.lastActivity.Load()),
+		Calendars:    calendars,
+	}
+}
+
+// SendEvent queues an event of one of the connection subscriptions to be written to the socket
+func (c *wsClient) SendEvent(subscriptionId string, e *calendar.Event) {
+	if c.protocol == ProtocolLegacy {
+		c.send(e)
+		return
+	}
+	// it waits for subscribe to send the ack of a new subscription
+	c.mu.Lock()
+	calendarName, ok := c.subscriptions[subscriptionId]
+	c.mu.Unlock()
+	if !ok {
+		// unsubscribed while the event was on its way
+		return
+	}
+	f := &Frame{Type: FrameEvent, Subscription: subscriptionId, Event: e, calendar: calendarName}
+	if c.outbox != nil {
+		if f = c.outbox.add(c, f); f == nil {
+			// a newer connection of the device took the outbox
+			return
+		}
+	}
+	c.send(f)
+}
+
+// redeliver sends the frames the device didn't ack last time it was connected for the calendar it just subscribed to, once per
+// calendar. Frames of calendars it doesn't subscribe to again are dropped by its next ack. c.mu must be held.
+func (c *wsClient) redeliver(calendarName, subscriptionId string) {
+	if c.outbox == nil || c.redelivered[calendarName] {
+		return
+	}
+	c.redelivered[calendarName] = true
+	for _, f := range c.outbox.unacked(calendarName, subscriptionId) {
+		c.send(f)
+	}
+}
+
+// SendError tells the client a subscription stopped, legacy clients only have one so their connection is closed
+func (c *wsClient) SendError(subscriptionId string, err error) {
+	code := errorCode(err)
+	if c.protocol == ProtocolLegacy {
+		if code == ErrorReauthRequired {
+			c.closeWith(CloseReauthRequired, "google access revoked, sign in again")
+		} else {
+			c.closeWith(websocket.CloseNormalClosure, err.Error())
+		}
+		return
+	}
+	c.mu.Lock()
+	delete(c.subscriptions, subscriptionId)
+	c.mu.Unlock()
+	c.send(&Frame{Type: FrameError, Subscription: subscriptionId, Code: code, Error: err.Error()})
+}
+
+// errorCode is the code of the error frames for err, empty if clients have nothing to do about it
+func errorCode(err error) string {
+	if errors.Is(err, auth.ErrGrantRevoked) {
+		return ErrorReauthRequired
+	}
+	return ""
+}
+
+// send queues a message to be written to the socket, it's dropped if the connection is already closed
+func (c *wsClient) send(m interface{}) {
+	select {
+	case c.messages <- m:
+	case <-c.done:
+	}
+}
+
+// subscribe subscribes the connection to the calendar. ack (nil for legacy connections) is sent with the id of the subscription before
+// any of its events: the subscription is only handed to the run loop, which starts sending its events, once the ack and the redelivered
+// frames of the calendar are queued. The lock isn't held while waiting for the run loop, it may be waiting for us to take an event.
+func (c *wsClient) subscribe(calendarName string, filter *eventfilter.Filter, ack *Frame) (string, error) {
+	c.mu.Lock()
+	if len(c.subscriptions) >= maxConnectionSubscriptions {
+		c.mu.Unlock()
+		return "", ErrTooManySubscriptions
+	}
+	sub, err := c.notificationServ.newSubscription(c.t, calendarName, filter, c)
+	if err != nil {
+		c.mu.Unlock()
+		return "", err
+	}
+	c.subscriptions[sub.id] = calendarName
+	if ack != nil {
+		ack.Subscription = sub.id
+		c.send(ack)
+		c.redeliver(calendarName, sub.id)
+	}
+	c.mu.Unlock()
+	c.notificationServ.register <- sub
+	return sub.id, nil
 }
 
-func (c *wsClient) GetEmailAndCalendar() string {
-	return c.t.Email + "_" + c.calendarName
+func (c *wsClient) unsubscribe(id string) error {
+	c.mu.Lock()
+	_, ok := c.subscriptions[id]
+	delete(c.subscriptions, id)
+	c.mu.Unlock()
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	c.notificationServ.Unsubscribe(id)
+	return nil
 }
 
-// description
-func (c *wsClient) SendEvent(e *calendar.Event) {
-	c.events <- e
+func (c *wsClient) updateFilters(id string, filter *eventfilter.Filter) error {
+	c.mu.Lock()
+	_, ok := c.subscriptions[id]
+	c.mu.Unlock()
+	if !ok {
+		return ErrSubscriptionNotFound
+	}
+	return c.notificationServ.UpdateFilter(id, filter)
 }
 
 // ReadPump discards messages
@@ -70,8 +254,69 @@ func (c *wsClient) ReadPump() {
 			c.Close()
 			return
 		}
+		c.touch()
+	}
+}
+
+// ReadCommands reads the commands V2 clients send and answers each one with an ack or an error frame, except for event acks which get no answer
+func (c *wsClient) ReadCommands() {
+	for {
+		var cmd Command
+		err := c.conn.ReadJSON(&cmd)
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+			c.send(&Frame{Type: FrameError, Error: "malformed command: " + err.Error()})
+			continue
+		}
+		if err != nil {
+			c.Close()
+			return
+		}
+		c.touch()
+		if f := c.handleCommand(&cmd); f != nil {
+			c.send(f)
+		}
 	}
 }
+
+func (c *wsClient) handleCommand(cmd *Command) *Frame {
+	if cmd.Filters != nil {
+		if err := cmd.Filters.Validate(); err != nil {
+			return &Frame{Type: FrameError, Id: cmd.Id, Error: err.Error()}
+		}
+	}
+	switch cmd.Type {
+	case CommandAck:
+		if c.outbox == nil {
+			return &Frame{Type: FrameError, Id: cmd.Id, Error: "acks require connecting with a device"}
+		}
+		c.outbox.ack(cmd.Seq)
+		return nil
+	case CommandPing:
+		return &Frame{Type: FramePong, Id: cmd.Id}
+	case CommandSubscribe:
+		if cmd.Calendar == "" {
+			return &Frame{Type: FrameError, Id: cmd.Id, Error: "calendar is required"}
+		}
+		if _, err := c.subscribe(cmd.Calendar, cmd.Filters, &Frame{Type: FrameAck, Id: cmd.Id}); err != nil {
+			return &Frame{Type: FrameError, Id: cmd.Id, Code: errorCode(err), Error: err.Error()}
+		}
+		return nil
+	case CommandUnsubscribe:
+		if err := c.unsubscribe(cmd.Subscription); err != nil {
+			return &Frame{Type: FrameError, Id: cmd.Id, Subscription: cmd.Subscription, Error: err.Error()}
+		}
+		return &Frame{Type: FrameAck, Id: cmd.Id, Subscription: cmd.Subscription}
+	case CommandUpdateFilters:
+		if err := c.updateFilters(cmd.Subscription, cmd.Filters); err != nil {
+			return &Frame{Type: FrameError, Id: cmd.Id, Subscription: cmd.Subscription, Error: err.Error()}
+		}
+		return &Frame{Type: FrameAck, Id: cmd.Id, Subscription: cmd.Subscription}
+	}
+	return &Frame{Type: FrameError, Id: cmd.Id, Error: fmt.Sprintf("unknown command %q", cmd.Type)}
+}
+
 func (c *wsClient) WritePump() {
 	ping := time.NewTicker(10 * time.Second)
 	defer func() {
@@ -80,20 +325,16 @@ func (c *wsClient) WritePump() {
 	}()
 	for {
 		select {
+		case <-c.done:
+			return
 		case <-ping.C:
-			if c.conn == nil {
-				return
-			}
 			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
 			if err != nil {
 				return
 			}
-		case e := <-c.events:
-			if c.conn == nil {
-				return
-			}
+		case m := <-c.messages:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.conn.WriteJSON(e)
+			err := c.conn.WriteJSON(m)
 			if err != nil {
 				return
 			}
@@ -101,14 +342,33 @@ func (c *wsClient) WritePump() {
 	}
 }
 
+// closeWith sends a close frame with the code and text before closing the connection
+func (c *wsClient) closeWith(code int, text string) {
+	msg := websocket.FormatCloseMessage(code, text)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.Close()
+}
+
 func (c *wsClient) Close() {
-	if c.conn == nil {
-		return
-	}
-	err := c.conn.Close()
-	if err != nil {
-		fmt.Println(err)
-	}
-	c.notificationServ.UnregisterClient(c.id)
-	c.conn = nil
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if err := c.conn.Close(); err != nil {
+			c.notificationServ.logger.Warnw("could not close websocket connection: "+err.Error(), "email", c.t.Email, "device", c.device)
+		}
+		// events still on their way are dropped once the subscriptions are gone, Unsubscribe waits for the run loop so it's called
+		// without the lock
+		c.mu.Lock()
+		subscriptions := c.subscriptions
+		c.subscriptions = map[string]string{}
+		c.mu.Unlock()
+		for id := range subscriptions {
+			c.notificationServ.Unsubscribe(id)
+		}
+		if c.outbox != nil {
+			c.outbox.detach(c)
+		}
+		c.notificationServ.untrackConnection(c)
+		c.notificationServ.authServ.Audit(c.origin, c.t, audit.ActionDisconnect, audit.OutcomeSuccess,
+			fmt.Sprintf("%v, connected for %v", c.describe(), time.Since(c.connectedAt).Round(time.Second)))
+	})
 }
@@ -0,0 +1,153 @@
+package notifications
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+)
+
+// testService is a notifications service whose webhooks can't reach google, tests forward the events themselves
+func testService() *Service {
+	// without a token url every refresh fails right away
+	authServ := auth.NewService(zap.NewNop().Sugar(), nil, &oauth2.Config{}, nil)
+	return NewService(zap.NewNop().Sugar(), authServ, "http://localhost")
+}
+
+func (w *webhookWithClients) clientCount() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.clients)
+}
+
+// testConn returns the server side of a websocket connection, the client side reads every frame until it's closed
+func testConn(t *testing.T) *websocket.Conn {
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		for {
+			if _, _, err := client.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+	return <-conns
+}
+
+// TestCloseWhileForwarding closes connections with several subscriptions of a calendar while the webhook forwards events to them,
+// the run loop has to go on unregistering them
+func TestCloseWhileForwarding(t *testing.T) {
+	s := testService()
+	expired := time.Now().Add(-time.Hour)
+	user := &auth.UserToken{Id: 1, Email: "me@example.com", ExpiresAt: &expired}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// the hang needs an event waiting for the connection while it's closed, try a few times
+	for i := 0; i < 10; i++ {
+		c := NewWsClient(s, user, testConn(t), "", ProtocolV2, "", audit.Origin{}, nil)
+		for j := 0; j < 5; j++ {
+			if _, err := c.subscribe("primary", nil, &Frame{Type: FrameAck}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var wh *webhookWithClients
+		for wh == nil || wh.clientCount() < 5 {
+			if err := s.Ping(ctx); err != nil {
+				t.Fatal("the run loop didn't register the subscriptions")
+			}
+			s.clientsMu.RLock()
+			wh = s.clients[user.Email+"_primary"]
+			s.clientsMu.RUnlock()
+		}
+
+		stop := make(chan struct{})
+		forwarding := make(chan struct{})
+		go func() {
+			defer close(forwarding)
+			e := &calendar.Event{Id: "e1", Summary: "Standup"}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					wh.forward(e)
+				}
+			}
+		}()
+		closed := make(chan struct{})
+		go func() {
+			c.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-ctx.Done():
+			t.Fatal("closing the connection hung")
+		}
+		close(stop)
+		<-forwarding
+		for wh.clientCount() > 0 {
+			if err := s.Ping(ctx); err != nil {
+				t.Fatal("the run loop didn't unregister the subscriptions")
+			}
+		}
+	}
+}
+
+// TestDeviceReconnect connects a device again while its previous connection is still registered, the new one takes its outbox
+func TestDeviceReconnect(t *testing.T) {
+	s := testService()
+	expired := time.Now().Add(-time.Hour)
+	user := &auth.UserToken{Id: 1, Email: "me@example.com", ExpiresAt: &expired}
+	o := s.outboxes.get(user.Email, "office-pi")
+	prev := NewWsClient(s, user, testConn(t), "", ProtocolV2, "office-pi", audit.Origin{}, o)
+	subId, err := prev.subscribe("primary", nil, &Frame{Type: FrameAck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.SendEvent(subId, &calendar.Event{Id: "e1"})
+
+	c := NewWsClient(s, user, testConn(t), "", ProtocolV2, "office-pi", audit.Origin{}, o)
+	select {
+	case <-prev.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the previous connection wasn't closed")
+	}
+	prev.SendEvent(subId, &calendar.Event{Id: "e2"})
+	if o.size() != 1 {
+		t.Errorf("the outbox has %v events, want the one the previous connection didn't get acked", o.size())
+	}
+	newId, err := c.subscribe("primary", nil, &Frame{Type: FrameAck})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unacked := o.unacked("primary", newId); len(unacked) != 1 || unacked[0].Event.Id != "e1" {
+		t.Errorf("got unacked %v, want e1 for the new subscription", unacked)
+	}
+	prev.Close()
+	if o.expired() || o.add(c, &Frame{Type: FrameEvent}) == nil {
+		t.Error("closing the previous connection detached the outbox from the new one")
+	}
+}
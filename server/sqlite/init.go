@@ -0,0 +1,55 @@
+// Package sqlite stores everything in a single sqlite file, for servers with a handful of users that don't want to run postgres.
+// The stores run the same queries on it, it has migrations of its own.
+package sqlite
+
+import (
+	"context"
+	"embed"
+	"strings"
+
+	"github.com/gabzim/meetings/server/migrate"
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+func init() {
+	// the stores use postgres style placeholders, sqlite understands them too
+	sqlx.BindDriver("sqlite", sqlx.DOLLAR)
+}
+
+// Connect opens the database at url (sqlite:///path/to/meetings.db, or sqlite://meetings.db for a path relative to the working directory)
+// without touching its schema
+func Connect(url string) (*sqlx.DB, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(url, "sqlite:"), "//")
+	db, err := sqlx.Connect("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	// sqlite has a single writer anyway, one connection avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// CreateDB opens the database, creating the file if needed, and applies the pending migrations
+func CreateDB(url string) (*sqlx.DB, error) {
+	db, err := Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewMigrator returns a migrator for the sqlite migrations. There is no lock, only one server should open the file.
+func NewMigrator(db *sqlx.DB) (*migrate.Migrator, error) {
+	return migrate.NewMigrator(db, migrationFiles, "migrations", nil)
+}
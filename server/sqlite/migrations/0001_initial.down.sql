@@ -0,0 +1,5 @@
+DROP TABLE feed_tokens;
+DROP TABLE audit_log;
+DROP TABLE device_codes;
+DROP TABLE api_tokens;
+DROP TABLE user_tokens;
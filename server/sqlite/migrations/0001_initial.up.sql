@@ -0,0 +1,67 @@
+-- same schema as the postgres migrations up to 0001_text_columns
+CREATE TABLE user_tokens(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    access_token TEXT NOT NULL DEFAULT '',
+    refresh_token TEXT NOT NULL DEFAULT '',
+    meetings_token VARCHAR(64) UNIQUE,
+    email VARCHAR(255) UNIQUE NOT NULL,
+    first_name VARCHAR(50),
+    last_name VARCHAR(50),
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    share_freebusy BOOLEAN NOT NULL DEFAULT FALSE,
+    needs_reconsent BOOLEAN NOT NULL DEFAULT FALSE,
+    encrypted_tokens TEXT,
+    wrapped_key TEXT,
+    key_id VARCHAR(32),
+    granted_scopes TEXT
+);
+CREATE TABLE api_tokens(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    token VARCHAR(64) UNIQUE,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    token_prefix VARCHAR(8),
+    token_hash VARCHAR(64),
+    scopes TEXT
+);
+CREATE INDEX api_tokens_token_prefix ON api_tokens(token_prefix);
+CREATE TABLE device_codes(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_code_hash VARCHAR(64) UNIQUE NOT NULL,
+    user_code VARCHAR(9) NOT NULL,
+    device VARCHAR(100) NOT NULL DEFAULT '',
+    user_id INTEGER REFERENCES user_tokens(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    last_polled_at TIMESTAMP,
+    consumed_at TIMESTAMP
+);
+CREATE INDEX device_codes_user_code ON device_codes(user_code);
+-- audit_log rows are kept after the user is deleted, so user_id is not a foreign key
+CREATE TABLE audit_log(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    action VARCHAR(50) NOT NULL,
+    actor VARCHAR(50) NOT NULL,
+    detail TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX audit_log_user_id ON audit_log(user_id);
+CREATE TABLE feed_tokens(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    token VARCHAR(64) UNIQUE NOT NULL,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    calendar VARCHAR(255) NOT NULL DEFAULT 'primary',
+    filter TEXT NOT NULL DEFAULT '{}',
+    privacy VARCHAR(20) NOT NULL DEFAULT 'full',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
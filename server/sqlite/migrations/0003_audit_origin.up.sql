@@ -0,0 +1,11 @@
+-- who did it from where and how it went, and the addresses each api token was used from
+ALTER TABLE audit_log ADD COLUMN ip VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE audit_log ADD COLUMN outcome VARCHAR(16) NOT NULL DEFAULT 'success';
+CREATE INDEX audit_log_created_at ON audit_log(created_at);
+CREATE TABLE api_token_ips(
+    api_token_id INTEGER NOT NULL REFERENCES api_tokens(id) ON DELETE CASCADE,
+    ip VARCHAR(64) NOT NULL,
+    first_seen_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (api_token_id, ip)
+);
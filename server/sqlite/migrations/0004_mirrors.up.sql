@@ -0,0 +1,12 @@
+-- calendars whose busy times are copied into another calendar, maybe of another user
+CREATE TABLE mirrors(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    source_user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    source_calendar VARCHAR(255) NOT NULL,
+    target_user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    target_calendar VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP
+);
+CREATE INDEX mirrors_source_user_id ON mirrors(source_user_id);
+CREATE INDEX mirrors_target_user_id ON mirrors(target_user_id);
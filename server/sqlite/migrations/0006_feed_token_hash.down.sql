@@ -0,0 +1,16 @@
+-- feeds only known by their hash can't be used without it
+CREATE TABLE feed_tokens_plain(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    token VARCHAR(64) UNIQUE NOT NULL,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    calendar VARCHAR(255) NOT NULL DEFAULT 'primary',
+    filter TEXT NOT NULL DEFAULT '{}',
+    privacy VARCHAR(20) NOT NULL DEFAULT 'full',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+INSERT INTO feed_tokens_plain (id, user_id, token, label, calendar, filter, privacy, created_at, revoked_at)
+    SELECT id, user_id, token, label, calendar, filter, privacy, created_at, revoked_at FROM feed_tokens WHERE token IS NOT NULL;
+DROP TABLE feed_tokens;
+ALTER TABLE feed_tokens_plain RENAME TO feed_tokens;
@@ -0,0 +1,18 @@
+-- feed tokens are stored hashed, token only keeps the ones created before until they're first used.
+-- sqlite can't drop the NOT NULL of a column, the table is copied
+CREATE TABLE feed_tokens_hashed(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES user_tokens(id) ON DELETE CASCADE,
+    token VARCHAR(64) UNIQUE,
+    token_hash VARCHAR(64) UNIQUE,
+    label VARCHAR(100) NOT NULL DEFAULT '',
+    calendar VARCHAR(255) NOT NULL DEFAULT 'primary',
+    filter TEXT NOT NULL DEFAULT '{}',
+    privacy VARCHAR(20) NOT NULL DEFAULT 'full',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+INSERT INTO feed_tokens_hashed (id, user_id, token, label, calendar, filter, privacy, created_at, revoked_at)
+    SELECT id, user_id, token, label, calendar, filter, privacy, created_at, revoked_at FROM feed_tokens;
+DROP TABLE feed_tokens;
+ALTER TABLE feed_tokens_hashed RENAME TO feed_tokens;
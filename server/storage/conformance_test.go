@@ -0,0 +1,705 @@
+package storage
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gabzim/meetings/server/calendarwh"
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/feeds"
+	"github.com/gabzim/meetings/server/services/mirrors"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/calendar/v3"
+)
+
+// TestConformance runs the checks every implementation of the stores has to pass, so the services behave the same on every backend.
+// They always run on an in-memory sqlite database, and on postgres too if MEETINGS_TEST_POSTGRES_URL points to a scratch database.
+func TestConformance(t *testing.T) {
+	urls := map[string]string{"sqlite": "sqlite::memory:"}
+	if url := os.Getenv("MEETINGS_TEST_POSTGRES_URL"); url != "" {
+		urls["postgres"] = url
+	}
+	for backend, url := range urls {
+		t.Run(backend, func(t *testing.T) {
+			db, err := CreateDB(url)
+			if err != nil {
+				t.Fatalf("opening the database: %v", err)
+			}
+			defer db.Close()
+			runChecks(t, db, testKey(t, "test"))
+		})
+	}
+}
+
+// testKey returns a throwaway key to encrypt the google tokens with, in the format of MEETINGS_TOKEN_KEYS
+func testKey(t *testing.T, id string) string {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key)
+}
+
+// runChecks runs the checks in order on stores, later ones use what earlier ones created. They create a user with a random email and
+// delete it at the end. The google tokens are encrypted with key, db is only used to set up rows the stores can't create anymore and to
+// rotate the key.
+func runChecks(t *testing.T, db *sqlx.DB, key string) {
+	cipher, err := auth.ParseTokenKeys(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// google sends emails in lower case, the stores expect them that way
+	c := &checker{Stores: NewStores(db, cipher), email: "conformance-" + strings.ToLower(uniuri.NewLen(8)) + "@meetings.invalid"}
+	checks := []struct {
+		name string
+		f    func() error
+	}{
+		{"users: insert and select", c.insertUser},
+		{"users: upsert keeps id, refresh token and scopes", c.upsertUser},
+		{"users: select by email ignores case and spaces", c.selectByEmail},
+		{"users: unknown id", c.unknownUser},
+		{"users: free/busy sharing", c.shareFreeBusy},
+		{"users: refreshed google token", c.updateOauthToken},
+		{"users: reconsent and new grant", c.updateGrant},
+		{"users: reencrypt counts the users it updates", c.reencrypt(db, key, testKey(t, "next"))},
+		{"api tokens: insert, find by prefix and scopes", c.apiTokens},
+		{"api tokens: addresses used from", c.apiTokenIPs},
+		{"api tokens: last use and revocation", c.revokeAPIToken},
+		{"device codes: approve, poll and consume", c.deviceCodes},
+		{"device codes: expired ones are deleted", c.expiredDeviceCodes},
+		{"feeds: insert, select and revoke", c.feeds},
+		{"feeds: plain tokens are hashed", c.plainFeeds(db)},
+		{"audit: insert and select in order", c.audit},
+		{"audit: old entries are deleted", c.auditRetention},
+		{"snapshots: upsert, select and delete old ones", c.snapshots},
+		{"mirrors: insert with a rule, accept and delete", c.mirrors},
+		{"users: delete cascades but keeps audit", c.deleteUser},
+	}
+	for _, check := range checks {
+		t.Run(check.name, func(t *testing.T) {
+			if err := check.f(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	if c.user != nil && !c.deleted {
+		c.Tokens.DeleteUser(c.user.Id)
+	}
+}
+
+var errNoUser = errors.New("no user to check with")
+
+type checker struct {
+	Stores
+	email    string
+	user     *auth.UserToken
+	apiToken *auth.APIToken
+	deleted  bool
+}
+
+// sameTime compares times the way they come back from the database, some backends keep less precision than others
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	d := a.Sub(*b)
+	return d < time.Millisecond && d > -time.Millisecond
+}
+
+func (c *checker) insertUser() error {
+	expires := time.Now().Add(time.Hour)
+	t, err := c.Tokens.UpsertToken(&auth.UserToken{
+		AccessToken:   "access-1",
+		RefreshToken:  "refresh-1",
+		Email:         c.email,
+		FirstName:     "Con",
+		LastName:      "Formance",
+		ExpiresAt:     &expires,
+		GrantedScopes: "openid email",
+	})
+	if err != nil {
+		return err
+	}
+	if t.Id == 0 {
+		return errors.New("no id returned")
+	}
+	c.user = t
+	got, err := c.Tokens.SelectById(t.Id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case got.Email != c.email || got.FirstName != "Con" || got.LastName != "Formance":
+		return fmt.Errorf("got user %v %v %v", got.Email, got.FirstName, got.LastName)
+	case got.AccessToken != "access-1" || got.RefreshToken != "refresh-1":
+		return fmt.Errorf("google tokens don't round trip: %q %q", got.AccessToken, got.RefreshToken)
+	case !sameTime(got.ExpiresAt, &expires):
+		return fmt.Errorf("expires at %v, want %v", got.ExpiresAt, expires)
+	case got.GrantedScopes != "openid email":
+		return fmt.Errorf("granted scopes %q", got.GrantedScopes)
+	case got.ShareFreeBusy || got.NeedsReconsent:
+		return errors.New("new users share free/busy or need reconsent")
+	}
+	return nil
+}
+
+func (c *checker) upsertUser() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	expires := time.Now().Add(2 * time.Hour)
+	t, err := c.Tokens.UpsertToken(&auth.UserToken{AccessToken: "access-2", Email: c.email, ExpiresAt: &expires})
+	if err != nil {
+		return err
+	}
+	if t.Id != c.user.Id {
+		return fmt.Errorf("upsert returned id %v, want %v", t.Id, c.user.Id)
+	}
+	got, err := c.Tokens.SelectById(t.Id)
+	if err != nil {
+		return err
+	}
+	if got.AccessToken != "access-2" || got.RefreshToken != "refresh-1" {
+		return fmt.Errorf("got tokens %q %q, want access-2 refresh-1", got.AccessToken, got.RefreshToken)
+	}
+	if got.GrantedScopes != "openid email" {
+		return fmt.Errorf("granted scopes %q were not kept", got.GrantedScopes)
+	}
+	return nil
+}
+
+func (c *checker) selectByEmail() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	users, err := c.Tokens.SelectByEmail("  CONFORMANCE" + c.email[len("conformance"):] + " ")
+	if err != nil {
+		return err
+	}
+	if len(users) != 1 || users[0].Id != c.user.Id {
+		return fmt.Errorf("found %v users", len(users))
+	}
+	return nil
+}
+
+func (c *checker) unknownUser() error {
+	if _, err := c.Tokens.SelectById(-1); !errors.Is(err, auth.ErrUserNotFound) {
+		return fmt.Errorf("got %v, want %v", err, auth.ErrUserNotFound)
+	}
+	return nil
+}
+
+func (c *checker) shareFreeBusy() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	sharing, err := c.Tokens.SelectSharingFreeBusy([]string{c.email})
+	if err != nil {
+		return err
+	}
+	if len(sharing) != 0 {
+		return errors.New("users don't share free/busy until they opt in")
+	}
+	if err := c.Tokens.SetShareFreeBusy(c.user.Id, true); err != nil {
+		return err
+	}
+	if sharing, err = c.Tokens.SelectSharingFreeBusy([]string{"nobody@meetings.invalid", c.email}); err != nil {
+		return err
+	}
+	if len(sharing) != 1 || !sharing[0].ShareFreeBusy {
+		return fmt.Errorf("found %v users sharing", len(sharing))
+	}
+	if sharing, err = c.Tokens.SelectSharingFreeBusy(nil); err != nil || len(sharing) != 0 {
+		return fmt.Errorf("no emails found %v users, %v", len(sharing), err)
+	}
+	return nil
+}
+
+func (c *checker) updateOauthToken() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	expires := time.Now().Add(3 * time.Hour)
+	token := (&oauth2.Token{AccessToken: "access-3", Expiry: expires}).WithExtra(map[string]interface{}{"scope": "openid email calendar"})
+	if err := c.Tokens.UpdateOauthToken(c.user.Id, token); err != nil {
+		return err
+	}
+	got, err := c.Tokens.SelectById(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if got.AccessToken != "access-3" || got.RefreshToken != "refresh-1" || !sameTime(got.ExpiresAt, &expires) {
+		return fmt.Errorf("got %q %q %v", got.AccessToken, got.RefreshToken, got.ExpiresAt)
+	}
+	if got.GrantedScopes != "openid email calendar" {
+		return fmt.Errorf("granted scopes %q", got.GrantedScopes)
+	}
+	return nil
+}
+
+func (c *checker) updateGrant() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	if err := c.Tokens.MarkNeedsReconsent(c.user.Id); err != nil {
+		return err
+	}
+	if got, err := c.Tokens.SelectById(c.user.Id); err != nil || !got.NeedsReconsent {
+		return fmt.Errorf("user wasn't marked as needing reconsent: %v", err)
+	}
+	token := &oauth2.Token{AccessToken: "access-4", RefreshToken: "refresh-4", Expiry: time.Now().Add(time.Hour)}
+	if err := c.Tokens.UpdateGrant(c.user.Id, token, "openid calendar.events"); err != nil {
+		return err
+	}
+	got, err := c.Tokens.SelectById(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if got.NeedsReconsent || got.RefreshToken != "refresh-4" || got.GrantedScopes != "openid calendar.events" {
+		return fmt.Errorf("got reconsent %v, refresh token %q, scopes %q", got.NeedsReconsent, got.RefreshToken, got.GrantedScopes)
+	}
+	return nil
+}
+
+// reencrypt rotates the tokens of the users to next and back to key, they end up encrypted with key like the stores expect
+func (c *checker) reencrypt(db *sqlx.DB, key, next string) func() error {
+	return func() error {
+		if c.user == nil {
+			return errNoUser
+		}
+		for _, active := range []string{next, key} {
+			activeId, _, _ := strings.Cut(active, ":")
+			cipher, err := auth.ParseTokenKeys(key+","+next, activeId)
+			if err != nil {
+				return err
+			}
+			store := auth.NewTokenStore(db, cipher)
+			// other users could be in the database already
+			if n, err := store.Reencrypt(); err != nil || n < 1 {
+				return fmt.Errorf("reencrypting with %v updated %v users: %v", activeId, n, err)
+			}
+			if n, err := store.Reencrypt(); err != nil || n != 0 {
+				return fmt.Errorf("reencrypting with %v again updated %v users: %v", activeId, n, err)
+			}
+			got, err := store.SelectById(c.user.Id)
+			if err != nil {
+				return err
+			}
+			if got.KeyId != activeId || got.RefreshToken != "refresh-4" {
+				return fmt.Errorf("got key %v and refresh token %q", got.KeyId, got.RefreshToken)
+			}
+		}
+		return nil
+	}
+}
+
+func (c *checker) apiTokens() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	prefix := uniuri.NewLen(8)
+	scopes := &auth.Scopes{Calendars: []string{"primary"}, Capabilities: []string{auth.CapabilityREST}}
+	t, err := c.Tokens.InsertAPIToken(&auth.APIToken{UserId: c.user.Id, Label: "conformance", Prefix: prefix, Hash: "hash-" + prefix, Scopes: scopes})
+	if err != nil {
+		return err
+	}
+	c.apiToken = t
+	found, err := c.Tokens.SelectAPITokensByPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	if len(found) != 1 || found[0].Id != t.Id || found[0].Hash != "hash-"+prefix || found[0].Label != "conformance" {
+		return fmt.Errorf("found %v tokens by prefix", len(found))
+	}
+	if found[0].Scopes == nil || found[0].Scopes.String() != scopes.String() {
+		return fmt.Errorf("scopes %v don't round trip", found[0].Scopes)
+	}
+	if err := c.Tokens.HashAPIToken(t.Id, prefix, "rehashed-"+prefix); err != nil {
+		return err
+	}
+	byUser, err := c.Tokens.SelectAPITokensByUser(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if len(byUser) != 1 || byUser[0].Hash != "rehashed-"+prefix || byUser[0].CreatedAt == nil {
+		return fmt.Errorf("found %v tokens of the user", len(byUser))
+	}
+	return nil
+}
+
+func (c *checker) revokeAPIToken() error {
+	if c.apiToken == nil {
+		return errors.New("no api token to check with")
+	}
+	if err := c.Tokens.TouchAPIToken(c.apiToken); err != nil {
+		return err
+	}
+	if err := c.Tokens.RevokeAPIToken(c.user.Id+1, c.apiToken.Id); !errors.Is(err, auth.ErrAPITokenNotFound) {
+		return fmt.Errorf("revoking the token of another user got %v", err)
+	}
+	if err := c.Tokens.RevokeAPIToken(c.user.Id, c.apiToken.Id); err != nil {
+		return err
+	}
+	if err := c.Tokens.RevokeAPIToken(c.user.Id, c.apiToken.Id); !errors.Is(err, auth.ErrAPITokenNotFound) {
+		return fmt.Errorf("revoking twice got %v", err)
+	}
+	tokens, err := c.Tokens.SelectAPITokensByUser(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if len(tokens) != 1 || tokens[0].LastUsedAt == nil || tokens[0].RevokedAt == nil || tokens[0].IsValid() {
+		return errors.New("token wasn't touched and revoked")
+	}
+	return nil
+}
+
+func (c *checker) deviceCodes() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	now := time.Now()
+	d := &auth.DeviceCode{CodeHash: "conformance-" + uniuri.NewLen(16), UserCode: "BCDF-GHJK", Device: "conformance", CreatedAt: now, ExpiresAt: now.Add(10 * time.Minute)}
+	if err := c.Tokens.InsertDeviceCode(d); err != nil {
+		return err
+	}
+	byUserCode, err := c.Tokens.SelectDeviceCodeByUserCode("BCDF-GHJK")
+	if err != nil {
+		return err
+	}
+	if byUserCode.Id != d.Id || byUserCode.Device != "conformance" || byUserCode.UserId.Valid {
+		return fmt.Errorf("got device code %v for user %v", byUserCode.Id, byUserCode.UserId)
+	}
+	if err := c.Tokens.ApproveDeviceCode(d.Id, c.user.Id); err != nil {
+		return err
+	}
+	if err := c.Tokens.ApproveDeviceCode(d.Id, c.user.Id); !errors.Is(err, auth.ErrDeviceCodeApproved) {
+		return fmt.Errorf("approving twice returned %v, want %v", err, auth.ErrDeviceCodeApproved)
+	}
+	if err := c.Tokens.TouchDeviceCode(d.Id, now); err != nil {
+		return err
+	}
+	byHash, err := c.Tokens.SelectDeviceCodeByHash(d.CodeHash)
+	if err != nil {
+		return err
+	}
+	if byHash.UserId != (sql.NullInt64{Int64: c.user.Id, Valid: true}) || !sameTime(byHash.LastPolledAt, &now) || byHash.IsExpired() {
+		return fmt.Errorf("device code wasn't approved and polled: %+v", byHash)
+	}
+	if consumed, err := c.Tokens.ConsumeDeviceCode(d.Id); err != nil || !consumed {
+		return fmt.Errorf("first consume got %v %v", consumed, err)
+	}
+	if consumed, err := c.Tokens.ConsumeDeviceCode(d.Id); err != nil || consumed {
+		return fmt.Errorf("second consume got %v %v", consumed, err)
+	}
+	if _, err := c.Tokens.SelectDeviceCodeByUserCode("BCDF-GHJK"); !errors.Is(err, auth.ErrDeviceCodeNotFound) {
+		return fmt.Errorf("consumed code found by user code: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) expiredDeviceCodes() error {
+	created := time.Now().Add(-48 * time.Hour)
+	d := &auth.DeviceCode{CodeHash: "conformance-" + uniuri.NewLen(16), UserCode: "ZZZZ-ZZZZ", CreatedAt: created, ExpiresAt: created.Add(10 * time.Minute)}
+	if err := c.Tokens.InsertDeviceCode(d); err != nil {
+		return err
+	}
+	if err := c.Tokens.DeleteExpiredDeviceCodes(); err != nil {
+		return err
+	}
+	if _, err := c.Tokens.SelectDeviceCodeByHash(d.CodeHash); !errors.Is(err, auth.ErrDeviceCodeNotFound) {
+		return fmt.Errorf("expired code wasn't deleted: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) feeds() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	f, err := c.Feeds.Insert(&feeds.FeedToken{UserId: c.user.Id, TokenHash: "hash-" + c.email, Label: "conformance", Calendar: "primary", FilterRaw: `{"status":["confirmed"]}`, Privacy: "full"})
+	if err != nil {
+		return err
+	}
+	if f.Id == 0 {
+		return errors.New("feed has no id")
+	}
+	got, err := c.Feeds.SelectByHash(f.TokenHash)
+	if err != nil {
+		return err
+	}
+	if got.Id != f.Id || got.FilterRaw != f.FilterRaw || got.Privacy != "full" || got.CreatedAt == nil || got.Token != "" {
+		return fmt.Errorf("got feed %+v", got)
+	}
+	if _, err := c.Feeds.SelectByPlainToken(f.TokenHash); !errors.Is(err, feeds.ErrFeedNotFound) {
+		return fmt.Errorf("hashed feed found by plain token: %v", err)
+	}
+	if err := c.Feeds.Revoke(c.user.Id+1, f.Id); !errors.Is(err, feeds.ErrFeedNotFound) {
+		return fmt.Errorf("revoking the feed of another user got %v", err)
+	}
+	if err := c.Feeds.Revoke(c.user.Id, f.Id); err != nil {
+		return err
+	}
+	if _, err := c.Feeds.SelectByHash(f.TokenHash); !errors.Is(err, feeds.ErrFeedNotFound) {
+		return fmt.Errorf("revoked feed found by hash: %v", err)
+	}
+	byUser, err := c.Feeds.SelectByUser(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if len(byUser) != 1 || byUser[0].RevokedAt == nil || byUser[0].Token != "" {
+		return fmt.Errorf("found %v feeds of the user", len(byUser))
+	}
+	return nil
+}
+
+// plainFeeds checks feeds created before tokens were hashed are found by their token until they're hashed
+func (c *checker) plainFeeds(db *sqlx.DB) func() error {
+	return func() error {
+		if c.user == nil {
+			return errNoUser
+		}
+		token := "plain-" + c.email
+		if _, err := db.Exec(db.Rebind("INSERT INTO feed_tokens (user_id, token, label) VALUES (?, ?, 'plain')"), c.user.Id, token); err != nil {
+			return err
+		}
+		f, err := c.Feeds.SelectByPlainToken(token)
+		if err != nil {
+			return err
+		}
+		if err := c.Feeds.HashToken(f.Id, "hash-"+token); err != nil {
+			return err
+		}
+		if _, err := c.Feeds.SelectByPlainToken(token); !errors.Is(err, feeds.ErrFeedNotFound) {
+			return fmt.Errorf("feed found by plain token after hashing it: %v", err)
+		}
+		got, err := c.Feeds.SelectByHash("hash-" + token)
+		if err != nil {
+			return err
+		}
+		if got.Id != f.Id {
+			return fmt.Errorf("got feed %v, want %v", got.Id, f.Id)
+		}
+		return c.Feeds.Revoke(c.user.Id, f.Id)
+	}
+}
+
+func (c *checker) audit() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	origin := audit.Origin{Actor: audit.TokenActor(1), IP: "192.0.2.1", UserAgent: "conformance"}
+	for _, action := range []string{audit.ActionAccountExport, audit.ActionAccountDelete} {
+		e := &audit.Entry{UserId: c.user.Id, Email: c.email, Action: action, Origin: origin, Detail: "conformance"}
+		if err := c.Audit.Insert(e); err != nil {
+			return err
+		}
+		if e.Id == 0 {
+			return errors.New("entry has no id")
+		}
+	}
+	entries, err := c.Audit.SelectByUser(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 2 || entries[0].Action != audit.ActionAccountExport || entries[1].Action != audit.ActionAccountDelete {
+		return fmt.Errorf("found %v entries", len(entries))
+	}
+	if entries[0].Origin != origin || entries[0].Outcome != audit.OutcomeSuccess {
+		return fmt.Errorf("got origin %+v and outcome %q", entries[0].Origin, entries[0].Outcome)
+	}
+	page, err := c.Audit.SelectPage(c.user.Id, 0, 1)
+	if err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].Id != entries[1].Id {
+		return fmt.Errorf("first page has %v entries", len(page))
+	}
+	if page, err = c.Audit.SelectPage(c.user.Id, page[0].Id, 10); err != nil {
+		return err
+	}
+	if len(page) != 1 || page[0].Id != entries[0].Id {
+		return fmt.Errorf("second page has %v entries", len(page))
+	}
+	return nil
+}
+
+func (c *checker) auditRetention() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	old := &audit.Entry{UserId: c.user.Id, Email: c.email, Action: audit.ActionLogin, Origin: audit.CLI, Outcome: audit.OutcomeFailure, CreatedAt: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := c.Audit.Insert(old); err != nil {
+		return err
+	}
+	n, err := c.Audit.DeleteBefore(time.Date(2000, 1, 2, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		return err
+	}
+	if n < 1 {
+		return errors.New("old entry wasn't deleted")
+	}
+	entries, err := c.Audit.SelectByUser(c.user.Id)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.Id == old.Id {
+			return errors.New("old entry is still there")
+		}
+	}
+	if len(entries) != 2 {
+		return fmt.Errorf("recent entries were deleted, %v left", len(entries))
+	}
+	return nil
+}
+
+func (c *checker) apiTokenIPs() error {
+	if c.apiToken == nil {
+		return errors.New("no api token to check with")
+	}
+	for i, want := range []bool{true, false} {
+		isNew, err := c.Tokens.InsertAPITokenIP(c.apiToken.Id, "192.0.2.1", time.Now())
+		if err != nil {
+			return err
+		}
+		if isNew != want {
+			return fmt.Errorf("use %v from the same address is new: %v", i+1, isNew)
+		}
+	}
+	if isNew, err := c.Tokens.InsertAPITokenIP(c.apiToken.Id, "2001:db8::1", time.Now()); err != nil || !isNew {
+		return fmt.Errorf("another address isn't new: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) deleteUser() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	if err := c.Tokens.DeleteUser(c.user.Id); err != nil {
+		return err
+	}
+	c.deleted = true
+	if _, err := c.Tokens.SelectById(c.user.Id); !errors.Is(err, auth.ErrUserNotFound) {
+		return fmt.Errorf("deleted user found: %v", err)
+	}
+	if tokens, err := c.Tokens.SelectAPITokensByUser(c.user.Id); err != nil || len(tokens) != 0 {
+		return fmt.Errorf("api tokens of the user left: %v %v", len(tokens), err)
+	}
+	if userFeeds, err := c.Feeds.SelectByUser(c.user.Id); err != nil || len(userFeeds) != 0 {
+		return fmt.Errorf("feeds of the user left: %v %v", len(userFeeds), err)
+	}
+	if snapshot, err := c.Snapshots.SelectSnapshot(c.user.Id, "primary"); err != nil || snapshot != nil {
+		return fmt.Errorf("snapshot of the user left: %v", err)
+	}
+	if userMirrors, err := c.Mirrors.SelectByUser(c.user.Id); err != nil || len(userMirrors) != 0 {
+		return fmt.Errorf("mirrors of the user left: %v %v", len(userMirrors), err)
+	}
+	entries, err := c.Audit.SelectByUser(c.user.Id)
+	if err != nil {
+		return err
+	}
+	if len(entries) != 2 {
+		return fmt.Errorf("audit entries of the user were deleted, %v left", len(entries))
+	}
+	return nil
+}
+
+func (c *checker) snapshots() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	if snapshot, err := c.Snapshots.SelectSnapshot(c.user.Id, "primary"); err != nil || snapshot != nil {
+		return fmt.Errorf("got snapshot %v before saving one: %v", snapshot, err)
+	}
+	old := time.Now().Add(-time.Hour)
+	err := c.Snapshots.UpsertSnapshot(c.user.Id, "old", &calendarwh.Snapshot{SyncToken: "sync-old", SyncedAt: old, Events: []*calendar.Event{}})
+	if err != nil {
+		return err
+	}
+	for _, token := range []string{"sync-1", "sync-2"} {
+		snapshot := &calendarwh.Snapshot{
+			SyncToken: token,
+			SyncedAt:  time.Now(),
+			Events:    []*calendar.Event{{Id: "event-1", Summary: token, Start: &calendar.EventDateTime{DateTime: "2023-05-01T10:00:00Z"}}},
+		}
+		if err := c.Snapshots.UpsertSnapshot(c.user.Id, "primary", snapshot); err != nil {
+			return err
+		}
+	}
+	got, err := c.Snapshots.SelectSnapshot(c.user.Id, "primary")
+	if err != nil {
+		return err
+	}
+	if got == nil || got.SyncToken != "sync-2" || len(got.Events) != 1 || got.Events[0].Summary != "sync-2" || got.Events[0].Start.DateTime != "2023-05-01T10:00:00Z" {
+		return fmt.Errorf("got snapshot %+v", got)
+	}
+	if err := c.Snapshots.DeleteSnapshotsBefore(old.Add(time.Minute)); err != nil {
+		return err
+	}
+	if snapshot, err := c.Snapshots.SelectSnapshot(c.user.Id, "old"); err != nil || snapshot != nil {
+		return fmt.Errorf("old snapshot wasn't deleted: %v", err)
+	}
+	if snapshot, err := c.Snapshots.SelectSnapshot(c.user.Id, "primary"); err != nil || snapshot == nil {
+		return fmt.Errorf("recent snapshot was deleted: %v", err)
+	}
+	return nil
+}
+
+func (c *checker) mirrors() error {
+	if c.user == nil {
+		return errNoUser
+	}
+	m := &mirrors.Mirror{SourceUserId: c.user.Id, SourceCalendar: "primary", TargetUserId: c.user.Id, TargetCalendar: "work", RuleRaw: `{"prefix":"[home] "}`}
+	if err := c.Mirrors.Insert(m); err != nil {
+		return err
+	}
+	if m.Id == 0 {
+		return errors.New("mirror has no id")
+	}
+	got, err := c.Mirrors.SelectById(m.Id)
+	if err != nil {
+		return err
+	}
+	if got.SourceEmail != c.email || got.TargetEmail != c.email || got.TargetCalendar != "work" || got.AcceptedAt != nil || got.RuleRaw != m.RuleRaw {
+		return fmt.Errorf("got mirror %+v", got)
+	}
+	if err := c.Mirrors.Accept(m.Id, c.user.Id+1, time.Now()); !errors.Is(err, mirrors.ErrMirrorNotFound) {
+		return fmt.Errorf("accepting the mirror of another user got %v", err)
+	}
+	if err := c.Mirrors.Accept(m.Id, c.user.Id, time.Now()); err != nil {
+		return err
+	}
+	accepted, err := c.Mirrors.SelectAccepted()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, a := range accepted {
+		found = found || a.Id == m.Id && a.AcceptedAt != nil
+	}
+	if !found {
+		return errors.New("accepted mirror not found")
+	}
+	if err := c.Mirrors.Delete(m.Id, c.user.Id+1); !errors.Is(err, mirrors.ErrMirrorNotFound) {
+		return fmt.Errorf("deleting the mirror of another user got %v", err)
+	}
+	if err := c.Mirrors.Delete(m.Id, c.user.Id); err != nil {
+		return err
+	}
+	if _, err := c.Mirrors.SelectById(m.Id); !errors.Is(err, mirrors.ErrMirrorNotFound) {
+		return fmt.Errorf("deleted mirror found: %v", err)
+	}
+	// one left for deleteUser
+	return c.Mirrors.Insert(&mirrors.Mirror{SourceUserId: c.user.Id, SourceCalendar: "primary", TargetUserId: c.user.Id, TargetCalendar: "work"})
+}
@@ -0,0 +1,44 @@
+// Package storage opens the database MEETINGS_DB_URL points to, postgres or sqlite depending on its scheme.
+package storage
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gabzim/meetings/server/migrate"
+	"github.com/gabzim/meetings/server/postgres"
+	"github.com/gabzim/meetings/server/sqlite"
+	"github.com/jmoiron/sqlx"
+)
+
+// IsSQLite tells whether url points to a sqlite database (sqlite://...), anything else is a postgres url
+func IsSQLite(url string) bool {
+	return strings.HasPrefix(url, "sqlite:")
+}
+
+// Connect opens the database at url without touching its schema
+func Connect(url string) (*sqlx.DB, error) {
+	if IsSQLite(url) {
+		return sqlite.Connect(url)
+	}
+	return postgres.Connect(url)
+}
+
+// CreateDB opens the database at url and applies its pending migrations
+func CreateDB(url string) (*sqlx.DB, error) {
+	if IsSQLite(url) {
+		return sqlite.CreateDB(url)
+	}
+	return postgres.CreateDB(url)
+}
+
+// NewMigrator returns the migrator for the backend db was opened with
+func NewMigrator(db *sqlx.DB) (*migrate.Migrator, error) {
+	switch db.DriverName() {
+	case "sqlite":
+		return sqlite.NewMigrator(db)
+	case "postgres":
+		return postgres.NewMigrator(db)
+	}
+	return nil, fmt.Errorf("no migrations for driver %v", db.DriverName())
+}
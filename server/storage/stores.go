@@ -0,0 +1,31 @@
+package storage
+
+import (
+	"github.com/gabzim/meetings/server/services/audit"
+	"github.com/gabzim/meetings/server/services/auth"
+	"github.com/gabzim/meetings/server/services/feeds"
+	"github.com/gabzim/meetings/server/services/mirrors"
+	"github.com/gabzim/meetings/server/services/notifications"
+	"github.com/jmoiron/sqlx"
+)
+
+// Stores are the stores the services keep their data in
+type Stores struct {
+	Tokens  auth.Store
+	Feeds   feeds.Store
+	Audit   audit.Store
+	Mirrors mirrors.Store
+	// Snapshots are only used when MEETINGS_PERSIST_SNAPSHOTS is on
+	Snapshots notifications.Store
+}
+
+// NewStores returns the sql stores on db, they run the same queries on postgres and sqlite
+func NewStores(db *sqlx.DB, cipher *auth.TokenCipher) Stores {
+	return Stores{
+		Tokens:    auth.NewTokenStore(db, cipher),
+		Feeds:     feeds.NewFeedStore(db),
+		Audit:     audit.NewEntryStore(db),
+		Mirrors:   mirrors.NewMirrorStore(db),
+		Snapshots: notifications.NewSnapshotStore(db),
+	}
+}